@@ -0,0 +1,196 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.dumpstack.io/tools/donate/database"
+)
+
+// approve the pending payout and send it, the payout stays pending
+// if the wallets backend can't send it (split payouts held by older
+// versions)
+func approve(db *database.DB, wallets Wallets, id int64) (
+	payout database.IssuePayout, err error) {
+
+	payout, err = database.GetIssuePayout(db, id)
+	if err != nil {
+		return
+	}
+	if !canSend(wallets, payout.Payout) {
+		err = errSplitNotSupported
+		return
+	}
+
+	payout, seed, err := database.ApprovePayout(db, id,
+		time.Now().Add(retryLease))
+	if err != nil {
+		return
+	}
+
+	tx, serr := sendPayout(wallets, payout.Payout, seed)
+	next := nextAttempt(time.Now(), payout.Attempts+1, serr)
+	if serr != nil {
+		log.Println("sendall error", serr)
+		payout.Status = database.PayoutFailed
+		payout.Error = serr.Error()
+		if next.IsZero() {
+			payout.Status = database.PayoutAbandoned
+		}
+	} else {
+		payout.Status = database.PayoutSent
+		payout.Tx = tx
+	}
+
+	err = database.SetPayoutResult(db, id, tx, serr, next)
+	return
+}
+
+func formatPayout(p database.IssuePayout) (s string) {
+	s = fmt.Sprintf("%d\t%s#%d\t%s\t%s -> %s (%s)", p.ID, p.Repo,
+		p.Issue, strings.ToUpper(p.Type.Symbol()), p.Source,
+		p.Destination, p.Reason)
+	for _, share := range p.Shares {
+		s += fmt.Sprintf(", %s x%g", share.Destination, share.Weight)
+	}
+	if p.Fee != 0 {
+		s += fmt.Sprintf(", %g%% -> %s (fee)", p.Fee, p.FeeDestination)
+	}
+	if p.Hold != "" {
+		s += fmt.Sprintf(", held: %s", p.Hold)
+	}
+	return
+}
+
+// approvalCommand implements pending, approve and reject subcommands
+func approvalCommand(db *database.DB, wallets Wallets, command string,
+	ids []int64) (err error) {
+
+	if command == "pending" {
+		var payouts []database.IssuePayout
+		payouts, err = database.PayoutsByStatus(db, database.PayoutPending)
+		if err != nil {
+			return
+		}
+		for _, p := range payouts {
+			fmt.Println(formatPayout(p))
+		}
+		return
+	}
+
+	for _, id := range ids {
+		switch command {
+		case "approve":
+			var p database.IssuePayout
+			p, err = approve(db, wallets, id)
+			if err != nil {
+				return
+			}
+			fmt.Println(formatPayout(p), p.Status, p.Tx, p.Error)
+		case "reject":
+			err = database.RejectPayout(db, id)
+			if err != nil {
+				return
+			}
+			fmt.Println(id, database.PayoutRejected)
+		}
+	}
+	return
+}
+
+// pendingHandler lists pending payouts of the repo, or of all repos
+// if no repo is set (requires the admin token)
+func pendingHandler(db *database.DB, w http.ResponseWriter, r *http.Request) {
+	payouts, err := database.PayoutsByStatus(db, database.PayoutPending)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	repo := r.URL.Query().Get("repo")
+	var filtered []database.IssuePayout
+	for _, p := range payouts {
+		if repo == "" || p.Repo == repo {
+			filtered = append(filtered, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
+
+// approveHandler approves (or rejects, if reject is true) the
+// pending payout by id, the request is authenticated for the repo
+// of the payout
+func approveHandler(db *database.DB, wallets Wallets, creds credentials,
+	w http.ResponseWriter, r *http.Request, reject bool) {
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "invalid id")
+		return
+	}
+
+	p, err := database.GetIssuePayout(db, id)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "payout not found")
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = authenticateRepo(creds, p.Repo, r)
+	if err != nil {
+		log.Println("auth:", r.URL, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "unauthorized")
+		return
+	}
+
+	if reject {
+		err = database.RejectPayout(db, id)
+		if err == nil {
+			fmt.Fprintln(w, database.PayoutRejected)
+			return
+		}
+	} else {
+		var payout database.IssuePayout
+		payout, err = approve(db, wallets, id)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(payout)
+			return
+		}
+	}
+
+	switch err {
+	case database.ErrNotPending, errSplitNotSupported:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, err)
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
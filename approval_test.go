@@ -0,0 +1,148 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func TestPayApproval(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 1, forge.PullRequest{
+		Number: 2,
+		Body:   "BTC{contributor}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	pay := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET",
+			"/pay?repo=github.com/owner/project&issue=1", nil)
+		w := httptest.NewRecorder()
+		payHandler(db, wallets, forges, context.Background(), w, r,
+			testConfig(nil, true))
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := pay()
+		if w.Code != http.StatusAccepted {
+			t.Fatal("unexpected status", w.Code, w.Body.String())
+		}
+	}
+	if len(wallets.sent()) != 0 {
+		t.Fatal("payout is sent without approval")
+	}
+
+	pending, err := database.PayoutsByStatus(db, database.PayoutPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(c.Cryptocurrencies) {
+		t.Fatal("invalid amount of pending payouts", len(pending))
+	}
+
+	creds := credentials{
+		admin: "admin",
+		repos: map[string]string{
+			"github.com/owner/project": "repo",
+			"github.com/owner/other":   "other",
+		},
+	}
+	approve := func(method string, id int64,
+		token string) *httptest.ResponseRecorder {
+
+		r := httptest.NewRequest(method,
+			"/approve?id="+strconv.FormatInt(id, 10), nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		approveHandler(db, wallets, creds, w, r, false)
+		return w
+	}
+
+	if w := approve("GET", pending[0].ID, "repo"); w.Code !=
+		http.StatusMethodNotAllowed {
+
+		t.Fatal("payout is approved with GET", w.Code)
+	}
+	if w := approve("POST", pending[0].ID, "other"); w.Code !=
+		http.StatusUnauthorized {
+
+		t.Fatal("payout is approved with token of other repo", w.Code)
+	}
+
+	for _, p := range pending {
+		if p.Repo != issue.Repo || p.Issue != issue.ID ||
+			p.Source != issue.Wallets[p.Type].Address {
+
+			t.Fatal("invalid pending payout", p)
+		}
+
+		if p.Type == c.Bitcoin {
+			if p.Destination != "contributor" ||
+				p.Reason != database.ReasonContributor {
+
+				t.Fatal("invalid pending payout", p)
+			}
+
+			w := approve("POST", p.ID, "repo")
+			if w.Code != http.StatusOK {
+				t.Fatal("not approved", w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		err = database.RejectPayout(db, p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(wallets.sent()) != 1 || wallets.sent()[0] != "contributor" {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+
+	w := approve("POST", pending[0].ID, "admin")
+	if w.Code != http.StatusConflict {
+		t.Fatal("payout is approved twice", w.Code)
+	}
+
+	w = pay()
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	transactions := make(map[c.Cryptocurrency]string)
+	err = json.NewDecoder(w.Body).Decode(&transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transactions[c.Bitcoin] != "tx-"+issue.Wallets[c.Bitcoin].Seed {
+		t.Fatal("invalid transactions", transactions)
+	}
+}
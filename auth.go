@@ -0,0 +1,131 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSignatureAge of the HMAC-signed request
+const maxSignatureAge = 5 * time.Minute
+
+// credentials for the authenticated endpoints, the admin token is
+// valid for all repositories. Without any tokens requests are
+// rejected unless insecure is set explicitly.
+type credentials struct {
+	admin    string
+	repos    map[string]string
+	insecure bool
+}
+
+func (creds credentials) empty() bool {
+	return creds.admin == "" && len(creds.repos) == 0
+}
+
+// tokens that are valid for the repo
+func (creds credentials) tokens(repo string) (tokens []string) {
+	if creds.admin != "" {
+		tokens = append(tokens, creds.admin)
+	}
+	if token, ok := creds.repos[repo]; ok && token != "" {
+		tokens = append(tokens, token)
+	}
+	return
+}
+
+// signRequest returns the X-Donate-Signature header value for the
+// request URI (path and query) signed at the timestamp (unix time)
+func signRequest(token, uri string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%d\n%s", timestamp, uri)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate the request with either "Authorization: Bearer TOKEN"
+// or the HMAC-SHA256 signature in X-Donate-Signature over the
+// X-Donate-Timestamp and the request URI
+func authenticate(creds credentials, r *http.Request) (err error) {
+	return authenticateRepo(creds, r.URL.Query().Get("repo"), r)
+}
+
+// authenticateRepo is the same as authenticate, but for the repo that
+// is not in the query
+func authenticateRepo(creds credentials, repo string, r *http.Request) (
+	err error) {
+
+	tokens := creds.tokens(repo)
+	if len(tokens) == 0 {
+		err = errors.New("no credentials for repo")
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		bearer := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, token := range tokens {
+			if subtle.ConstantTimeCompare(bearer, []byte(token)) == 1 {
+				return
+			}
+		}
+		err = errors.New("invalid token")
+		return
+	}
+
+	signature := r.Header.Get("X-Donate-Signature")
+	if signature == "" {
+		err = errors.New("no credentials provided")
+		return
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Donate-Timestamp"),
+		10, 64)
+	if err != nil {
+		err = errors.New("invalid timestamp")
+		return
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > maxSignatureAge || age < -maxSignatureAge {
+		err = errors.New("signature is expired")
+		return
+	}
+
+	for _, token := range tokens {
+		expected := signRequest(token, r.URL.RequestURI(), timestamp)
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return
+		}
+	}
+	err = errors.New("invalid signature")
+	return
+}
+
+// requireAuth wraps the handler, requests are passed through without
+// authentication only if no credentials are configured at all and
+// it's allowed by insecure
+func requireAuth(creds credentials, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !creds.empty() || !creds.insecure {
+			err := authenticate(creds, r)
+			if err != nil {
+				log.Println("auth:", r.URL, err)
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, "unauthorized")
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequireAuth(t *testing.T) {
+	creds := credentials{
+		admin: "admin",
+		repos: map[string]string{"github.com/owner/project": "repo"},
+	}
+
+	handler := requireAuth(creds, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	uri := "/pay?repo=github.com/owner/project&issue=1"
+	other := "/pay?repo=github.com/owner/other&issue=1"
+	now := time.Now().Unix()
+	stale := time.Now().Add(-time.Hour).Unix()
+
+	for _, tc := range []struct {
+		uri       string
+		header    map[string]string
+		forbidden bool
+	}{
+		{uri, nil, true},
+		{uri, map[string]string{"Authorization": "Bearer admin"}, false},
+		{uri, map[string]string{"Authorization": "Bearer repo"}, false},
+		{uri, map[string]string{"Authorization": "Bearer wrong"}, true},
+		{other, map[string]string{"Authorization": "Bearer admin"}, false},
+		{other, map[string]string{"Authorization": "Bearer repo"}, true},
+		{uri, map[string]string{
+			"X-Donate-Timestamp": fmt.Sprint(now),
+			"X-Donate-Signature": signRequest("repo", uri, now),
+		}, false},
+		{uri, map[string]string{
+			"X-Donate-Timestamp": fmt.Sprint(now),
+			"X-Donate-Signature": signRequest("repo", other, now),
+		}, true},
+		{uri, map[string]string{
+			"X-Donate-Timestamp": fmt.Sprint(stale),
+			"X-Donate-Signature": signRequest("repo", uri, stale),
+		}, true},
+	} {
+		r := httptest.NewRequest("GET", tc.uri, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if (w.Code == http.StatusUnauthorized) != tc.forbidden {
+			t.Fatal(tc.uri, tc.header, "unexpected status", w.Code)
+		}
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}
+
+	w := httptest.NewRecorder()
+	requireAuth(credentials{}, ok)(w, httptest.NewRequest("GET", uri, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("request is accepted without credentials configured")
+	}
+
+	w = httptest.NewRecorder()
+	requireAuth(credentials{insecure: true}, ok)(w,
+		httptest.NewRequest("GET", uri, nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("insecure request is rejected", w.Code)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+)
+
+// dropTimeout after which the transaction that is not found
+// in the chain is considered as dropped. Dropped payouts are
+// only sent again by the operator (resend command).
+const dropTimeout = 24 * time.Hour
+
+// Chain backend to check transactions
+type Chain interface {
+	// Confirmations of the transaction, found is false if the
+	// transaction is not known (neither in a block nor in
+	// the mempool)
+	Confirmations(ctx context.Context, cc c.Cryptocurrency, tx string) (
+		confirmations int, found bool, err error)
+}
+
+// blockchair chain backend (https://blockchair.com/api)
+type blockchair struct {
+	baseURL string
+	key     string
+	client  *http.Client
+}
+
+func newBlockchair(key string) *blockchair {
+	return &blockchair{
+		baseURL: "https://api.blockchair.com",
+		key:     key,
+		client:  http.DefaultClient,
+	}
+}
+
+func (b *blockchair) Confirmations(ctx context.Context,
+	cc c.Cryptocurrency, tx string) (confirmations int, found bool,
+	err error) {
+
+	var chain string
+	switch cc {
+	case c.Bitcoin:
+		chain = "bitcoin"
+	case c.Ethereum:
+		chain = "ethereum"
+	case c.Cardano:
+		chain = "cardano"
+	default:
+		err = fmt.Errorf("%s is not supported by blockchair",
+			cc.Symbol())
+		return
+	}
+
+	u := fmt.Sprintf("%s/%s/dashboards/transaction/%s", b.baseURL,
+		chain, url.PathEscape(tx))
+	if b.key != "" {
+		u += "?key=" + url.QueryEscape(b.key)
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("blockchair: %s", resp.Status)
+		return
+	}
+
+	var result struct {
+		// Data is an empty array for unknown transactions
+		Data    json.RawMessage
+		Context struct {
+			// State is the latest block
+			State int
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return
+	}
+
+	if string(bytes.TrimSpace(result.Data)) == "[]" {
+		// unknown transaction
+		return
+	}
+
+	var data map[string]struct {
+		Transaction struct {
+			// BlockID is -1 for transactions in the mempool
+			BlockID int `json:"block_id"`
+		}
+	}
+	err = json.Unmarshal(result.Data, &data)
+	if err != nil {
+		return
+	}
+
+	t, ok := data[tx]
+	if !ok {
+		err = fmt.Errorf("blockchair: no data for %s", tx)
+		return
+	}
+
+	found = true
+	if t.Transaction.BlockID >= 0 {
+		confirmations = result.Context.State - t.Transaction.BlockID + 1
+	}
+	return
+}
+
+// checkConfirmations of the sent payouts, dropped ones are checked
+// as well until they are sent again. Errors of the chain backend
+// never change the status.
+func checkConfirmations(db *database.DB, chain Chain, ctx context.Context,
+	now time.Time) (err error) {
+
+	sent, err := database.PayoutsByStatus(db, database.PayoutSent)
+	if err != nil {
+		return
+	}
+
+	dropped, err := database.PayoutsByStatus(db, database.PayoutDropped)
+	if err != nil {
+		return
+	}
+	sent = append(sent, dropped...)
+
+	for _, p := range sent {
+		if p.Tx == "" {
+			continue
+		}
+
+		confirmations, found, err := chain.Confirmations(ctx, p.Type,
+			p.Tx)
+		if err != nil {
+			log.Println("confirmations:", p.Tx, err)
+			continue
+		}
+
+		status := database.PayoutSent
+		switch {
+		case confirmations > 0:
+			status = database.PayoutConfirmed
+		case !found && now.Sub(p.Timestamp) > dropTimeout:
+			status = database.PayoutDropped
+		}
+
+		if status != p.Status {
+			log.Printf("payout %d (%s#%d) is %s: %s",
+				p.ID, p.Repo, p.Issue, status, p.Tx)
+		}
+
+		if status == p.Status && confirmations == p.Confirmations {
+			continue
+		}
+
+		err = database.SetPayoutConfirmations(db, p.ID, status,
+			confirmations)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// confirmWorker checks confirmations of the sent payouts
+// every interval
+func confirmWorker(db *database.DB, chain Chain, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := checkConfirmations(db, chain, context.Background(),
+			time.Now())
+		if err != nil {
+			log.Println("confirmations:", err)
+		}
+	}
+}
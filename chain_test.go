@@ -0,0 +1,214 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// fakeChain knows only transactions with confirmations in the map
+type fakeChain map[string]int
+
+func (f fakeChain) Confirmations(ctx context.Context, cc c.Cryptocurrency,
+	tx string) (confirmations int, found bool, err error) {
+
+	confirmations, found = f[tx]
+	return
+}
+
+func TestBlockchair(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("key") != "key" {
+				w.WriteHeader(http.StatusPaymentRequired)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/bitcoin/dashboards/transaction/mined":
+				fmt.Fprint(w, `{"data": {"mined": {"transaction": `+
+					`{"block_id": 100}}}, "context": {"state": 105}}`)
+			case "/ethereum/dashboards/transaction/mempool":
+				fmt.Fprint(w, `{"data": {"mempool": {"transaction": `+
+					`{"block_id": -1}}}, "context": {"state": 105}}`)
+			case "/bitcoin/dashboards/transaction/unknown":
+				fmt.Fprint(w, `{"data": [], "context": {"state": 105}}`)
+			case "/bitcoin/dashboards/transaction/malformed":
+				fmt.Fprint(w, `{"data": {"other": {}}, `+
+					`"context": {"state": 105}}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer server.Close()
+
+	b := newBlockchair("key")
+	b.baseURL = server.URL
+
+	for _, tc := range []struct {
+		cc            c.Cryptocurrency
+		tx            string
+		confirmations int
+		found         bool
+	}{
+		{c.Bitcoin, "mined", 6, true},
+		{c.Ethereum, "mempool", 0, true},
+		{c.Bitcoin, "unknown", 0, false},
+		{c.Cardano, "missing", 0, false},
+	} {
+		confirmations, found, err := b.Confirmations(
+			context.Background(), tc.cc, tc.tx)
+		if err != nil {
+			t.Fatal(tc.tx, err)
+		}
+		if confirmations != tc.confirmations || found != tc.found {
+			t.Fatal(tc.tx, confirmations, found)
+		}
+	}
+
+	// Unexpected answer is not a missing transaction
+	_, _, err := b.Confirmations(context.Background(), c.Bitcoin,
+		"malformed")
+	if err == nil {
+		t.Fatal("error is not returned for malformed data")
+	}
+
+	b.key = ""
+	_, _, err = b.Confirmations(context.Background(), c.Bitcoin, "mined")
+	if err == nil {
+		t.Fatal("error is not returned")
+	}
+}
+
+func TestCheckConfirmations(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 1, forge.PullRequest{
+		Number: 2,
+		Body:   "BTC{btcContributor} ETH{ethContributor}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=1", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(nil, false))
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code)
+	}
+
+	btcTx := "tx-" + issue.Wallets[c.Bitcoin].Seed
+	ethTx := "tx-" + issue.Wallets[c.Ethereum].Seed
+
+	// Ethereum transaction is lost
+	chain := fakeChain{btcTx: 3}
+
+	status := func() map[c.Cryptocurrency]transaction {
+		w := httptest.NewRecorder()
+		transactionsHandler(db, w, httptest.NewRequest("GET",
+			"/transactions?repo=github.com/owner/project&issue=1", nil))
+
+		var transactions []transaction
+		err := json.NewDecoder(w.Body).Decode(&transactions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := make(map[c.Cryptocurrency]transaction)
+		for _, tx := range transactions {
+			m[tx.Type] = tx
+		}
+		if len(m) != 2 {
+			t.Fatal("invalid transactions", transactions)
+		}
+		return m
+	}
+
+	err = checkConfirmations(db, chain, context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := status()
+	if s[c.Bitcoin].Status != database.PayoutConfirmed ||
+		s[c.Bitcoin].Confirmations != 3 {
+
+		t.Fatal("bitcoin payout is not confirmed", s[c.Bitcoin])
+	}
+	if s[c.Ethereum].Status != database.PayoutSent {
+		t.Fatal("ethereum payout is dropped too early", s[c.Ethereum])
+	}
+
+	later := time.Now().Add(dropTimeout + time.Hour)
+	err = checkConfirmations(db, chain, context.Background(), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := status(); s[c.Ethereum].Status != database.PayoutDropped {
+		t.Fatal("ethereum payout is not dropped", s[c.Ethereum])
+	}
+
+	// Dropped payout is not sent again without the operator
+	err = retryFailed(db, wallets, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status(); s[c.Ethereum].Status != database.PayoutDropped {
+		t.Fatal("dropped payout is sent again", s[c.Ethereum])
+	}
+
+	dropped, err := database.PayoutsByStatus(db, database.PayoutDropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, p := range dropped {
+		ids = append(ids, p.ID)
+	}
+	err = resendCommand(db, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = retryFailed(db, wallets, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = status()
+	if s[c.Ethereum].Status != database.PayoutSent ||
+		s[c.Ethereum].Tx != ethTx {
+
+		t.Fatal("dropped payout is not sent again", s[c.Ethereum])
+	}
+	if s[c.Bitcoin].Status != database.PayoutConfirmed {
+		t.Fatal("confirmed payout is changed", s[c.Bitcoin])
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"golang.org/x/crypto/sha3"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// snapshotContributors of the merged pull requests. Addresses (and
+// registered addresses of authors, and co-authors of commits) are
+// recorded when the pull request is seen for the first time (on the
+// webhook or on the payout), later changes of the body are reported
+// and not followed.
+func snapshotContributors(db *database.DB, fg forge.Forge,
+	ctx context.Context, owner, project string, issue database.Issue,
+	currencies []c.Cryptocurrency, prs []forge.PullRequest) (
+	contributors []database.Contributor, err error) {
+
+	host := strings.Split(issue.Repo, "/")[0]
+
+	for _, pr := range prs {
+		var registered map[c.Cryptocurrency]string
+		if pr.Author != "" {
+			registered, err = database.ContributorAddresses(db,
+				host, pr.Author)
+			if err != nil {
+				return
+			}
+		}
+
+		var commits []string
+		commits, err = fg.PullRequestCommits(ctx, owner, project,
+			pr.Number)
+		if err != nil {
+			return
+		}
+
+		hash := sha256.Sum256([]byte(pr.Body))
+		claim := database.Claim{
+			PullRequest: pr.Number,
+			MergeSHA:    pr.MergeSHA,
+			BodyHash:    hex.EncodeToString(hash[:]),
+			Contributors: findContributors(currencies, pr, commits,
+				registered),
+		}
+
+		var snapshot database.Claim
+		snapshot, err = database.GetOrAddClaim(db, issue, claim)
+		if err != nil {
+			return
+		}
+		if snapshot.BodyHash != claim.BodyHash {
+			log.Printf("warning: %s#%d: body of pull request #%d "+
+				"is changed after the snapshot at %s, "+
+				"the snapshot is used", issue.Repo, issue.ID,
+				pr.Number, snapshot.Timestamp.Format(time.RFC3339))
+		}
+		contributors = append(contributors, snapshot.Contributors...)
+	}
+	return
+}
+
+// claimMessage is signed by the key of the address in strict claim
+// mode, e.g. "donate: claim github.com/owner/project#1 to bc1q..."
+func claimMessage(repo string, issue int, address string) string {
+	return fmt.Sprintf("donate: claim %s#%d to %s", repo, issue, address)
+}
+
+// findSignature of the claim in the format BTCSIG{...}
+func findSignature(text, symbol string) (signature string) {
+	re := regexp.MustCompile(strings.ToUpper(symbol) +
+		"SIG{([a-zA-Z0-9+/=]*)}")
+	match := re.FindStringSubmatch(text)
+	if len(match) >= 2 {
+		signature = match[1]
+	}
+	return
+}
+
+// verifyClaim signature of the message by the key of the address,
+// Bitcoin message signing (BIP137) for BTC and personal_sign
+// (EIP-191) for ETH. Other currencies are never verified.
+func verifyClaim(cc c.Cryptocurrency, address, message,
+	signature string) (valid bool) {
+
+	switch cc {
+	case c.Bitcoin:
+		valid = verifyBitcoin(address, message, signature)
+	case c.Ethereum:
+		valid = verifyEthereum(address, message, signature)
+	default:
+		log.Println(cc.Symbol(), "claim signatures are not supported")
+	}
+	return
+}
+
+// bitcoinMessageHash is the hash of the message that Bitcoin wallets
+// sign ("Sign message" in Bitcoin Core and Electrum)
+func bitcoinMessageHash(message string) []byte {
+	var buf bytes.Buffer
+	wire.WriteVarString(&buf, 0, "Bitcoin Signed Message:\n")
+	wire.WriteVarString(&buf, 0, message)
+	return chainhash.DoubleHashB(buf.Bytes())
+}
+
+func verifyBitcoin(address, message, signature string) (valid bool) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != 65 || sig[0] < 27 || sig[0] > 42 {
+		return
+	}
+
+	// Headers of segwit addresses (BIP137) are the same as of
+	// compressed keys for the recovery
+	compact := append([]byte{}, sig...)
+	if compact[0] >= 35 {
+		compact[0] = 31 + (compact[0]-35)%4
+	}
+
+	pub, compressed, err := btcec.RecoverCompact(btcec.S256(), compact,
+		bitcoinMessageHash(message))
+	if err != nil {
+		return
+	}
+
+	params := &chaincfg.MainNetParams
+
+	var addresses []btcutil.Address
+	if !compressed {
+		hash := btcutil.Hash160(pub.SerializeUncompressed())
+		p2pkh, err := btcutil.NewAddressPubKeyHash(hash, params)
+		if err != nil {
+			return
+		}
+		addresses = append(addresses, p2pkh)
+	} else {
+		// Wallets do not agree on headers of segwit addresses,
+		// so all addresses of the key are accepted
+		hash := btcutil.Hash160(pub.SerializeCompressed())
+		p2pkh, err := btcutil.NewAddressPubKeyHash(hash, params)
+		if err != nil {
+			return
+		}
+		p2wpkh, err := btcutil.NewAddressWitnessPubKeyHash(hash, params)
+		if err != nil {
+			return
+		}
+		script := append([]byte{0x00, 0x14}, hash...)
+		p2sh, err := btcutil.NewAddressScriptHash(script, params)
+		if err != nil {
+			return
+		}
+		addresses = append(addresses, p2pkh, p2wpkh, p2sh)
+	}
+
+	for _, a := range addresses {
+		if a.EncodeAddress() == address {
+			valid = true
+			return
+		}
+	}
+	return
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func verifyEthereum(address, message, signature string) (valid bool) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return
+	}
+
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return
+	}
+
+	hash := keccak256([]byte(fmt.Sprintf(
+		"\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+
+	// [v, r, s] is the format of btcec with uncompressed key
+	compact := append([]byte{27 + v}, sig[:64]...)
+	pub, _, err := btcec.RecoverCompact(btcec.S256(), compact, hash)
+	if err != nil {
+		return
+	}
+
+	recovered := keccak256(pub.SerializeUncompressed()[1:])[12:]
+	valid = strings.EqualFold(strings.TrimPrefix(address, "0x"),
+		hex.EncodeToString(recovered))
+	return
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// testBitcoinKey returns the address of the key and the function
+// that signs messages like Bitcoin wallets do
+func testBitcoinKey(t *testing.T, segwit bool) (address string,
+	sign func(message string) string) {
+
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := btcutil.Hash160(key.PubKey().SerializeCompressed())
+	var a btcutil.Address
+	if segwit {
+		a, err = btcutil.NewAddressWitnessPubKeyHash(hash,
+			&chaincfg.MainNetParams)
+	} else {
+		a, err = btcutil.NewAddressPubKeyHash(hash,
+			&chaincfg.MainNetParams)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign = func(message string) string {
+		sig, err := btcec.SignCompact(btcec.S256(), key,
+			bitcoinMessageHash(message), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if segwit {
+			// BIP137 header of P2WPKH
+			sig[0] += 8
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	return a.EncodeAddress(), sign
+}
+
+func TestVerifyClaim(t *testing.T) {
+	for _, segwit := range []bool{false, true} {
+		address, sign := testBitcoinKey(t, segwit)
+		if !verifyClaim(c.Bitcoin, address, "message", sign("message")) {
+			t.Fatal("valid signature is not verified", address)
+		}
+		if verifyClaim(c.Bitcoin, address, "message", sign("other")) {
+			t.Fatal("signature of other message is verified")
+		}
+		other, _ := testBitcoinKey(t, segwit)
+		if verifyClaim(c.Bitcoin, other, "message", sign("message")) {
+			t.Fatal("signature of other address is verified")
+		}
+	}
+
+	// Bitcoin Core (src/test/util_tests.cpp) and the same signature
+	// for other addresses of the key: Electrum keeps the header of
+	// the compressed key, BIP137 adds 4 for P2SH-P2WPKH and 8 for
+	// P2WPKH
+	for _, v := range []struct{ address, signature string }{
+		{"15CRxFdyRpGZLW9w8HnHvVduizdL5jKNbs",
+			"IPojfrX2dfPnH26UegfbGQQLrdK844DlHq5157/P6h57WyuS/" +
+				"Qsl+h/WSVGDF4MUi4rWSswW38oimDYfNNUBUOk="},
+		{"bc1q9cy7s7nmzah0m6mt2ftmu6x723esjxqkkl4wsw",
+			"IPojfrX2dfPnH26UegfbGQQLrdK844DlHq5157/P6h57WyuS/" +
+				"Qsl+h/WSVGDF4MUi4rWSswW38oimDYfNNUBUOk="},
+		{"35uijJkf4rcCnGzEZsn12YJenTHToDKpr2",
+			"JPojfrX2dfPnH26UegfbGQQLrdK844DlHq5157/P6h57WyuS/" +
+				"Qsl+h/WSVGDF4MUi4rWSswW38oimDYfNNUBUOk="},
+		{"bc1q9cy7s7nmzah0m6mt2ftmu6x723esjxqkkl4wsw",
+			"KPojfrX2dfPnH26UegfbGQQLrdK844DlHq5157/P6h57WyuS/" +
+				"Qsl+h/WSVGDF4MUi4rWSswW38oimDYfNNUBUOk="},
+	} {
+		if !verifyClaim(c.Bitcoin, v.address, "Trust no one",
+			v.signature) {
+
+			t.Fatal("valid signature is not verified", v.address)
+		}
+		if verifyClaim(c.Bitcoin, v.address, "Trust me", v.signature) {
+			t.Fatal("signature of other message is verified")
+		}
+	}
+
+	// personalSign of "hello world" from the eth-sig-util tests
+	// (MetaMask)
+	if !verifyClaim(c.Ethereum, "0xbe93f9bacbcffc8ee6663f2647917ed7a20a57bb",
+		"hello world", "0xce909e8ea6851bc36c007a0072d0524b07a3ff8d4e"+
+			"623aca4c71ca8e57250c4d0a3fc38fa8fbaaa81ead4b9f6bd03356b6"+
+			"f8bf18bccad167d78891636e1d69561b") {
+
+		t.Fatal("valid signature is not verified")
+	}
+
+	// web3.eth.accounts.sign("Some data", key) from the web3.js
+	// documentation
+	address := "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+	signature := "0xb91467e570a6466aa9e9876cbcd013baba02900b8979d43fe2" +
+		"08a4a4f339f5fd6007e74cd82e037b800186422fc2da167c747ef045e5d1" +
+		"8a5f5d4300f8e1a0291c"
+	if !verifyClaim(c.Ethereum, address, "Some data", signature) {
+		t.Fatal("valid signature is not verified")
+	}
+	if verifyClaim(c.Ethereum, address, "Other data", signature) {
+		t.Fatal("signature of other message is verified")
+	}
+
+	for _, cc := range []c.Cryptocurrency{c.Bitcoin, c.Ethereum, c.Cardano} {
+		if verifyClaim(cc, "address", "message", "") {
+			t.Fatal(cc.Symbol(), "empty signature is verified")
+		}
+	}
+}
+
+func TestPayStrictClaims(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 7)
+
+	address, sign := testBitcoinKey(t, true)
+	signature := sign(claimMessage(repo, 7, address))
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 7,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 7, forge.PullRequest{
+		Body: "BTC{" + address + "} BTCSIG{" + signature + "}\n" +
+			"ETH{unsigned}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+	cfg := testConfig(defaultDests, false)
+	cfg.defaults.StrictClaims = true
+
+	wallets := newFakeWallets()
+
+	r := httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=7", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r, cfg)
+	if w.Code != http.StatusAccepted {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	// There is no rollover target, so the payout to the unsigned
+	// claim is held for the maintainer
+	expected := []string{address, "default-ada"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+
+	pending, err := database.PayoutsByStatus(db, database.PayoutPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Destination != "unsigned" ||
+		pending[0].Hold != errClaimNotVerified.Error() {
+
+		t.Fatal("invalid pending payouts", pending)
+	}
+
+	// With approval unverified claims are flagged
+	addTestIssue(t, db, repo, 8)
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 8,
+		State:  forge.Closed,
+	})
+	err = fg.SetClosingPullRequest("owner", "project", 8, forge.PullRequest{
+		Body: "BTC{" + address + "} BTCSIG{" +
+			sign(claimMessage(repo, 8, address)) + "}\n" +
+			"ETH{unsigned}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.defaults.Approval = true
+
+	r = httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=8", nil)
+	w = httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r, cfg)
+	if w.Code != http.StatusAccepted {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	pending, err = database.PayoutsByStatus(db, database.PayoutPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := make(map[string]string)
+	for _, p := range pending {
+		if p.Issue == 8 {
+			held[p.Destination] = p.Hold
+		}
+	}
+	if len(held) != 3 || held[address] != "" ||
+		held["unsigned"] != errClaimNotVerified.Error() {
+
+		t.Fatal("invalid pending payouts", pending)
+	}
+}
+
+func TestSnapshotContributors(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 8)
+	currencies := []c.Cryptocurrency{c.Bitcoin}
+
+	fg := forge.NewFake()
+	snapshot := func(prs ...forge.PullRequest) (
+		[]database.Contributor, error) {
+
+		return snapshotContributors(db, fg, context.Background(),
+			"owner", "project", issue, currencies, prs)
+	}
+
+	pr := forge.PullRequest{Number: 9, Body: "BTC{first}"}
+	contributors, err := snapshot(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contributors) != 1 ||
+		contributors[0].Addresses[c.Bitcoin] != "first" {
+
+		t.Fatal("invalid contributors", contributors)
+	}
+
+	// Changes after the snapshot are not followed
+	pr.Body = "BTC{edited}"
+	other := forge.PullRequest{Number: 10, Body: "BTC{second}"}
+	contributors, err = snapshot(pr, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contributors) != 2 ||
+		contributors[0].Addresses[c.Bitcoin] != "first" ||
+		contributors[1].Addresses[c.Bitcoin] != "second" {
+
+		t.Fatal("invalid contributors", contributors)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// claimRe matches the claim of the contributor, e.g.
+// "/claim BTC{...} ETH{...}"
+var claimRe = regexp.MustCompile(`(?m)^/claim\s.*$`)
+
+// payRe matches the command of the maintainer that redirects the
+// payout, e.g. "/donate pay @user"
+var payRe = regexp.MustCompile(`(?m)^/donate pay @([a-zA-Z0-9_.-]+)\s*$`)
+
+// claimComments of the issue and of the pull requests: the last
+// claim of each user (by lowercase login) and the user designated by
+// the last pay command of a maintainer, if any. Claims are taken from
+// snapshots made when comments are seen first.
+func claimComments(db *database.DB, fg forge.Forge, ctx context.Context,
+	owner, project string, issue database.Issue, prs []forge.PullRequest) (
+	claims map[string]string, designated string, err error) {
+
+	comments, err := fg.Comments(ctx, owner, project, issue.ID)
+	if err != nil {
+		return
+	}
+	for _, pr := range prs {
+		var prComments []forge.Comment
+		prComments, err = fg.PullRequestComments(ctx, owner, project,
+			pr.Number)
+		if err != nil {
+			return
+		}
+		comments = append(comments, prComments...)
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		return comments[i].ID < comments[j].ID
+	})
+
+	claims = make(map[string]string)
+	for _, comment := range comments {
+		login := strings.ToLower(comment.Author)
+
+		// Comments without claims are recorded as well, so a
+		// claim can not be added or removed by editing
+		var snapshot database.ClaimComment
+		snapshot, err = database.GetOrAddClaimComment(db, issue,
+			database.ClaimComment{
+				ID:     comment.ID,
+				Author: comment.Author,
+				Claim:  claimRe.FindString(comment.Body),
+			})
+		if err != nil {
+			return
+		}
+		if snapshot.Claim != "" {
+			claims[login] = snapshot.Claim
+		}
+
+		match := payRe.FindStringSubmatch(comment.Body)
+		if match == nil {
+			continue
+		}
+
+		var maintainer bool
+		maintainer, err = fg.IsMaintainer(ctx, owner, project,
+			comment.Author)
+		if err != nil {
+			return
+		}
+		if !maintainer {
+			log.Println("pay command by", comment.Author,
+				"who is not a maintainer")
+			continue
+		}
+		designated = strings.ToLower(match[1])
+	}
+	return
+}
+
+// claimedContributors of the issue. If a maintainer designates the
+// user, the whole payout goes to the claim (or to registered
+// addresses) of the user, redirected is true then. Otherwise
+// snapshots of pull requests are used, the claim comment of the
+// author of the pull request is used for currencies that have no
+// address in the snapshot or only a registered one.
+func claimedContributors(db *database.DB, fg forge.Forge, ctx context.Context,
+	owner, project string, issue database.Issue,
+	currencies []c.Cryptocurrency, prs []forge.PullRequest) (
+	contributors []database.Contributor, redirected bool, err error) {
+
+	claims, designated, err := claimComments(db, fg, ctx, owner, project,
+		issue, prs)
+	if err != nil {
+		return
+	}
+
+	if designated != "" {
+		host := strings.Split(issue.Repo, "/")[0]
+
+		var registered map[c.Cryptocurrency]string
+		registered, err = database.ContributorAddresses(db, host,
+			designated)
+		if err != nil {
+			return
+		}
+
+		ctr, found := findContributor(currencies, claims[designated],
+			registered)
+		if !found {
+			err = errClaimMissing
+			return
+		}
+		// the maintainer decides, there are no shares
+		ctr.Weight = 1
+		contributors = []database.Contributor{ctr}
+		redirected = true
+		return
+	}
+
+	for _, pr := range prs {
+		var snapshot []database.Contributor
+		snapshot, err = snapshotContributors(db, fg, ctx, owner,
+			project, issue, currencies, []forge.PullRequest{pr})
+		if err != nil {
+			return
+		}
+
+		claim, ok := claims[strings.ToLower(pr.Author)]
+		if ok {
+			snapshot = withClaim(currencies, snapshot, claim)
+		}
+		contributors = append(contributors, snapshot...)
+	}
+	return
+}
+
+// withClaim of the author added to contributors of the pull request
+// for currencies without addresses in the body. WEIGHT of the claim is
+// ignored, the claim has the normalized weight of the author (who
+// comes first in the snapshot), or the whole weight of the pull
+// request if there is nobody else.
+func withClaim(currencies []c.Cryptocurrency,
+	contributors []database.Contributor, claim string) (
+	result []database.Contributor) {
+
+	inBody := make(map[c.Cryptocurrency]bool)
+	for _, ctr := range contributors {
+		for cc := range ctr.Addresses {
+			if !ctr.Registered[cc] {
+				inBody[cc] = true
+			}
+		}
+	}
+
+	var claimed []c.Cryptocurrency
+	for _, cc := range currencies {
+		if !inBody[cc] {
+			claimed = append(claimed, cc)
+		}
+	}
+
+	ctr, found := findContributor(claimed, claim, nil)
+	if !found {
+		result = contributors
+		return
+	}
+	ctr.Weight = 1
+	if len(contributors) != 0 {
+		ctr.Weight = contributors[0].Weight
+	}
+
+	// the claim replaces registered addresses of the author
+	for _, prev := range contributors {
+		for cc := range ctr.Addresses {
+			if prev.Registered[cc] {
+				delete(prev.Addresses, cc)
+			}
+		}
+		if len(prev.Addresses) != 0 {
+			result = append(result, prev)
+		}
+	}
+	result = append(result, ctr)
+	return
+}
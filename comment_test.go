@@ -0,0 +1,282 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func TestPayClaimComment(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 13)
+
+	err := database.SetContributorAddress(db, "github.com", "contributor",
+		c.Bitcoin, "registered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 13,
+		State:  forge.Closed,
+	})
+	err = fg.SetClosingPullRequest("owner", "project", 13, forge.PullRequest{
+		Number: 14,
+		Author: "Contributor",
+		Body:   "Fixes #13\n\nADA{frombody}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 14,
+		State:  forge.Closed,
+	})
+
+	for _, comment := range []struct {
+		number       int
+		author, body string
+	}{
+		{14, "contributor", "/claim BTC{old}"},
+		{13, "stranger", "/claim ETH{stranger}"},
+		{13, "contributor", "Thanks!\n/claim BTC{claimed} " +
+			"ETH{claimed} ADA{claimed}"},
+	} {
+		err = fg.AddComment("owner", "project", comment.number,
+			comment.author, comment.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	wallets := newFakeWallets()
+	r := httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=13", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(defaultDests, false))
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	// The last claim replaces registered addresses, the body takes
+	// precedence over the claim
+	expected := []string{"claimed", "claimed", "frombody"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+}
+
+func TestWithClaimWeight(t *testing.T) {
+	contributors := []database.Contributor{
+		{
+			Addresses: map[c.Cryptocurrency]string{
+				c.Bitcoin: "author",
+			},
+			Weight: 0.25,
+		},
+		{
+			Addresses: map[c.Cryptocurrency]string{
+				c.Bitcoin:  "coauthor",
+				c.Ethereum: "coauthor",
+			},
+			Weight: 0.75,
+		},
+	}
+
+	// The weight of the claim can not exceed the share of the author
+	result := withClaim(c.Cryptocurrencies, contributors,
+		"/claim ADA{claimed} WEIGHT{10}")
+	if len(result) != 3 || result[2].Addresses[c.Cardano] != "claimed" ||
+		result[2].Weight != 0.25 {
+
+		t.Fatal("invalid contributors", result)
+	}
+
+	result = withClaim(c.Cryptocurrencies, nil, "/claim ADA{claimed} WEIGHT{10}")
+	if len(result) != 1 || result[0].Weight != 1 {
+		t.Fatal("invalid contributors", result)
+	}
+}
+
+func TestPayRedirect(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 15)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 15,
+		State:  forge.Closed,
+	})
+	fg.SetMaintainer("owner", "project", "owner")
+	err := fg.SetClosingPullRequest("owner", "project", 15, forge.PullRequest{
+		Number: 16,
+		Author: "maintainer",
+		Body:   "Fixes #15\n\nBTC{maintainer}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range []struct{ author, body string }{
+		{"stranger", "/donate pay @stranger"},
+		{"owner", "/donate pay @helper"},
+	} {
+		err = fg.AddComment("owner", "project", 15, comment.author,
+			comment.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	wallets := newFakeWallets()
+	pay := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=15",
+			nil)
+		w := httptest.NewRecorder()
+		payHandler(db, wallets, forges, context.Background(), w, r,
+			testConfig(defaultDests, false))
+		return w
+	}
+
+	// The payout waits for the claim of the designated user
+	w := pay()
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), errClaimMissing.Error()) {
+
+		t.Fatal("unexpected response", w.Code, w.Body.String())
+	}
+	if len(wallets.sent()) != 0 {
+		t.Fatal("paid without claim", wallets.sent())
+	}
+
+	err = fg.AddComment("owner", "project", 15, "Helper",
+		"/claim BTC{helper}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = pay()
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	expected := []string{"helper", "default-eth", "default-ada"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+}
+
+func TestPayClaimWindow(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 17)
+
+	closedAt := time.Now()
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number:   17,
+		State:    forge.Closed,
+		ClosedAt: &closedAt,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 17, forge.PullRequest{
+		Number: 18,
+		Author: "contributor",
+		Body:   "Fixes #17\n\nBTC{frombody}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	wallets := newFakeWallets()
+	pay := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=17",
+			nil)
+		w := httptest.NewRecorder()
+		payHandler(db, wallets, forges, context.Background(), w, r,
+			testConfig(defaultDests, false))
+		return w
+	}
+
+	// The payout waits for claims of currencies without addresses
+	err = fg.AddComment("owner", "project", 17, "contributor",
+		"/claim ETH{claimed}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pay()
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), errClaimWindow.Error()) {
+
+		t.Fatal("unexpected response", w.Code, w.Body.String())
+	}
+	if len(wallets.sent()) != 0 {
+		t.Fatal("paid in the claim window", wallets.sent())
+	}
+
+	// Edits after the claim is seen are ignored
+	comments, err := fg.Comments(context.Background(), "owner",
+		"project", 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fg.EditComment(context.Background(), "owner", "project", 17,
+		comments[0].ID, "/claim ETH{edited} ADA{edited}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The claim window is over
+	closedAt = time.Now().Add(-claimWindow)
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number:   17,
+		State:    forge.Closed,
+		ClosedAt: &closedAt,
+	})
+	w = pay()
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	expected := []string{"frombody", "claimed", "default-ada"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+// settings of payouts of the repository
+type settings struct {
+	// Currencies to generate issue wallets for
+	Currencies []c.Cryptocurrency
+	// DefaultDests receive funds that are not acquired
+	DefaultDests map[c.Cryptocurrency]string
+	// Approval of payouts by the maintainer
+	Approval bool
+	// Fee in percents of payouts to the contributor that is sent
+	// to DefaultDests
+	Fee float64
+	// Rollover issue receives funds if nothing is merged, zero
+	// means DefaultDests
+	Rollover int
+	// StrictClaims require signatures of claimed addresses
+	StrictClaims bool
+}
+
+// config of the daemon
+type config struct {
+	// Listen address of the HTTP server, not reloaded
+	Listen string
+
+	defaults settings
+	repos    map[string]settings
+}
+
+// repo settings, defaults if the repo is not configured
+func (cfg *config) repo(repo string) settings {
+	if s, ok := cfg.repos[repo]; ok {
+		return s
+	}
+	return cfg.defaults
+}
+
+// repoFile is the format of settings in the config file
+type repoFile struct {
+	Currencies        []string
+	DonationAddresses map[string]string `toml:"donation_addresses"`
+	Approval          *bool
+	Fee               *percent
+	Rollover          *int
+	StrictClaims      *bool `toml:"strict_claims"`
+}
+
+// percent is either integer or float in the config file
+type percent float64
+
+func (p *percent) UnmarshalTOML(v interface{}) (err error) {
+	switch n := v.(type) {
+	case int64:
+		*p = percent(n)
+	case float64:
+		*p = percent(n)
+	default:
+		err = fmt.Errorf("invalid percent %v", v)
+	}
+	return
+}
+
+// configFile format:
+//
+//	listen = ":8080"
+//
+//	[defaults]
+//	currencies = ["btc", "eth"]
+//	donation_addresses = { btc = "bc1q..." }
+//
+//	[repos."github.com/owner/project"]
+//	approval = true
+//	fee = 5
+//	rollover = 123
+//	strict_claims = true
+//	donation_addresses = { eth = "0x..." }
+type configFile struct {
+	Listen   string
+	Defaults repoFile
+	Repos    map[string]repoFile
+}
+
+// merge settings from the file over s, donation addresses are
+// merged per currency
+func (rf repoFile) merge(s settings, wallets Wallets) (merged settings,
+	err error) {
+
+	supported := wallets.Currencies()
+
+	merged = s
+	if rf.Approval != nil {
+		merged.Approval = *rf.Approval
+	}
+
+	if rf.StrictClaims != nil {
+		merged.StrictClaims = *rf.StrictClaims
+	}
+
+	if rf.Rollover != nil {
+		if *rf.Rollover < 0 {
+			err = fmt.Errorf("invalid rollover issue %d",
+				*rf.Rollover)
+			return
+		}
+		merged.Rollover = *rf.Rollover
+	}
+
+	if rf.Fee != nil {
+		merged.Fee = float64(*rf.Fee)
+		err = checkFee(merged.Fee, wallets)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(rf.Currencies) != 0 {
+		merged.Currencies = nil
+		for _, symbol := range rf.Currencies {
+			var cc c.Cryptocurrency
+			cc, err = parseCurrency(symbol, supported)
+			if err != nil {
+				return
+			}
+			merged.Currencies = append(merged.Currencies, cc)
+		}
+	}
+
+	merged.DefaultDests = make(map[c.Cryptocurrency]string)
+	for cc, address := range s.DefaultDests {
+		merged.DefaultDests[cc] = address
+	}
+	for symbol, address := range rf.DonationAddresses {
+		var cc c.Cryptocurrency
+		cc, err = parseCurrency(symbol, supported)
+		if err != nil {
+			return
+		}
+		merged.DefaultDests[cc] = address
+	}
+	return
+}
+
+// checkFee is in range and can be sent by the wallets backend
+func checkFee(fee float64, wallets Wallets) (err error) {
+	if fee < 0 || fee >= 100 {
+		err = fmt.Errorf("fee %g%% is out of range [0, 100)", fee)
+		return
+	}
+	if _, split := wallets.(SplitWallets); fee != 0 && !split {
+		err = fmt.Errorf("fee %g%%: %v", fee, errSplitNotSupported)
+	}
+	return
+}
+
+func parseCurrency(symbol string, supported []c.Cryptocurrency) (
+	cc c.Cryptocurrency, err error) {
+
+	cc, err = c.FromSymbol(symbol)
+	if err != nil {
+		err = fmt.Errorf("unknown currency %s", symbol)
+		return
+	}
+
+	for _, s := range supported {
+		if s == cc {
+			return
+		}
+	}
+	err = fmt.Errorf("%s is not supported by the wallets backend",
+		strings.ToUpper(symbol))
+	return
+}
+
+// loadConfig from the file, values that are not set in the file
+// are taken from cfg (flags)
+func loadConfig(path string, cfg config, wallets Wallets) (
+	loaded *config, err error) {
+
+	var file configFile
+	md, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		err = fmt.Errorf("%s: unknown keys %v", path, undecoded)
+		return
+	}
+
+	loaded = &config{
+		Listen: cfg.Listen,
+		repos:  make(map[string]settings),
+	}
+	if file.Listen != "" {
+		loaded.Listen = file.Listen
+	}
+
+	// Issue numbers are different in each repo
+	if file.Defaults.Rollover != nil {
+		err = fmt.Errorf("%s: rollover is allowed only for repos", path)
+		return
+	}
+
+	loaded.defaults, err = file.Defaults.merge(cfg.defaults, wallets)
+	if err != nil {
+		return
+	}
+
+	for repo, rf := range file.Repos {
+		_, _, _, err = splitRepo(repo)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", repo, err)
+			return
+		}
+
+		loaded.repos[repo], err = rf.merge(loaded.defaults, wallets)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", repo, err)
+			return
+		}
+	}
+	return
+}
+
+// liveConfig is the current config that is replaced on reload
+type liveConfig struct {
+	mutex sync.RWMutex
+	cfg   *config
+}
+
+func (l *liveConfig) get() *config {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.cfg
+}
+
+func (l *liveConfig) set(cfg *config) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.cfg = cfg
+}
+
+// reloadOnSIGHUP loads the config file again on SIGHUP, the current
+// config is kept if the file is not valid
+func reloadOnSIGHUP(live *liveConfig, path string, cfg config,
+	wallets Wallets) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		loaded, err := loadConfig(path, cfg, wallets)
+		if err != nil {
+			log.Println("config is not reloaded:", err)
+			continue
+		}
+		live.set(loaded)
+		log.Println("config is reloaded")
+	}
+}
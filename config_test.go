@@ -0,0 +1,208 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// ethWallets supports only Ethereum and is not able to split funds
+type ethWallets struct {
+	Wallets
+}
+
+func (ethWallets) Currencies() []c.Cryptocurrency {
+	return []c.Cryptocurrency{c.Ethereum}
+}
+
+// testConfig with the same settings for all repositories
+func testConfig(defaultDests map[c.Cryptocurrency]string,
+	approval bool) *config {
+
+	return &config{
+		defaults: settings{
+			Currencies:   c.Cryptocurrencies,
+			DefaultDests: defaultDests,
+			Approval:     approval,
+		},
+	}
+}
+
+func writeTestConfig(t *testing.T, content string) (path string,
+	cleanup func()) {
+
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path = filepath.Join(dir, "donate.toml")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `
+listen = ":8081"
+
+[defaults]
+donation_addresses = { btc = "default-btc" }
+
+[repos."github.com/owner/project"]
+currencies = ["btc"]
+approval = true
+fee = 2.5
+donation_addresses = { btc = "project-btc" }
+
+[repos."gitlab.com/group/subgroup/project"]
+rollover = 1
+donation_addresses = { eth = "project-eth" }
+`)
+	defer cleanup()
+
+	flags := testConfig(map[c.Cryptocurrency]string{
+		c.Bitcoin:  "flag-btc",
+		c.Ethereum: "flag-eth",
+	}, false)
+	flags.Listen = ":8080"
+
+	cfg, err := loadConfig(path, *flags, newFakeWallets())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Listen != ":8081" {
+		t.Fatal("invalid listen", cfg.Listen)
+	}
+
+	expected := map[string]settings{
+		"github.com/other/project": {
+			Currencies: c.Cryptocurrencies,
+			DefaultDests: map[c.Cryptocurrency]string{
+				c.Bitcoin:  "default-btc",
+				c.Ethereum: "flag-eth",
+			},
+		},
+		"github.com/owner/project": {
+			Currencies: []c.Cryptocurrency{c.Bitcoin},
+			DefaultDests: map[c.Cryptocurrency]string{
+				c.Bitcoin:  "project-btc",
+				c.Ethereum: "flag-eth",
+			},
+			Approval: true,
+			Fee:      2.5,
+		},
+		"gitlab.com/group/subgroup/project": {
+			Currencies: c.Cryptocurrencies,
+			DefaultDests: map[c.Cryptocurrency]string{
+				c.Bitcoin:  "default-btc",
+				c.Ethereum: "project-eth",
+			},
+			Rollover: 1,
+		},
+	}
+	for repo, s := range expected {
+		if !reflect.DeepEqual(cfg.repo(repo), s) {
+			t.Fatal(repo, cfg.repo(repo))
+		}
+	}
+
+	for _, content := range []string{
+		`[defaults]
+currencies = ["doge"]`,
+		`[repos."github.com/owner/project"]
+donation_addresses = { xmr = "address" }`,
+		`[repos."owner/project"]
+approval = true`,
+		`[defaults]
+aproval = true`,
+		`[defaults]
+fee = 100`,
+		`[defaults]
+rollover = 1`,
+	} {
+		path, cleanup := writeTestConfig(t, content)
+		_, err = loadConfig(path, *flags, newFakeWallets())
+		cleanup()
+		if err == nil {
+			t.Fatal("invalid config is loaded", content)
+		}
+	}
+
+	_, err = loadConfig(path, *flags, ethWallets{newFakeWallets()})
+	if err == nil {
+		t.Fatal("currency that is not supported is loaded")
+	}
+
+	path, cleanup = writeTestConfig(t, `
+[defaults]
+fee = 1`)
+	defer cleanup()
+
+	// Payouts with the fee can't be sent without split send
+	_, err = loadConfig(path, *flags, ethWallets{newFakeWallets()})
+	if err == nil {
+		t.Fatal("fee without split send is loaded")
+	}
+	_, err = loadConfig(path, *flags, newFakeWallets())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayRepoConfig(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	cfg := testConfig(nil, true)
+	cfg.repos = map[string]settings{
+		"github.com/owner/project": {
+			Currencies: []c.Cryptocurrency{c.Bitcoin},
+			DefaultDests: map[c.Cryptocurrency]string{
+				c.Bitcoin:  "project-btc",
+				c.Ethereum: "project-eth",
+				c.Cardano:  "project-ada",
+			},
+		},
+	}
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=1", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r, cfg)
+	if w.Code != http.StatusCreated {
+		t.Fatal("approval of the defaults is used", w.Code)
+	}
+
+	expected := []string{"project-btc", "project-eth", "project-ada"}
+	if !reflect.DeepEqual(wallets.sent(), expected) {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/cipher"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrNotPending is returned for payouts that are not waiting
+// for approval
+var ErrNotPending = errors.New("payout is not pending")
+
+// ApprovePayout marks the pending payout as approved and returns it
+// with the seed of the source wallet. Only one caller can approve
+// the payout, others get ErrNotPending. If the result of sending is
+// not recorded until lease (e.g. the daemon is stopped in the
+// middle), the payout is due for retry.
+func ApprovePayout(db *DB, id int64, lease time.Time) (
+	payout IssuePayout, seed string, err error) {
+
+	aead := db.aead
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	payout, seed, err = txApprovePayout(tx, aead, id, lease)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// same as ApprovePayout but to be wrapped by transaction
+func txApprovePayout(tx *sql.Tx, aead cipher.AEAD, id int64,
+	lease time.Time) (payout IssuePayout, seed string, err error) {
+
+	err = txSetPendingStatus(tx, id, PayoutApproved)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("UPDATE payouts SET next_attempt = ? WHERE id = ?",
+		lease.Unix(), id)
+	if err != nil {
+		return
+	}
+
+	payout, seed, err = txIssuePayoutWithSeed(tx, aead, id)
+	return
+}
+
+// txSetPendingStatus changes status of the pending payout,
+// ErrNotPending if the payout is not pending anymore
+func txSetPendingStatus(tx *sql.Tx, id int64, status PayoutStatus) (
+	err error) {
+
+	res, err := tx.Exec("UPDATE payouts SET status = ? "+
+		"WHERE id = ? AND status = ?", status, id, PayoutPending)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n != 1 {
+		err = ErrNotPending
+	}
+	return
+}
+
+// RejectPayout that is pending. If all payouts of the issue are
+// rejected, payout of the issue can be planned again.
+func RejectPayout(db *DB, id int64) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = txRejectPayout(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// same as RejectPayout but to be wrapped by transaction
+func txRejectPayout(tx *sql.Tx, id int64) (err error) {
+	err = txSetPendingStatus(tx, id, PayoutRejected)
+	if err != nil {
+		return
+	}
+
+	var issueID int64
+	err = tx.QueryRow("SELECT issue_id FROM payouts WHERE id = ?", id).
+		Scan(&issueID)
+	if err != nil {
+		return
+	}
+
+	var active int
+	err = tx.QueryRow("SELECT COUNT(*) FROM payouts "+
+		"WHERE issue_id = ? AND status != ?", issueID,
+		PayoutRejected).Scan(&active)
+	if err != nil || active != 0 {
+		return
+	}
+
+	_, err = tx.Exec("UPDATE issues SET payout_state = ? WHERE id = ?",
+		PayoutIdle, issueID)
+	return
+}
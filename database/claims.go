@@ -0,0 +1,204 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+// GetOrAddClaim returns the snapshot of the pull request of the
+// issue, the claim is recorded as the snapshot if there is no one
+// yet. Repo and ID of the issue should be filled.
+func GetOrAddClaim(db *DB, issue Issue, claim Claim) (snapshot Claim,
+	err error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	snapshot, err = txGetOrAddClaim(tx, issue, claim)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// same as GetOrAddClaim but to be wrapped by transaction
+func txGetOrAddClaim(tx *sql.Tx, issue Issue, claim Claim) (
+	snapshot Claim, err error) {
+
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		return
+	}
+
+	var claimID, timestamp int64
+	err = tx.QueryRow("SELECT id, merge_sha, body_hash, timestamp "+
+		"FROM claims WHERE issue_id = ? AND pull_request = ?",
+		id, claim.PullRequest).Scan(&claimID, &snapshot.MergeSHA,
+		&snapshot.BodyHash, &timestamp)
+	if err == sql.ErrNoRows {
+		err = txAddClaim(tx, id, claim)
+		snapshot = claim
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	snapshot.PullRequest = claim.PullRequest
+	snapshot.Timestamp = time.Unix(timestamp, 0)
+	snapshot.Contributors, err = queryContributors(tx, claimID)
+	return
+}
+
+func txAddClaim(tx *sql.Tx, id int, claim Claim) (err error) {
+	if claim.Timestamp.IsZero() {
+		claim.Timestamp = time.Now()
+	}
+
+	res, err := tx.Exec("INSERT INTO claims (issue_id, pull_request, "+
+		"merge_sha, body_hash, timestamp) VALUES (?, ?, ?, ?, ?)",
+		id, claim.PullRequest, claim.MergeSHA, claim.BodyHash,
+		claim.Timestamp.Unix())
+	if err != nil {
+		return
+	}
+
+	claimID, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+
+	for i, ctr := range claim.Contributors {
+		for cc, address := range ctr.Addresses {
+			_, err = tx.Exec("INSERT INTO claim_addresses "+
+				"(claim_id, contributor, symbol, address, "+
+				"signature, weight, registered) "+
+				"VALUES (?, ?, ?, ?, ?, ?, ?)",
+				claimID, i, cc.Symbol(), address,
+				ctr.Signatures[cc], ctr.Weight,
+				ctr.Registered[cc])
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// GetOrAddClaimComment returns the snapshot of the comment of the
+// issue, the comment is recorded as the snapshot if there is no one
+// yet, so later edits of the comment are ignored. Repo and ID of
+// the issue should be filled.
+func GetOrAddClaimComment(db *DB, issue Issue, comment ClaimComment) (
+	snapshot ClaimComment, err error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	snapshot, err = txGetOrAddClaimComment(tx, issue, comment)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// same as GetOrAddClaimComment but to be wrapped by transaction
+func txGetOrAddClaimComment(tx *sql.Tx, issue Issue, comment ClaimComment) (
+	snapshot ClaimComment, err error) {
+
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		return
+	}
+
+	var timestamp int64
+	err = tx.QueryRow("SELECT author, claim, timestamp "+
+		"FROM claim_comments WHERE issue_id = ? AND comment_id = ?",
+		id, comment.ID).Scan(&snapshot.Author, &snapshot.Claim,
+		&timestamp)
+	if err == sql.ErrNoRows {
+		if comment.Timestamp.IsZero() {
+			comment.Timestamp = time.Now()
+		}
+		_, err = tx.Exec("INSERT INTO claim_comments (issue_id, "+
+			"comment_id, author, claim, timestamp) "+
+			"VALUES (?, ?, ?, ?, ?)", id, comment.ID,
+			comment.Author, comment.Claim,
+			comment.Timestamp.Unix())
+		snapshot = comment
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	snapshot.ID = comment.ID
+	snapshot.Timestamp = time.Unix(timestamp, 0)
+	return
+}
+
+// queryContributors of the claim in order of appearance
+func queryContributors(q querier, id int64) (contributors []Contributor,
+	err error) {
+
+	rows, err := q.Query("SELECT contributor, symbol, address, "+
+		"signature, weight, registered FROM claim_addresses "+
+		"WHERE claim_id = ? ORDER BY contributor, id", id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	last := -1
+	for rows.Next() {
+		var index int
+		var symbol, address, signature string
+		var weight float64
+		var registered bool
+		err = rows.Scan(&index, &symbol, &address, &signature, &weight,
+			&registered)
+		if err != nil {
+			return
+		}
+
+		var cc c.Cryptocurrency
+		cc, err = c.FromSymbol(symbol)
+		if err != nil {
+			return
+		}
+
+		if index != last {
+			last = index
+			contributors = append(contributors, Contributor{
+				Addresses:  make(map[c.Cryptocurrency]string),
+				Signatures: make(map[c.Cryptocurrency]string),
+				Registered: make(map[c.Cryptocurrency]bool),
+				Weight:     weight,
+			})
+		}
+		ctr := contributors[len(contributors)-1]
+		ctr.Addresses[cc] = address
+		if signature != "" {
+			ctr.Signatures[cc] = signature
+		}
+		if registered {
+			ctr.Registered[cc] = true
+		}
+	}
+	err = rows.Err()
+	return
+}
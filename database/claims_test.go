@@ -0,0 +1,175 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+func TestGetOrAddClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issue := Issue{
+		Repo: "repo",
+		ID:   1,
+		Wallets: map[c.Cryptocurrency]Wallet{
+			c.Bitcoin: Wallet{
+				Seed:    "btcSeed",
+				Address: "btcAddress",
+			},
+		},
+	}
+
+	claim := Claim{
+		PullRequest: 2,
+		MergeSHA:    "sha",
+		BodyHash:    "hash",
+		Contributors: []Contributor{
+			{
+				Addresses: map[c.Cryptocurrency]string{
+					c.Bitcoin:  "first",
+					c.Ethereum: "0xfirst",
+				},
+				Signatures: map[c.Cryptocurrency]string{
+					c.Bitcoin: "signature",
+				},
+				Registered: map[c.Cryptocurrency]bool{
+					c.Ethereum: true,
+				},
+				Weight: 2,
+			},
+			{
+				Addresses: map[c.Cryptocurrency]string{
+					c.Bitcoin: "second",
+				},
+				Signatures: map[c.Cryptocurrency]string{},
+				Registered: map[c.Cryptocurrency]bool{},
+				Weight:     1,
+			},
+		},
+	}
+
+	_, err = GetOrAddClaim(db, issue, claim)
+	if err == nil {
+		t.Fatal("claim for unknown issue is added")
+	}
+
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := GetOrAddClaim(db, issue, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.BodyHash != "hash" {
+		t.Fatal("invalid snapshot", snapshot)
+	}
+
+	// The body is changed after the snapshot
+	changed := claim
+	changed.BodyHash = "changed"
+	changed.Contributors = nil
+
+	snapshot, err = GetOrAddClaim(db, issue, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.PullRequest != 2 || snapshot.MergeSHA != "sha" ||
+		snapshot.BodyHash != "hash" {
+
+		t.Fatal("invalid snapshot", snapshot)
+	}
+	if !reflect.DeepEqual(snapshot.Contributors, claim.Contributors) {
+		t.Fatal("invalid contributors", snapshot.Contributors)
+	}
+
+	// Snapshots are per pull request
+	other := changed
+	other.PullRequest = 3
+	snapshot, err = GetOrAddClaim(db, issue, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.BodyHash != "changed" || len(snapshot.Contributors) != 0 {
+		t.Fatal("invalid snapshot", snapshot)
+	}
+}
+
+func TestGetOrAddClaimComment(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issue := Issue{Repo: "repo", ID: 1}
+	comment := ClaimComment{ID: 10, Author: "author", Claim: "/claim BTC{a}"}
+
+	_, err = GetOrAddClaimComment(db, issue, comment)
+	if err == nil {
+		t.Fatal("claim comment for unknown issue is added")
+	}
+
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := GetOrAddClaimComment(db, issue, comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Claim != comment.Claim {
+		t.Fatal("invalid snapshot", snapshot)
+	}
+
+	// The comment is edited after the snapshot
+	edited := comment
+	edited.Claim = "/claim BTC{b}"
+	snapshot, err = GetOrAddClaimComment(db, issue, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.ID != 10 || snapshot.Author != "author" ||
+		snapshot.Claim != comment.Claim {
+
+		t.Fatal("invalid snapshot", snapshot)
+	}
+
+	// Snapshots are per comment
+	other := edited
+	other.ID = 11
+	snapshot, err = GetOrAddClaimComment(db, issue, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Claim != edited.Claim {
+		t.Fatal("invalid snapshot", snapshot)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"strings"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+// SetContributorAddress of the login on the forge host, the empty
+// address removes the registered one. Logins are case-insensitive.
+func SetContributorAddress(db *DB, host, login string,
+	cc c.Cryptocurrency, address string) (err error) {
+
+	login = strings.ToLower(login)
+	if address == "" {
+		_, err = db.Exec("DELETE FROM contributors "+
+			"WHERE host = ? AND login = ? AND symbol = ?",
+			host, login, cc.Symbol())
+		return
+	}
+
+	_, err = db.Exec("INSERT OR REPLACE INTO contributors "+
+		"(host, login, symbol, address, timestamp) "+
+		"VALUES (?, ?, ?, ?, ?)", host, login, cc.Symbol(), address,
+		time.Now().Unix())
+	return
+}
+
+// ContributorAddresses registered by the login on the forge host
+func ContributorAddresses(db *DB, host, login string) (
+	addresses map[c.Cryptocurrency]string, err error) {
+
+	rows, err := db.Query("SELECT symbol, address FROM contributors "+
+		"WHERE host = ? AND login = ?", host, strings.ToLower(login))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	addresses = make(map[c.Cryptocurrency]string)
+	for rows.Next() {
+		var symbol, address string
+		err = rows.Scan(&symbol, &address)
+		if err != nil {
+			return
+		}
+
+		var cc c.Cryptocurrency
+		cc, err = c.FromSymbol(symbol)
+		if err != nil {
+			return
+		}
+		addresses[cc] = address
+	}
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+func TestContributorAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, a := range []struct {
+		login   string
+		cc      c.Cryptocurrency
+		address string
+	}{
+		{"Contributor", c.Bitcoin, "old"},
+		{"contributor", c.Bitcoin, "btc"},
+		{"contributor", c.Ethereum, "eth"},
+		{"other", c.Bitcoin, "other"},
+	} {
+		err = SetContributorAddress(db, "github.com", a.login, a.cc,
+			a.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addresses, err := ContributorAddresses(db, "github.com", "CONTRIBUTOR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[c.Cryptocurrency]string{
+		c.Bitcoin:  "btc",
+		c.Ethereum: "eth",
+	}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatal("invalid addresses", addresses)
+	}
+
+	err = SetContributorAddress(db, "github.com", "contributor",
+		c.Ethereum, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err = ContributorAddresses(db, "github.com", "contributor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[c.Bitcoin] != "btc" {
+		t.Fatal("address is not removed", addresses)
+	}
+
+	// Logins are per forge
+	addresses, err = ContributorAddresses(db, "gitlab.com", "contributor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 0 {
+		t.Fatal("addresses of other forge", addresses)
+	}
+}
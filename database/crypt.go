@@ -0,0 +1,168 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeySize of the master key (AES-256)
+const KeySize = 32
+
+// encryptedPrefix marks seeds encrypted with the master key, it
+// allows to distinguish them from the plaintext ones that were
+// stored by the previous versions.
+const encryptedPrefix = "aes256gcm:"
+
+// ParseKey decodes the hex-encoded master key
+func ParseKey(s string) (key []byte, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		err = errors.New("master key is not specified")
+		return
+	}
+
+	key, err = hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+
+	if len(key) != KeySize {
+		err = fmt.Errorf("master key should be %d bytes", KeySize)
+	}
+	return
+}
+
+// ReadKey reads the hex-encoded master key from the file
+func ReadKey(path string) (key []byte, err error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return ParseKey(string(raw))
+}
+
+// newCipher of wallet seeds with the master key
+func newCipher(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSeed with the wallet address as an additional data, so the
+// encrypted seed can not be moved to another wallet.
+func encryptSeed(aead cipher.AEAD, seed, address string) (s string, err error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(seed), []byte(address))
+	s = encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return
+}
+
+func decryptSeed(aead cipher.AEAD, s, address string) (seed string, err error) {
+	if !strings.HasPrefix(s, encryptedPrefix) {
+		err = errors.New("seed is not encrypted")
+		return
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(s, encryptedPrefix))
+	if err != nil {
+		return
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		err = errors.New("encrypted seed is too short")
+		return
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	raw, err := aead.Open(nil, nonce, ciphertext, []byte(address))
+	if err != nil {
+		return
+	}
+
+	seed = string(raw)
+	return
+}
+
+// encryptPlaintextSeeds encrypts in place all seeds that were stored
+// before the encryption was introduced. Encrypted seeds are skipped,
+// so it's safe to run it on every start.
+func encryptPlaintextSeeds(db *DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	err = txEncryptPlaintextSeeds(tx, db.aead)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// same as encryptPlaintextSeeds but to be wrapped by transaction
+func txEncryptPlaintextSeeds(tx *sql.Tx, aead cipher.AEAD) (err error) {
+	query := "SELECT id, seed, address FROM wallets WHERE seed NOT LIKE ?"
+	rows, err := tx.Query(query, encryptedPrefix+"%")
+	if err != nil {
+		return
+	}
+
+	type plaintext struct {
+		id            int
+		seed, address string
+	}
+
+	var wallets []plaintext
+	for rows.Next() {
+		var w plaintext
+		err = rows.Scan(&w.id, &w.seed, &w.address)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		wallets = append(wallets, w)
+	}
+	rows.Close()
+
+	stmt, err := tx.Prepare("UPDATE wallets SET seed = ? WHERE id = ?")
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, w := range wallets {
+		var s string
+		s, err = encryptSeed(aead, w.seed, w.address)
+		if err != nil {
+			return
+		}
+
+		_, err = stmt.Exec(s, w.id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestSeedEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db.sqlite3")
+
+	// Database that was created by the previous version
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec("INSERT INTO issues (repo, issue) VALUES ('repo', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.Exec("INSERT INTO wallets (issue_id, symbol, seed, address) " +
+		"VALUES (1, 'btc', 'plainSeed', 'plainAddress')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	db, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := Issue{
+		Repo: "repo",
+		ID:   2,
+		Wallets: map[c.Cryptocurrency]Wallet{
+			c.Bitcoin: Wallet{
+				Seed:    "newSeed",
+				Address: "newAddress",
+			},
+		},
+	}
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT seed FROM wallets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var seed string
+		err = rows.Scan(&seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(seed, encryptedPrefix) {
+			t.Fatal("seed is stored in plaintext")
+		}
+	}
+	rows.Close()
+
+	issues, err := AllIssues(db, "repo", ShowSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 2 {
+		t.Fatal("invalid issues array")
+	}
+	if issues[0].Wallets[c.Bitcoin].Seed != "plainSeed" {
+		t.Fatal("migrated seed is not decrypted")
+	}
+	if issues[1].Wallets[c.Bitcoin].Seed != "newSeed" {
+		t.Fatal("seed is not decrypted")
+	}
+
+	db.Close()
+
+	wrongKey := []byte("fedcba9876543210fedcba9876543210")
+	db, err = Open(path, wrongKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = AllIssues(db, "repo", ShowSeed)
+	if err == nil {
+		t.Fatal("seed is decrypted with the wrong key")
+	}
+}
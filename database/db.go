@@ -5,20 +5,53 @@
 package database
 
 import (
+	"crypto/cipher"
 	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// DB is the opened database with the cipher of wallet seeds
+type DB struct {
+	*sql.DB
+	aead cipher.AEAD
+	// generate serializes generation of wallets in GetOrCreate
+	generate sync.Mutex
+}
+
 // Open (or create new) sqlite3 database on the path,
-// and generate all tables if they do not exist.
-func Open(path string) (db *sql.DB, err error) {
-	db, err = sql.Open("sqlite3", path)
+// and apply all schema migrations.
+//
+// Wallet seeds are encrypted with the master key (see KeySize),
+// plaintext seeds left by the previous versions are encrypted
+// in place.
+func Open(path string, key []byte) (db *DB, err error) {
+	aead, err := newCipher(key)
+	if err != nil {
+		return
+	}
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return
+	}
+	db = &DB{DB: raw, aead: aead}
+
+	// sqlite does not support concurrent writers, so all
+	// transactions are serialized through the one connection
+	db.SetMaxOpenConns(1)
+
+	err = migrate(raw)
 	if err != nil {
 		return
 	}
 
-	err = createSchema(db)
+	err = encryptPlaintextSeeds(db)
 	if err != nil {
 		return
 	}
@@ -26,33 +59,141 @@ func Open(path string) (db *sql.DB, err error) {
 	return
 }
 
-func createSchema(db *sql.DB) (err error) {
-	err = createIssuesTable(db)
+// migration of the database schema
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations are applied in order at Open. Never change or remove
+// the existing ones, append a new migration with the next version.
+var migrations = []migration{
+	{1, "create issues and wallets tables", createIssuesAndWalletsTables},
+	{2, "create payouts table", createPayoutsTable},
+	{3, "add payout state to issues", addPayoutStateColumn},
+	{4, "add source address to payouts", addPayoutSourceColumn},
+	{5, "add attempts to payouts", addPayoutAttemptsColumns},
+	{6, "add confirmations to payouts", addPayoutConfirmationsColumn},
+	{7, "create repos table", createReposTable},
+	{8, "add fee to payouts", addPayoutFeeColumns},
+	{9, "create payout shares table", createPayoutSharesTable},
+	{10, "add rollover target to payouts", addPayoutTargetColumn},
+	{11, "create claims tables", createClaimsTables},
+	{12, "create contributors table", createContributorsTable},
+	{13, "drop unique constraint of wallet seeds", rebuildWalletsTable},
+	{14, "make NON NULL columns NOT NULL", rebuildNotNullTables},
+	{15, "add hold reason to payouts", addPayoutHoldColumn},
+	{16, "create claim comments table", createClaimCommentsTable},
+	{17, "create deferred payouts table", createDeferredPayoutsTable},
+}
+
+// LatestVersion of the database schema known to this version
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Version of the database schema, zero for the empty database
+func Version(db *DB) (version int, err error) {
+	return currentVersion(db.DB)
+}
+
+// currentVersion is read only, the version table is created by migrate
+func currentVersion(db *sql.DB) (version int, err error) {
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master " +
+		"WHERE type = 'table' AND name = 'schema_version'").
+		Scan(&tables)
+	if err != nil || tables == 0 {
+		return
+	}
+
+	err = db.QueryRow("SELECT IFNULL(MAX(version), 0) FROM schema_version").
+		Scan(&version)
+	return
+}
+
+func createVersionTable(db *sql.DB) (err error) {
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version		INTEGER PRIMARY KEY,
+		description	TEXT NOT NULL,
+		applied		INTEGER NOT NULL
+	)`)
+	return
+}
+
+// migrate applies all migrations that are not applied yet, each one
+// in its own transaction.
+func migrate(db *sql.DB) (err error) {
+	err = createVersionTable(db)
 	if err != nil {
 		return
 	}
 
-	err = createWalletsTable(db)
+	version, err := currentVersion(db)
 	if err != nil {
 		return
 	}
 
+	if version > LatestVersion() {
+		err = fmt.Errorf("database schema version %d is newer "+
+			"than supported %d", version, LatestVersion())
+		return
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		err = applyMigration(db, m)
+		if err != nil {
+			err = fmt.Errorf("migration %d (%s): %v",
+				m.version, m.description, err)
+			return
+		}
+	}
 	return
 }
 
-func createIssuesTable(db *sql.DB) (err error) {
-	_, err = db.Exec(`
+func applyMigration(db *sql.DB, m migration) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	err = m.apply(tx)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	query := "INSERT INTO schema_version (version, description, applied) " +
+		"VALUES (?, ?, ?)"
+	_, err = tx.Exec(query, m.version, m.description, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// Databases created before the schema versioning already have these
+// tables, so they must be created only if they do not exist.
+func createIssuesAndWalletsTables(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
 	CREATE TABLE IF NOT EXISTS issues (
 		id		INTEGER PRIMARY KEY,
 		repo		TEXT NON NULL,
 		issue		INTEGER NON NULL,
 		UNIQUE(repo, issue) ON CONFLICT ROLLBACK
 	)`)
-	return
-}
+	if err != nil {
+		return
+	}
 
-func createWalletsTable(db *sql.DB) (err error) {
-	_, err = db.Exec(`
+	_, err = tx.Exec(`
 	CREATE TABLE IF NOT EXISTS wallets (
 		id		INTEGER PRIMARY KEY,
 		issue_id	INTEGER,
@@ -62,3 +203,270 @@ func createWalletsTable(db *sql.DB) (err error) {
 	)`)
 	return
 }
+
+func createPayoutsTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE payouts (
+		id		INTEGER PRIMARY KEY,
+		issue_id	INTEGER NOT NULL,
+		symbol		TEXT NOT NULL,
+		destination	TEXT NOT NULL,
+		reason		TEXT NOT NULL,
+		tx		TEXT NOT NULL,
+		amount		TEXT NOT NULL,
+		status		TEXT NOT NULL,
+		error		TEXT NOT NULL,
+		timestamp	INTEGER NOT NULL
+	)`)
+	return
+}
+
+func addPayoutStateColumn(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE issues ADD COLUMN " +
+		"payout_state TEXT NOT NULL DEFAULT 'idle'")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("UPDATE issues SET payout_state = 'done' " +
+		"WHERE id IN (SELECT issue_id FROM payouts)")
+	return
+}
+
+func addPayoutSourceColumn(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"source TEXT NOT NULL DEFAULT ''")
+	return
+}
+
+// Payouts that were recorded before have been tried once and can
+// be retried immediately.
+func addPayoutAttemptsColumns(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"attempts INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"next_attempt INTEGER NOT NULL DEFAULT 0")
+	return
+}
+
+func addPayoutConfirmationsColumn(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"confirmations INTEGER NOT NULL DEFAULT 0")
+	return
+}
+
+func createReposTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE repos (
+		id		INTEGER PRIMARY KEY,
+		repo		TEXT NOT NULL UNIQUE,
+		timestamp	INTEGER NOT NULL
+	)`)
+	return
+}
+
+func addPayoutFeeColumns(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"fee REAL NOT NULL DEFAULT 0")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"fee_destination TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"fee_tx TEXT NOT NULL DEFAULT ''")
+	return
+}
+
+func createPayoutSharesTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE payout_shares (
+		id		INTEGER PRIMARY KEY,
+		payout_id	INTEGER NOT NULL,
+		destination	TEXT NOT NULL,
+		weight		REAL NOT NULL
+	)`)
+	return
+}
+
+func addPayoutTargetColumn(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"target INTEGER NOT NULL DEFAULT 0")
+	return
+}
+
+func createClaimsTables(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE claims (
+		id		INTEGER PRIMARY KEY,
+		issue_id	INTEGER NOT NULL,
+		pull_request	INTEGER NOT NULL,
+		merge_sha	TEXT NOT NULL,
+		body_hash	TEXT NOT NULL,
+		timestamp	INTEGER NOT NULL,
+		UNIQUE(issue_id, pull_request)
+	)`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(`
+	CREATE TABLE claim_addresses (
+		id		INTEGER PRIMARY KEY,
+		claim_id	INTEGER NOT NULL,
+		contributor	INTEGER NOT NULL,
+		symbol		TEXT NOT NULL,
+		address		TEXT NOT NULL,
+		signature	TEXT NOT NULL,
+		weight		REAL NOT NULL
+	)`)
+	return
+}
+
+func createContributorsTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE contributors (
+		id		INTEGER PRIMARY KEY,
+		host		TEXT NOT NULL,
+		login		TEXT NOT NULL,
+		symbol		TEXT NOT NULL,
+		address		TEXT NOT NULL,
+		timestamp	INTEGER NOT NULL,
+		UNIQUE(host, login, symbol)
+	)`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("ALTER TABLE claim_addresses ADD COLUMN " +
+		"registered BOOLEAN NOT NULL DEFAULT 0")
+	return
+}
+
+// Seeds are encrypted with random nonces, so the unique constraint of
+// the seed column compares ciphertexts and guarantees nothing. SQLite
+// can not drop a constraint, the table is rebuilt.
+func rebuildWalletsTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE wallets_new (
+		id		INTEGER PRIMARY KEY,
+		issue_id	INTEGER NOT NULL,
+		symbol		TEXT NOT NULL,
+		seed		TEXT NOT NULL,
+		address		TEXT NOT NULL UNIQUE
+	)`)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO wallets_new " +
+		"(id, issue_id, symbol, seed, address) " +
+		"SELECT id, issue_id, symbol, seed, address FROM wallets")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("DROP TABLE wallets")
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("ALTER TABLE wallets_new RENAME TO wallets")
+	return
+}
+
+// createTableRe matches the name of the table in the schema
+var createTableRe = regexp.MustCompile(`^CREATE TABLE\s+("?\w+"?)`)
+
+// Tables were created with the "NON NULL" typo, SQLite reads it as a
+// part of the type name, so columns are nullable. Tables are rebuilt
+// from their own schema with NOT NULL.
+func rebuildNotNullTables(tx *sql.Tx) (err error) {
+	rows, err := tx.Query("SELECT name, sql FROM sqlite_master " +
+		"WHERE type = 'table' AND sql LIKE '%NON NULL%'")
+	if err != nil {
+		return
+	}
+
+	schemas := make(map[string]string)
+	for rows.Next() {
+		var name, schema string
+		err = rows.Scan(&name, &schema)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		schemas[name] = schema
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+
+	for name, schema := range schemas {
+		tmp := name + "_not_null"
+		schema = strings.Replace(schema, "NON NULL", "NOT NULL", -1)
+		schema = createTableRe.ReplaceAllString(schema,
+			"CREATE TABLE "+tmp)
+
+		_, err = tx.Exec(schema)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec("INSERT INTO " + tmp + " SELECT * FROM " + name)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec("DROP TABLE " + name)
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec("ALTER TABLE " + tmp + " RENAME TO " + name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func addPayoutHoldColumn(tx *sql.Tx) (err error) {
+	_, err = tx.Exec("ALTER TABLE payouts ADD COLUMN " +
+		"hold TEXT NOT NULL DEFAULT ''")
+	return
+}
+
+func createClaimCommentsTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE claim_comments (
+		id		INTEGER PRIMARY KEY,
+		issue_id	INTEGER NOT NULL,
+		comment_id	INTEGER NOT NULL,
+		author		TEXT NOT NULL,
+		claim		TEXT NOT NULL,
+		timestamp	INTEGER NOT NULL,
+		UNIQUE(issue_id, comment_id)
+	)`)
+	return
+}
+
+func createDeferredPayoutsTable(tx *sql.Tx) (err error) {
+	_, err = tx.Exec(`
+	CREATE TABLE deferred_payouts (
+		issue_id	INTEGER PRIMARY KEY,
+		due		INTEGER NOT NULL
+	)`)
+	return
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db.sqlite3")
+
+	// Database that was created before the schema versioning
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := currentVersion(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatal("invalid version of the empty database", version)
+	}
+	var tables int
+	err = raw.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatal("version query changes the schema")
+	}
+
+	tx, err := raw.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = createIssuesAndWalletsTables(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+
+	db, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err = Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestVersion() {
+		t.Fatal("not all migrations are applied")
+	}
+
+	var typos int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master " +
+		"WHERE sql LIKE '%NON NULL%'").Scan(&typos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typos != 0 {
+		t.Fatal("tables are not rebuilt")
+	}
+	_, err = db.Exec("INSERT INTO issues (repo, issue) VALUES (NULL, 1)")
+	if err == nil {
+		t.Fatal("NULL is inserted to NOT NULL column")
+	}
+
+	// Reopen should not apply anything
+	db.Close()
+	db, err = Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err = Version(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestVersion() {
+		t.Fatal("invalid version after reopen", version)
+	}
+	var applied int
+	err = db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Fatal("migrations are applied again", applied)
+	}
+
+	// Database from the future
+	_, err = db.Exec("INSERT INTO schema_version "+
+		"(version, description, applied) VALUES (?, 'future', 0)",
+		LatestVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = Open(path, testKey)
+	if err == nil {
+		t.Fatal("database with newer schema is opened")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DeferPayout of the issue until due, e.g. while claims of
+// contributors are awaited. The due time of the already deferred
+// payout is replaced. Repo and ID of the issue should be filled.
+func DeferPayout(db *DB, issue Issue, due time.Time) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = txDeferPayout(tx, issue, due)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// same as DeferPayout but to be wrapped by transaction
+func txDeferPayout(tx *sql.Tx, issue Issue, due time.Time) (err error) {
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO deferred_payouts "+
+		"(issue_id, due) VALUES (?, ?)", id, due.Unix())
+	return
+}
+
+// DeferredPayouts of issues which are due at now, only Repo and ID
+// of the issues are filled
+func DeferredPayouts(db *DB, now time.Time) (issues []Issue, err error) {
+	rows, err := db.Query("SELECT issues.repo, issues.issue "+
+		"FROM deferred_payouts JOIN issues "+
+		"ON issues.id = deferred_payouts.issue_id "+
+		"WHERE deferred_payouts.due <= ? "+
+		"ORDER BY deferred_payouts.due", now.Unix())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		issue := NewIssue()
+		err = rows.Scan(&issue.Repo, &issue.ID)
+		if err != nil {
+			return
+		}
+		issues = append(issues, issue)
+	}
+	err = rows.Err()
+	return
+}
+
+// RemoveDeferredPayout of the issue, nothing is done if the payout
+// is not deferred. Repo and ID of the issue should be filled.
+func RemoveDeferredPayout(db *DB, issue Issue) (err error) {
+	_, err = db.Exec("DELETE FROM deferred_payouts WHERE issue_id IN "+
+		"(SELECT id FROM issues WHERE repo = ? AND issue = ?)",
+		issue.Repo, issue.ID)
+	return
+}
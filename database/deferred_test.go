@@ -0,0 +1,82 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeferPayout(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issue := NewIssue()
+	issue.Repo = "repo"
+	issue.ID = 1
+
+	now := time.Now()
+
+	err = DeferPayout(db, issue, now)
+	if err == nil {
+		t.Fatal("payout of unknown issue is deferred")
+	}
+
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DeferPayout(db, issue, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the due time is replaced
+	err = DeferPayout(db, issue, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := DeferredPayouts(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatal("payout is due before the time", issues)
+	}
+
+	issues, err = DeferredPayouts(db, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Repo != "repo" || issues[0].ID != 1 {
+		t.Fatal("invalid deferred payouts", issues)
+	}
+
+	err = RemoveDeferredPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err = DeferredPayouts(db, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatal("removed payout is due", issues)
+	}
+}
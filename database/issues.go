@@ -5,19 +5,22 @@
 package database
 
 import (
+	"crypto/cipher"
 	"database/sql"
 
 	c "code.dumpstack.io/lib/cryptocurrency"
 )
 
 // GetWallets for the issue. Repo and ID of the issue should be filled.
-func GetWallets(db *sql.DB, issue *Issue, sp SeedPrivacy) (err error) {
+func GetWallets(db *DB, issue *Issue, sp SeedPrivacy) (err error) {
+	aead := db.aead
+
 	tx, err := db.Begin()
 	if err != nil {
 		tx.Rollback()
 		return
 	}
-	err = txGetWallets(tx, issue, sp)
+	err = txGetWallets(tx, aead, issue, sp)
 	if err != nil {
 		tx.Rollback()
 		return
@@ -26,7 +29,9 @@ func GetWallets(db *sql.DB, issue *Issue, sp SeedPrivacy) (err error) {
 }
 
 // same as GetWallets but to be wrapped by transaction
-func txGetWallets(tx *sql.Tx, issue *Issue, sp SeedPrivacy) (err error) {
+func txGetWallets(tx *sql.Tx, aead cipher.AEAD, issue *Issue,
+	sp SeedPrivacy) (err error) {
+
 	id, err := getInternalID(tx, issue)
 	if err != nil {
 		return
@@ -60,7 +65,10 @@ func txGetWallets(tx *sql.Tx, issue *Issue, sp SeedPrivacy) (err error) {
 
 		wallet := Wallet{Address: address}
 		if sp == ShowSeed {
-			wallet.Seed = seed
+			wallet.Seed, err = decryptSeed(aead, seed, address)
+			if err != nil {
+				return
+			}
 		}
 
 		issue.Wallets[cc] = wallet
@@ -82,7 +90,7 @@ func getInternalID(tx *sql.Tx, issue *Issue) (id int, err error) {
 }
 
 // IsExists check for the issue. Repo and ID of the issue should be filled.
-func IsExists(db *sql.DB, issue Issue) (exists bool, err error) {
+func IsExists(db *DB, issue Issue) (exists bool, err error) {
 	query := "SELECT EXISTS(SELECT id FROM issues " +
 		"WHERE repo=? AND issue=?)"
 	stmt, err := db.Prepare(query)
@@ -96,13 +104,15 @@ func IsExists(db *sql.DB, issue Issue) (exists bool, err error) {
 }
 
 // Add issue to the database.
-func Add(db *sql.DB, issue Issue) (err error) {
+func Add(db *DB, issue Issue) (err error) {
+	aead := db.aead
+
 	tx, err := db.Begin()
 	if err != nil {
 		tx.Rollback()
 		return
 	}
-	err = txAdd(tx, issue)
+	err = txAdd(tx, aead, issue)
 	if err != nil {
 		tx.Rollback()
 		return
@@ -111,7 +121,7 @@ func Add(db *sql.DB, issue Issue) (err error) {
 }
 
 // same as Add but to be wrapped by transaction
-func txAdd(tx *sql.Tx, issue Issue) (err error) {
+func txAdd(tx *sql.Tx, aead cipher.AEAD, issue Issue) (err error) {
 	query := "INSERT INTO issues (repo, issue) VALUES (?, ?)"
 	stmt, err := tx.Prepare(query)
 	if err != nil {
@@ -130,7 +140,7 @@ func txAdd(tx *sql.Tx, issue Issue) (err error) {
 	}
 
 	for cc, wallet := range issue.Wallets {
-		err = addWallet(tx, id, cc, wallet)
+		err = addWallet(tx, aead, id, cc, wallet)
 		if err != nil {
 			return
 		}
@@ -138,8 +148,15 @@ func txAdd(tx *sql.Tx, issue Issue) (err error) {
 	return
 }
 
-// addWallet to database by internal (database) issue ID
-func addWallet(tx *sql.Tx, id int64, cc c.Cryptocurrency, wallet Wallet) (err error) {
+// addWallet to database by internal (database) issue ID,
+// seed is stored encrypted
+func addWallet(tx *sql.Tx, aead cipher.AEAD, id int64,
+	cc c.Cryptocurrency, wallet Wallet) (err error) {
+
+	seed, err := encryptSeed(aead, wallet.Seed, wallet.Address)
+	if err != nil {
+		return
+	}
 
 	query := "INSERT INTO wallets " +
 		"(issue_id, symbol, seed, address) " +
@@ -150,18 +167,122 @@ func addWallet(tx *sql.Tx, id int64, cc c.Cryptocurrency, wallet Wallet) (err er
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(id, cc.Symbol(), wallet.Seed, wallet.Address)
+	_, err = stmt.Exec(id, cc.Symbol(), seed, wallet.Address)
+	return
+}
+
+// Generator of wallets for the new issue
+type Generator func() (wallets map[c.Cryptocurrency]Wallet, err error)
+
+// GetOrCreate wallets of the issue. Repo and ID of the issue should
+// be filled. If the issue does not exist, wallets are generated out
+// of transaction, so the database is not held by the slow generation,
+// and the issue is added unless it appeared meanwhile. Generation is
+// serialized, so concurrent callers get the same wallets and
+// generate is called only once.
+func GetOrCreate(db *DB, issue *Issue, sp SeedPrivacy,
+	generate Generator) (created bool, err error) {
+
+	found, err := getExisting(db, issue, sp)
+	if err != nil || found {
+		return
+	}
+
+	db.generate.Lock()
+	defer db.generate.Unlock()
+
+	// added by the concurrent caller while waiting
+	found, err = getExisting(db, issue, sp)
+	if err != nil || found {
+		return
+	}
+
+	// Wallets are replaced, the issue may come with empty ones
+	issue.Wallets, err = generate()
+	if err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	created, err = txGetOrAdd(tx, db.aead, issue, sp)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// getExisting wallets of the issue, found is false if the issue does
+// not exist
+func getExisting(db *DB, issue *Issue, sp SeedPrivacy) (found bool,
+	err error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = getInternalID(tx, issue)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	err = txGetWallets(tx, db.aead, issue, sp)
+	found = err == nil
+	return
+}
+
+// txGetOrAdd adds the issue with generated wallets, if the issue is
+// added by someone else since the check, its wallets are used instead
+func txGetOrAdd(tx *sql.Tx, aead cipher.AEAD, issue *Issue,
+	sp SeedPrivacy) (created bool, err error) {
+
+	_, err = getInternalID(tx, issue)
+	if err == nil {
+		issue.Wallets = make(map[c.Cryptocurrency]Wallet)
+		err = txGetWallets(tx, aead, issue, sp)
+		return
+	}
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	err = txAdd(tx, aead, *issue)
+	if err != nil {
+		return
+	}
+	created = true
+
+	if sp == HideSeed {
+		for cc, wallet := range issue.Wallets {
+			wallet.Seed = ""
+			issue.Wallets[cc] = wallet
+		}
+	}
 	return
 }
 
 // AllIssues from database for repository
-func AllIssues(db *sql.DB, repo string, sp SeedPrivacy) (issues []Issue, err error) {
+func AllIssues(db *DB, repo string, sp SeedPrivacy) (issues []Issue, err error) {
+	aead := db.aead
+
 	tx, err := db.Begin()
 	if err != nil {
 		tx.Rollback()
 		return
 	}
-	issues, err = txAllIssues(tx, repo, sp)
+	issues, err = txAllIssues(tx, aead, repo, sp)
 	if err != nil {
 		tx.Rollback()
 		return
@@ -171,7 +292,9 @@ func AllIssues(db *sql.DB, repo string, sp SeedPrivacy) (issues []Issue, err err
 }
 
 // same as AllIssues but to be wrapped by transaction
-func txAllIssues(tx *sql.Tx, repo string, sp SeedPrivacy) (issues []Issue, err error) {
+func txAllIssues(tx *sql.Tx, aead cipher.AEAD, repo string,
+	sp SeedPrivacy) (issues []Issue, err error) {
+
 	query := "SELECT issue FROM issues WHERE repo = ?"
 	stmt, err := tx.Prepare(query)
 	if err != nil {
@@ -193,7 +316,7 @@ func txAllIssues(tx *sql.Tx, repo string, sp SeedPrivacy) (issues []Issue, err e
 			return
 		}
 
-		err = txGetWallets(tx, &issue, sp)
+		err = txGetWallets(tx, aead, &issue, sp)
 		if err != nil {
 			return
 		}
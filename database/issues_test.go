@@ -5,10 +5,13 @@
 package database
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	c "code.dumpstack.io/lib/cryptocurrency"
 )
@@ -20,7 +23,7 @@ func TestDB(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := Open(filepath.Join(dir, "db.sqlite3"))
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -197,3 +200,88 @@ func TestDB(t *testing.T) {
 		t.Fatal("address is not shown")
 	}
 }
+
+func TestGetOrCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var mutex sync.Mutex
+	generated := 0
+	generate := func() (wallets map[c.Cryptocurrency]Wallet, err error) {
+		mutex.Lock()
+		generated++
+		n := generated
+		mutex.Unlock()
+
+		// give other callers a chance to race
+		time.Sleep(10 * time.Millisecond)
+
+		// the database is not held during generation
+		_, err = IsExists(db, Issue{Repo: "repo", ID: 2})
+		if err != nil {
+			return
+		}
+
+		wallets = map[c.Cryptocurrency]Wallet{
+			c.Bitcoin: Wallet{
+				Seed:    fmt.Sprintf("btcSeed%d", n),
+				Address: fmt.Sprintf("btcAddress%d", n),
+			},
+		}
+		return
+	}
+
+	n := 8
+	addresses := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			issue := NewIssue()
+			issue.Repo = "repo"
+			issue.ID = 1
+			_, err := GetOrCreate(db, &issue, HideSeed, generate)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if issue.Wallets[c.Bitcoin].Seed != "" {
+				t.Error("seed is shown")
+			}
+			addresses <- issue.Wallets[c.Bitcoin].Address
+		}()
+	}
+	wg.Wait()
+	close(addresses)
+
+	if generated != 1 {
+		t.Fatal("wallets are generated", generated, "times")
+	}
+
+	for address := range addresses {
+		if address != "btcAddress1" {
+			t.Fatal("invalid address", address)
+		}
+	}
+
+	issue := NewIssue()
+	issue.Repo = "repo"
+	issue.ID = 1
+	created, err := GetOrCreate(db, &issue, ShowSeed, generate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || issue.Wallets[c.Bitcoin].Seed != "btcSeed1" {
+		t.Fatal("invalid existing issue")
+	}
+}
@@ -0,0 +1,476 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/cipher"
+	"database/sql"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+// AddPayout to the ledger of the issue. Repo and ID of the issue
+// should be filled.
+func AddPayout(db *DB, issue Issue, payout Payout) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = txAddPayout(tx, issue, payout)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// same as AddPayout but to be wrapped by transaction
+func txAddPayout(tx *sql.Tx, issue Issue, payout Payout) (err error) {
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		return
+	}
+
+	if payout.Timestamp.IsZero() {
+		payout.Timestamp = time.Now()
+	}
+
+	var nextAttempt int64
+	if !payout.NextAttempt.IsZero() {
+		nextAttempt = payout.NextAttempt.Unix()
+	}
+
+	query := "INSERT INTO payouts (issue_id, symbol, source, " +
+		"destination, reason, tx, amount, status, error, timestamp, " +
+		"attempts, next_attempt, fee, fee_destination, fee_tx, " +
+		"target, hold) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(id, payout.Type.Symbol(), payout.Source,
+		payout.Destination, payout.Reason, payout.Tx, payout.Amount,
+		payout.Status, payout.Error, payout.Timestamp.Unix(),
+		payout.Attempts, nextAttempt, payout.Fee, payout.FeeDestination,
+		payout.FeeTx, payout.Target, payout.Hold)
+	if err != nil {
+		return
+	}
+
+	payoutID, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+
+	for _, share := range payout.Shares {
+		_, err = tx.Exec("INSERT INTO payout_shares "+
+			"(payout_id, destination, weight) VALUES (?, ?, ?)",
+			payoutID, share.Destination, share.Weight)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Payouts of the issue in order of sending. Repo and ID of the issue
+// should be filled.
+func Payouts(db *DB, issue Issue) (payouts []Payout, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	payouts, err = txPayouts(tx, issue)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	tx.Commit()
+	return
+}
+
+// same as Payouts but to be wrapped by transaction
+func txPayouts(tx *sql.Tx, issue Issue) (payouts []Payout, err error) {
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		return
+	}
+
+	query := "SELECT " + payoutColumns + " FROM payouts " +
+		"WHERE issue_id = ? ORDER BY id"
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var payout Payout
+		payout, err = scanPayout(rows)
+		if err != nil {
+			return
+		}
+		payouts = append(payouts, payout)
+	}
+	rows.Close()
+
+	for i := range payouts {
+		payouts[i].Shares, err = queryShares(tx, payouts[i].ID)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// payoutColumns in the order of scanPayout
+const payoutColumns = "payouts.id, payouts.symbol, payouts.source, " +
+	"payouts.destination, payouts.reason, payouts.tx, payouts.amount, " +
+	"payouts.status, payouts.error, payouts.timestamp, " +
+	"payouts.attempts, payouts.next_attempt, payouts.confirmations, " +
+	"payouts.fee, payouts.fee_destination, payouts.fee_tx, " +
+	"payouts.target, payouts.hold"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryShares of the payout in order of recording
+func queryShares(q querier, id int64) (shares []Share, err error) {
+	rows, err := q.Query("SELECT destination, weight FROM payout_shares "+
+		"WHERE payout_id = ? ORDER BY id", id)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var share Share
+		err = rows.Scan(&share.Destination, &share.Weight)
+		if err != nil {
+			return
+		}
+		shares = append(shares, share)
+	}
+	err = rows.Err()
+	return
+}
+
+// scanPayout from the row, extra columns (if any) follow payoutColumns
+func scanPayout(row scanner, extra ...interface{}) (payout Payout,
+	err error) {
+
+	var symbol string
+	var timestamp, nextAttempt int64
+	dest := []interface{}{&payout.ID, &symbol, &payout.Source,
+		&payout.Destination, &payout.Reason, &payout.Tx,
+		&payout.Amount, &payout.Status, &payout.Error, &timestamp,
+		&payout.Attempts, &nextAttempt, &payout.Confirmations,
+		&payout.Fee, &payout.FeeDestination, &payout.FeeTx,
+		&payout.Target, &payout.Hold}
+	err = row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return
+	}
+
+	payout.Type, err = c.FromSymbol(symbol)
+	if err != nil {
+		return
+	}
+	payout.Timestamp = time.Unix(timestamp, 0)
+	if nextAttempt != 0 {
+		payout.NextAttempt = time.Unix(nextAttempt, 0)
+	}
+	return
+}
+
+// PayoutsByStatus of all issues in order of recording
+func PayoutsByStatus(db *DB, status PayoutStatus) (
+	payouts []IssuePayout, err error) {
+
+	return queryIssuePayouts(db, "payouts.status = ?", status)
+}
+
+// GetIssuePayout by ID, sql.ErrNoRows if there is no such payout
+func GetIssuePayout(db *DB, id int64) (payout IssuePayout, err error) {
+	payouts, err := queryIssuePayouts(db, "payouts.id = ?", id)
+	if err != nil {
+		return
+	}
+	if len(payouts) == 0 {
+		err = sql.ErrNoRows
+		return
+	}
+	payout = payouts[0]
+	return
+}
+
+// IncomingRollovers are payouts of other issues of the same repo
+// that are sent to wallets of the issue, in order of recording.
+// Repo and ID of the issue should be filled.
+func IncomingRollovers(db *DB, issue Issue) (payouts []IssuePayout,
+	err error) {
+
+	return queryIssuePayouts(db, "issues.repo = ? AND "+
+		"payouts.reason = ? AND payouts.target = ?", issue.Repo,
+		ReasonRollover, issue.ID)
+}
+
+// queryIssuePayouts that match the condition in order of recording
+func queryIssuePayouts(db *DB, where string, args ...interface{}) (
+	payouts []IssuePayout, err error) {
+
+	query := "SELECT " + payoutColumns + ", issues.repo, issues.issue " +
+		"FROM payouts JOIN issues ON issues.id = payouts.issue_id " +
+		"WHERE " + where + " ORDER BY payouts.id"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p IssuePayout
+		p.Payout, err = scanPayout(rows, &p.Repo, &p.Issue)
+		if err != nil {
+			return
+		}
+		payouts = append(payouts, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return
+	}
+	rows.Close()
+
+	for i := range payouts {
+		payouts[i].Shares, err = queryShares(db, payouts[i].ID)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// txIssuePayoutWithSeed returns the payout with its issue and the
+// decrypted seed of the source wallet
+func txIssuePayoutWithSeed(tx *sql.Tx, aead cipher.AEAD, id int64) (
+	payout IssuePayout, seed string, err error) {
+
+	query := "SELECT " + payoutColumns + ", issues.repo, issues.issue " +
+		"FROM payouts JOIN issues ON issues.id = payouts.issue_id " +
+		"WHERE payouts.id = ?"
+	payout.Payout, err = scanPayout(tx.QueryRow(query, id),
+		&payout.Repo, &payout.Issue)
+	if err != nil {
+		return
+	}
+
+	payout.Shares, err = queryShares(tx, id)
+	if err != nil {
+		return
+	}
+
+	var encrypted, address string
+	err = tx.QueryRow("SELECT wallets.seed, wallets.address "+
+		"FROM wallets JOIN payouts "+
+		"ON wallets.issue_id = payouts.issue_id "+
+		"AND wallets.symbol = payouts.symbol "+
+		"WHERE payouts.id = ?", id).Scan(&encrypted, &address)
+	if err != nil {
+		return
+	}
+
+	seed, err = decryptSeed(aead, encrypted, address)
+	return
+}
+
+// SetPayoutResult of sending the payout (the fee, if any, is sent in
+// the same transaction), nextAttempt is the time of the retry if
+// sending is failed (zero if the payout is abandoned)
+func SetPayoutResult(db *DB, id int64, txid string, sendErr error,
+	nextAttempt time.Time) (err error) {
+
+	status := PayoutSent
+	var errS string
+	var next int64
+	if sendErr != nil {
+		status = PayoutFailed
+		errS = sendErr.Error()
+		next = nextAttempt.Unix()
+		if nextAttempt.IsZero() {
+			status = PayoutAbandoned
+			next = 0
+		}
+	}
+
+	_, err = db.Exec("UPDATE payouts SET status = ?, tx = ?, "+
+		"error = ?, timestamp = ?, attempts = attempts + 1, "+
+		"next_attempt = ?, confirmations = 0 WHERE id = ?", status,
+		txid, errS, time.Now().Unix(), next, id)
+	return
+}
+
+// SetPayoutConfirmations of the sent (or dropped) payout, status is
+// PayoutSent (still not confirmed), PayoutConfirmed or PayoutDropped
+// (see ResendPayout). Nothing is changed if the payout is neither in
+// PayoutSent nor in PayoutDropped status anymore.
+func SetPayoutConfirmations(db *DB, id int64, status PayoutStatus,
+	confirmations int) (err error) {
+
+	_, err = db.Exec("UPDATE payouts SET status = ?, confirmations = ? "+
+		"WHERE id = ? AND status IN (?, ?)", status, confirmations,
+		id, PayoutSent, PayoutDropped)
+	return
+}
+
+// ClaimPayout of the issue. Only one caller can claim the payout,
+// others get claimed = false and the current state. The claim is
+// stored in the database, so it survives restarts.
+func ClaimPayout(db *DB, issue Issue) (claimed bool,
+	state PayoutState, err error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	claimed, state, err = txClaimPayout(tx, issue)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// same as ClaimPayout but to be wrapped by transaction
+func txClaimPayout(tx *sql.Tx, issue Issue) (claimed bool,
+	state PayoutState, err error) {
+
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		return
+	}
+
+	res, err := tx.Exec("UPDATE issues SET payout_state = ? "+
+		"WHERE id = ? AND payout_state = ?",
+		PayoutInProgress, id, PayoutIdle)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 1 {
+		claimed = true
+		state = PayoutInProgress
+		return
+	}
+
+	err = tx.QueryRow("SELECT payout_state FROM issues WHERE id = ?",
+		id).Scan(&state)
+	return
+}
+
+// SetPayoutState of the issue, used to release (PayoutIdle) or
+// finish (PayoutDone) the claimed payout.
+func SetPayoutState(db *DB, issue Issue, state PayoutState) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("UPDATE issues SET payout_state = ? WHERE id = ?",
+		state, id)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	return tx.Commit()
+}
+
+// ResetPayout of the issue that was claimed but never finished,
+// e.g. the daemon was stopped in the middle of payout. Reset is
+// false if the payout is not in progress.
+func ResetPayout(db *DB, issue Issue) (reset bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	res, err := tx.Exec("UPDATE issues SET payout_state = ? "+
+		"WHERE id = ? AND payout_state = ?",
+		PayoutIdle, id, PayoutInProgress)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	reset = n == 1
+	err = tx.Commit()
+	return
+}
+
+// GetPayoutState of the issue
+func GetPayoutState(db *DB, issue Issue) (state PayoutState, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	id, err := getInternalID(tx, &issue)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.QueryRow("SELECT payout_state FROM issues WHERE id = ?",
+		id).Scan(&state)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
@@ -0,0 +1,583 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+)
+
+func TestPayouts(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issue := Issue{
+		Repo: "repo",
+		ID:   1,
+		Wallets: map[c.Cryptocurrency]Wallet{
+			c.Bitcoin: Wallet{
+				Seed:    "btcSeed",
+				Address: "btcAddress",
+			},
+		},
+	}
+
+	err = AddPayout(db, issue, Payout{Type: c.Bitcoin})
+	if err == nil {
+		t.Fatal("payout for unknown issue is added")
+	}
+
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err := Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payouts) != 0 {
+		t.Fatal("ledger is not empty")
+	}
+
+	err = AddPayout(db, issue, Payout{
+		Type:           c.Bitcoin,
+		Destination:    "contributor",
+		Reason:         ReasonContributor,
+		Tx:             "tx1",
+		Status:         PayoutSent,
+		Fee:            2.5,
+		FeeDestination: "project",
+		FeeTx:          "feetx1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddPayout(db, issue, Payout{
+		Type:        c.Ethereum,
+		Destination: "default",
+		Reason:      ReasonDefault,
+		Status:      PayoutFailed,
+		Error:       "no funds",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err = Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payouts) != 2 {
+		t.Fatal("invalid ledger")
+	}
+	if payouts[0].Type != c.Bitcoin || payouts[0].Tx != "tx1" ||
+		payouts[0].Status != PayoutSent || payouts[0].Fee != 2.5 ||
+		payouts[0].FeeDestination != "project" ||
+		payouts[0].FeeTx != "feetx1" {
+
+		t.Fatal("invalid payout", payouts[0])
+	}
+	if payouts[1].Reason != ReasonDefault || payouts[1].Error != "no funds" {
+		t.Fatal("invalid payout", payouts[1])
+	}
+	if payouts[1].Timestamp.IsZero() {
+		t.Fatal("timestamp is not set")
+	}
+
+	shares := []Share{{"first", 2}, {"second", 1}}
+	err = AddPayout(db, issue, Payout{
+		Type:        c.Cardano,
+		Destination: "first",
+		Reason:      ReasonContributor,
+		Status:      PayoutPending,
+		Shares:      shares,
+		Hold:        "split send is not supported",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err = Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payouts) != 3 || len(payouts[0].Shares) != 0 ||
+		!reflect.DeepEqual(payouts[2].Shares, shares) {
+
+		t.Fatal("invalid shares", payouts)
+	}
+
+	pending, err := PayoutsByStatus(db, PayoutPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || !reflect.DeepEqual(pending[0].Shares, shares) ||
+		pending[0].Hold != "split send is not supported" {
+
+		t.Fatal("invalid pending payout", pending)
+	}
+}
+
+func TestClaimPayout(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "db.sqlite3")
+	db, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := Issue{
+		Repo: "repo",
+		ID:   1,
+		Wallets: map[c.Cryptocurrency]Wallet{
+			c.Bitcoin: Wallet{
+				Seed:    "btcSeed",
+				Address: "btcAddress",
+			},
+		},
+	}
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, _, err := ClaimPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Fatal("payout is not claimed")
+	}
+
+	// Claim should survive restart
+	db.Close()
+	db, err = Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	claimed, state, err := ClaimPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed || state != PayoutInProgress {
+		t.Fatal("payout is claimed twice")
+	}
+
+	// Interrupted payout is released by the operator
+	reset, err := ResetPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reset {
+		t.Fatal("payout is not reset")
+	}
+	claimed, _, err = ClaimPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Fatal("reset payout is not claimed")
+	}
+
+	err = SetPayoutState(db, issue, PayoutDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, state, err = ClaimPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed || state != PayoutDone {
+		t.Fatal("finished payout is claimed")
+	}
+
+	reset, err = ResetPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset {
+		t.Fatal("finished payout is reset")
+	}
+}
+
+func TestApprovePayout(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issue := Issue{
+		Repo: "repo",
+		ID:   1,
+		Wallets: map[c.Cryptocurrency]Wallet{
+			c.Bitcoin:  Wallet{Seed: "btcSeed", Address: "btcAddress"},
+			c.Ethereum: Wallet{Seed: "ethSeed", Address: "ethAddress"},
+		},
+	}
+
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, _, err := ClaimPayout(db, issue)
+	if err != nil || !claimed {
+		t.Fatal("not claimed", err)
+	}
+	err = SetPayoutState(db, issue, PayoutDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cc := range []c.Cryptocurrency{c.Bitcoin, c.Ethereum} {
+		err = AddPayout(db, issue, Payout{
+			Type:        cc,
+			Source:      issue.Wallets[cc].Address,
+			Destination: "contributor",
+			Reason:      ReasonContributor,
+			Status:      PayoutPending,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err := PayoutsByStatus(db, PayoutPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Repo != "repo" ||
+		pending[0].Issue != 1 || pending[0].Source != "btcAddress" {
+
+		t.Fatal("invalid pending payouts", pending)
+	}
+
+	lease := time.Now().Add(time.Minute)
+	payout, seed, err := ApprovePayout(db, pending[0].ID, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != "btcSeed" || payout.Status != PayoutApproved {
+		t.Fatal("invalid approved payout", payout, seed)
+	}
+
+	_, _, err = ApprovePayout(db, pending[0].ID, lease)
+	if err != ErrNotPending {
+		t.Fatal("payout is approved twice", err)
+	}
+
+	// Sending is interrupted after the approval
+	due, err := DuePayouts(db, time.Now())
+	if err != nil || len(due) != 0 {
+		t.Fatal("approved payout is due before the lease", due, err)
+	}
+	due, err = DuePayouts(db, lease.Add(time.Second))
+	if err != nil || len(due) != 1 || due[0].Status != PayoutApproved {
+		t.Fatal("approved payout is not due after the lease", due, err)
+	}
+
+	err = SetPayoutResult(db, pending[0].ID, "", errors.New("no funds"),
+		time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RejectPayout(db, pending[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RejectPayout(db, pending[1].ID)
+	if err != ErrNotPending {
+		t.Fatal("payout is rejected twice", err)
+	}
+
+	payouts, err := Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payouts[0].Status != PayoutFailed || payouts[0].Error != "no funds" ||
+		payouts[1].Status != PayoutRejected {
+
+		t.Fatal("invalid payouts", payouts)
+	}
+
+	// Failed payout will be retried, so payout is not planned again
+	claimed, _, err = ClaimPayout(db, issue)
+	if err != nil || claimed {
+		t.Fatal("claimed with failed payout", err)
+	}
+
+	err = AddPayout(db, Issue{Repo: "repo", ID: 1}, Payout{
+		Type:   c.Bitcoin,
+		Status: PayoutPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("DELETE FROM payouts WHERE status = ?", PayoutFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err = PayoutsByStatus(db, PayoutPending)
+	if err != nil || len(pending) != 1 {
+		t.Fatal("invalid pending payouts", pending, err)
+	}
+	err = RejectPayout(db, pending[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is sent, failed or pending, so payout can be
+	// planned again
+	claimed, _, err = ClaimPayout(db, issue)
+	if err != nil || !claimed {
+		t.Fatal("not claimed after rejection", err)
+	}
+}
+
+func TestClaimRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	issue := Issue{
+		Repo: "repo",
+		ID:   1,
+		Wallets: map[c.Cryptocurrency]Wallet{
+			c.Bitcoin: Wallet{Seed: "btcSeed", Address: "btcAddress"},
+		},
+	}
+
+	err = Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	err = AddPayout(db, issue, Payout{
+		Type:        c.Bitcoin,
+		Destination: "contributor",
+		Status:      PayoutFailed,
+		Error:       "no funds",
+		Attempts:    1,
+		NextAttempt: now.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := DuePayouts(db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 0 {
+		t.Fatal("retry is due too early")
+	}
+
+	later := now.Add(2 * time.Minute)
+	due, err = DuePayouts(db, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].Attempts != 1 || due[0].Repo != "repo" {
+		t.Fatal("invalid due payouts", due)
+	}
+
+	lease := later.Add(10 * time.Minute)
+
+	// Not due while the payout of the issue is in progress
+	claimed, _, err := ClaimPayout(db, issue)
+	if err != nil || !claimed {
+		t.Fatal("not claimed", err)
+	}
+	_, _, err = ClaimRetry(db, due[0].ID, later, lease)
+	if err != ErrNotDue {
+		t.Fatal("retry is claimed during the payout", err)
+	}
+	err = SetPayoutState(db, issue, PayoutDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payout, seed, err := ClaimRetry(db, due[0].ID, later, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != "btcSeed" || payout.Destination != "contributor" {
+		t.Fatal("invalid payout", payout, seed)
+	}
+
+	_, _, err = ClaimRetry(db, due[0].ID, later, lease)
+	if err != ErrNotDue {
+		t.Fatal("retry is claimed twice", err)
+	}
+
+	err = SetPayoutResult(db, payout.ID, "tx", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err := Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payouts[0].Status != PayoutSent || payouts[0].Tx != "tx" ||
+		payouts[0].Attempts != 2 {
+
+		t.Fatal("invalid payout", payouts[0])
+	}
+
+	err = SetPayoutConfirmations(db, payout.ID, PayoutDropped, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due, err = DuePayouts(db, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 0 {
+		t.Fatal("dropped payout is due without resend", due)
+	}
+
+	err = ResendPayout(db, payout.ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ResendPayout(db, payout.ID, time.Now())
+	if err != ErrNotDropped {
+		t.Fatal("payout is resent twice", err)
+	}
+
+	due, err = DuePayouts(db, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].Status != PayoutFailed {
+		t.Fatal("resent payout is not due", due)
+	}
+
+	// Only sent (or dropped) payouts are updated
+	err = SetPayoutConfirmations(db, payout.ID, PayoutConfirmed, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err = Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payouts[0].Status != PayoutFailed {
+		t.Fatal("failed payout is confirmed", payouts[0])
+	}
+}
+
+func TestIncomingRollovers(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var issues []Issue
+	for _, repo := range []string{"repo", "other"} {
+		issue := Issue{
+			Repo: repo,
+			ID:   1,
+			Wallets: map[c.Cryptocurrency]Wallet{
+				c.Bitcoin: Wallet{
+					Seed:    repo + "Seed",
+					Address: repo + "Address",
+				},
+			},
+		}
+		err = Add(db, issue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issues = append(issues, issue)
+	}
+
+	// Rollover to the issue 2 of each repo
+	for _, issue := range issues {
+		err = AddPayout(db, issue, Payout{
+			Type:        c.Bitcoin,
+			Destination: "target",
+			Reason:      ReasonRollover,
+			Status:      PayoutSent,
+			Tx:          issue.Repo + "Tx",
+			Target:      2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	incoming, err := IncomingRollovers(db, Issue{Repo: "repo", ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incoming) != 1 || incoming[0].Issue != 1 ||
+		incoming[0].Tx != "repoTx" || incoming[0].Target != 2 {
+
+		t.Fatal("invalid incoming rollovers", incoming)
+	}
+
+	incoming, err = IncomingRollovers(db, Issue{Repo: "repo", ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incoming) != 0 {
+		t.Fatal("invalid incoming rollovers", incoming)
+	}
+}
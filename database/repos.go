@@ -0,0 +1,71 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRepoNotFound is returned on removal of the repo that is not
+// registered
+var ErrRepoNotFound = errors.New("repo is not registered")
+
+// AddRepo to registered repositories, registration of the
+// registered repo is not an error
+func AddRepo(db *DB, repo string) (err error) {
+	_, err = db.Exec("INSERT OR IGNORE INTO repos (repo, timestamp) "+
+		"VALUES (?, ?)", repo, time.Now().Unix())
+	return
+}
+
+// RemoveRepo from registered repositories, issues and wallets of
+// the repo are kept
+func RemoveRepo(db *DB, repo string) (err error) {
+	res, err := db.Exec("DELETE FROM repos WHERE repo = ?", repo)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n == 0 {
+		err = ErrRepoNotFound
+	}
+	return
+}
+
+// IsRepoRegistered returns true if the repo is registered
+func IsRepoRegistered(db *DB, repo string) (registered bool,
+	err error) {
+
+	var n int
+	err = db.QueryRow("SELECT COUNT(*) FROM repos WHERE repo = ?",
+		repo).Scan(&n)
+	registered = n != 0
+	return
+}
+
+// Repos that are registered in order of registration
+func Repos(db *DB) (repos []string, err error) {
+	rows, err := db.Query("SELECT repo FROM repos ORDER BY id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var repo string
+		err = rows.Scan(&repo)
+		if err != nil {
+			return
+		}
+		repos = append(repos, repo)
+	}
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepos(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, repo := range []string{"repo1", "repo2", "repo1"} {
+		err = AddRepo(db, repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos, err := Repos(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(repos, []string{"repo1", "repo2"}) {
+		t.Fatal("invalid repos", repos)
+	}
+
+	err = RemoveRepo(db, "repo1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RemoveRepo(db, "repo1")
+	if err != ErrRepoNotFound {
+		t.Fatal("removed twice", err)
+	}
+
+	for repo, expected := range map[string]bool{
+		"repo1": false,
+		"repo2": true,
+		"repo3": false,
+	} {
+		registered, err := IsRepoRegistered(db, repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if registered != expected {
+			t.Fatal(repo, registered)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/cipher"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrNotDue is returned for payouts that are not failed (or
+// approved but not sent until the lease) or which retry is not due yet
+var ErrNotDue = errors.New("payout retry is not due")
+
+// ErrNotDropped is returned for payouts that are not dropped
+var ErrNotDropped = errors.New("payout is not dropped")
+
+// DuePayouts are failed payouts which retry is due at now, and
+// approved payouts which sending is interrupted
+func DuePayouts(db *DB, now time.Time) (payouts []IssuePayout,
+	err error) {
+
+	failed, err := PayoutsByStatus(db, PayoutFailed)
+	if err != nil {
+		return
+	}
+
+	approved, err := PayoutsByStatus(db, PayoutApproved)
+	if err != nil {
+		return
+	}
+	failed = append(failed, approved...)
+
+	for _, p := range failed {
+		if p.NextAttempt.After(now) {
+			continue
+		}
+		payouts = append(payouts, p)
+	}
+	return
+}
+
+// ClaimRetry of the failed (or approved) payout that is due at
+// now. The next attempt is postponed to lease, so only one caller
+// gets the payout with the seed of the source wallet, others get
+// ErrNotDue. It's not due while the payout of the issue is in
+// progress as well.
+func ClaimRetry(db *DB, id int64, now, lease time.Time) (
+	payout IssuePayout, seed string, err error) {
+
+	aead := db.aead
+
+	tx, err := db.Begin()
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	payout, seed, err = txClaimRetry(tx, aead, id, now, lease)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+// same as ClaimRetry but to be wrapped by transaction
+func txClaimRetry(tx *sql.Tx, aead cipher.AEAD, id int64,
+	now, lease time.Time) (payout IssuePayout, seed string, err error) {
+
+	res, err := tx.Exec("UPDATE payouts SET next_attempt = ? "+
+		"WHERE id = ? AND status IN (?, ?) AND next_attempt <= ? "+
+		"AND issue_id NOT IN "+
+		"(SELECT id FROM issues WHERE payout_state = ?)",
+		lease.Unix(), id, PayoutFailed, PayoutApproved, now.Unix(),
+		PayoutInProgress)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n != 1 {
+		err = ErrNotDue
+		return
+	}
+
+	payout, seed, err = txIssuePayoutWithSeed(tx, aead, id)
+	return
+}
+
+// ResendPayout that is dropped, the operator confirms that the
+// transaction is lost. The payout becomes failed and its retry is
+// due at now, ErrNotDropped if the payout is not dropped.
+func ResendPayout(db *DB, id int64, now time.Time) (err error) {
+	res, err := db.Exec("UPDATE payouts SET status = ?, "+
+		"next_attempt = ? WHERE id = ? AND status = ?", PayoutFailed,
+		now.Unix(), id, PayoutDropped)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if n != 1 {
+		err = ErrNotDropped
+	}
+	return
+}
@@ -5,6 +5,8 @@
 package database
 
 import (
+	"time"
+
 	c "code.dumpstack.io/lib/cryptocurrency"
 )
 
@@ -18,12 +20,9 @@ const (
 	ShowSeed
 )
 
-// NewIssue returns issue with allocated wallets
+// NewIssue returns issue with the allocated (empty) map of wallets
 func NewIssue() (issue Issue) {
-	issue.Wallets = map[c.Cryptocurrency]Wallet{
-		c.Bitcoin:  Wallet{},
-		c.Ethereum: Wallet{},
-	}
+	issue.Wallets = make(map[c.Cryptocurrency]Wallet)
 	return
 }
 
@@ -44,3 +43,165 @@ type Wallet struct {
 	// Address for dotations
 	Address string
 }
+
+// PayoutState of the issue
+type PayoutState string
+
+const (
+	// PayoutIdle means that payout is not started yet
+	PayoutIdle PayoutState = "idle"
+	// PayoutInProgress means that payout is claimed by someone
+	PayoutInProgress PayoutState = "in_progress"
+	// PayoutDone means that all transactions are sent
+	PayoutDone PayoutState = "done"
+)
+
+// PayoutStatus of the transaction
+type PayoutStatus string
+
+const (
+	// PayoutSent means that transaction is broadcasted, but
+	// not confirmed yet
+	PayoutSent PayoutStatus = "sent"
+	// PayoutConfirmed means that transaction is included
+	// in a block
+	PayoutConfirmed PayoutStatus = "confirmed"
+	// PayoutDropped means that broadcasted transaction is
+	// not found in the chain anymore, it's retried only after
+	// confirmation of the operator
+	PayoutDropped PayoutStatus = "dropped"
+	// PayoutFailed means that sending is failed
+	PayoutFailed PayoutStatus = "failed"
+	// PayoutPending means that transfer is planned and waits
+	// for approval of the maintainer
+	PayoutPending PayoutStatus = "pending"
+	// PayoutApproved means that transfer is approved and
+	// being sent, it's retried if sending is interrupted
+	PayoutApproved PayoutStatus = "approved"
+	// PayoutRejected means that transfer is rejected by
+	// the maintainer and will never be sent
+	PayoutRejected PayoutStatus = "rejected"
+	// PayoutAbandoned means that sending is failed and will
+	// not be retried anymore (no funds or too many attempts)
+	PayoutAbandoned PayoutStatus = "abandoned"
+)
+
+// PayoutReason explains why the destination is chosen
+type PayoutReason string
+
+const (
+	// ReasonContributor is an address from the pull request
+	ReasonContributor PayoutReason = "contributor"
+	// ReasonDefault is a donation address of the daemon
+	ReasonDefault PayoutReason = "default"
+	// ReasonRollover is a wallet of another issue of the repo
+	ReasonRollover PayoutReason = "rollover"
+)
+
+// Payout of the issue wallet
+type Payout struct {
+	// ID of the payout in the ledger
+	ID int64
+	// Type is Bitcoin/Ethereum/etc.
+	Type c.Cryptocurrency
+	// Source is the address of the issue wallet
+	Source string
+	// Destination address
+	Destination string
+	// Reason of the destination choice
+	Reason PayoutReason
+	// Tx is the transaction ID, empty if sending is failed
+	Tx string
+	// Amount sent, empty if unknown (SendAll does not report it)
+	Amount string
+	// Status of the payout
+	Status PayoutStatus
+	// Error of sending, the last one if sending is retried
+	Error string
+	// Timestamp of the payout
+	Timestamp time.Time
+	// Attempts of sending
+	Attempts int
+	// NextAttempt of sending if it's failed
+	NextAttempt time.Time
+	// Confirmations of the transaction at the last check
+	Confirmations int
+	// Fee in percents of the funds that is sent to FeeDestination,
+	// zero if the payout is not split
+	Fee float64
+	// FeeDestination is the donation address of the project
+	FeeDestination string
+	// FeeTx is the transaction ID of the fee, empty if the fee
+	// is sent in the same transaction (Tx)
+	FeeTx string
+	// Shares of the payout that is split between several
+	// contributors, empty if it's sent to Destination only
+	Shares []Share
+	// Target issue of the rollover in the same repo
+	Target int
+	// Hold is the reason why the payout waits for approval even
+	// if approval is not required
+	Hold string
+}
+
+// Share of the split payout
+type Share struct {
+	// Destination address
+	Destination string
+	// Weight of the share, funds are divided in proportion
+	// to weights
+	Weight float64
+}
+
+// Claim is the snapshot of addresses in the body of the merged pull
+// request that closes the issue
+type Claim struct {
+	// PullRequest number
+	PullRequest int
+	// MergeSHA of the pull request, empty if it's unknown
+	MergeSHA string
+	// BodyHash is the hex SHA-256 of the body at the snapshot time
+	BodyHash string
+	// Timestamp of the snapshot
+	Timestamp time.Time
+	// Contributors of the pull request in order of appearance
+	Contributors []Contributor
+}
+
+// ClaimComment is the snapshot of the comment of the issue (or of the
+// pull request that closes the issue)
+type ClaimComment struct {
+	// ID of the comment, unique for the forge
+	ID int64
+	// Author login
+	Author string
+	// Claim is the command line at the snapshot time, empty if the
+	// comment has no claim
+	Claim string
+	// Timestamp of the snapshot
+	Timestamp time.Time
+}
+
+// Contributor who claims the payout
+type Contributor struct {
+	// Addresses of the contributor
+	Addresses map[c.Cryptocurrency]string
+	// Signatures of the claims of the addresses, empty if there
+	// is no signature
+	Signatures map[c.Cryptocurrency]string
+	// Registered addresses are taken from the registry of the
+	// pull request author
+	Registered map[c.Cryptocurrency]bool
+	// Weight of the share
+	Weight float64
+}
+
+// IssuePayout is a payout with its issue
+type IssuePayout struct {
+	// Repo of the issue
+	Repo string
+	// Issue ID on the forge
+	Issue int
+
+	Payout
+}
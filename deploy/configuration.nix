@@ -3,11 +3,13 @@
 let
   hostname = "changeme"; # e.g. donate.dumpstack.io
   github_token = "changeme"; # https://github.com/settings/tokens/new, no any scopes required
+  admin_token = "changeme"; # token for /pay, e.g. head -c 32 /dev/urandom | base64
   ssh_key = "changeme"; # e.g. ssh-rsa AAA.....== user@localhost
 
   donate_src = fetchGit { url = "https://code.dumpstack.io/tools/donate"; };
   donate = import "${donate_src}";
   database_path = "/home/donate/donate.db.sqlite3";
+  master_key_path = "/home/donate/master.key"; # see README.md
 in {
   imports =
     [ # Include the results of the hardware scan.
@@ -56,7 +58,7 @@ in {
   systemd.services."donate" = {
     serviceConfig = {
       User = "donate";
-      ExecStart = "${donate}/bin/donate --database ${database_path} --token ${github_token}";
+      ExecStart = "${donate}/bin/donate --database ${database_path} --master-key-file ${master_key_path} --token ${github_token} --admin-token ${admin_token}";
       Restart = "on-failure";
     };
     wantedBy = [ "default.target" ];
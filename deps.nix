@@ -8,6 +8,15 @@
       sha256 = "1mdaaxmgf5zbq21xbqlndvnwgjwfz95jbgapkw2z5cq03s976hmq";
     };
   }
+  {
+    goPackagePath = "github.com/BurntSushi/toml";
+    fetch = {
+      type = "git";
+      url = "https://github.com/BurntSushi/toml";
+      rev = "3012a1dbe2e4bd1391d42b32f0577cb7bbc7f005";
+      sha256 = "1fjdwwfzyzllgiwydknf1pwjvy49qxfsczqx5gz3y0izs7as99j6";
+    };
+  }
   {
     goPackagePath = "github.com/VictoriaMetrics/fastcache";
     fetch = {
@@ -12,6 +12,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -22,13 +23,26 @@ import (
 
 	c "code.dumpstack.io/lib/cryptocurrency"
 	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
 )
 
-func getIssue(owner, project, endpoint string, issueNo int) (
-	issue database.Issue, err error) {
+// repoSettings that are shown in the issue comment
+type repoSettings struct {
+	// Fee in percents of payouts
+	Fee float64
+	// StrictClaims require signatures of claimed addresses
+	StrictClaims bool
+	// Split is true if the bounty is shared by several
+	// contributors, otherwise it goes to one of them
+	Split bool
+}
+
+// getIssue wallets and the payout settings of the repo
+func getIssue(host, owner, project, endpoint string, issueNo int) (
+	issue database.Issue, rs repoSettings, err error) {
 
-	url := fmt.Sprintf("%s/query?repo=github.com/%s/%s&issue=%d",
-		endpoint, owner, project, issueNo)
+	url := fmt.Sprintf("%s/query?repo=%s/%s/%s&issue=%d",
+		endpoint, host, owner, project, issueNo)
 
 	resp, err := http.Get(url)
 	if err != nil {
@@ -36,35 +50,58 @@ func getIssue(owner, project, endpoint string, issueNo int) (
 	}
 	defer resp.Body.Close()
 
-	issue = database.NewIssue()
-	err = json.NewDecoder(resp.Body).Decode(&issue)
+	if resp.StatusCode == http.StatusForbidden {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		err = errors.New(e.Error)
+		return
+	}
+
+	result := struct {
+		database.Issue
+		repoSettings
+	}{Issue: database.NewIssue()}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	issue, rs = result.Issue, result.repoSettings
 	return
 }
 
-func updateIssue(gh *github.Client, ctx context.Context,
-	owner, project, endpoint string, ghIssue *github.Issue) (err error) {
+func updateIssue(fg forge.Forge, ctx context.Context,
+	host, owner, project, endpoint string, fgIssue forge.Issue) (err error) {
 
-	number := *ghIssue.Number
-	issue, err := getIssue(owner, project, endpoint, number)
+	number := fgIssue.Number
+	issue, rs, err := getIssue(host, owner, project, endpoint, number)
 	if err != nil {
 		return
 	}
 
-	body, totalUSD := genBody(gh, ctx, issue)
+	// Funds of duplicates and rollovers from other issues
+	var received []transaction
+	transactions, err := getTransactions(host, owner, project, endpoint,
+		number)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, t := range transactions {
+		if t.From != 0 {
+			received = append(received, t)
+		}
+	}
+
+	body, totalUSD := genBody(fg, ctx, issue, rs, received)
 
-	comments, _, err := gh.Issues.ListComments(ctx, owner, project, number, nil)
+	comments, err := fg.Comments(ctx, owner, project, number)
 
 	found := false
 	for _, comment := range comments {
-		if strings.Contains(*comment.Body, issue.Wallets[c.Bitcoin].Address) {
+		if isDonateComment(comment.Body, issue) {
 			found = true
-			newcomment := github.IssueComment{Body: &body}
 			if !dryRun {
-				_, _, err = gh.Issues.EditComment(ctx,
-					owner, project, *comment.ID, &newcomment)
+				err = fg.EditComment(ctx, owner, project,
+					number, comment.ID, body)
 			} else {
 				log.Println("old body:")
-				fmt.Println(*comment.Body)
+				fmt.Println(comment.Body)
 				fmt.Println()
 				log.Println("new body:")
 				fmt.Println(body)
@@ -76,10 +113,8 @@ func updateIssue(gh *github.Client, ctx context.Context,
 	}
 
 	if !found {
-		comment := github.IssueComment{Body: &body}
 		if !dryRun {
-			_, _, err = gh.Issues.CreateComment(ctx,
-				owner, project, number, &comment)
+			err = fg.CreateComment(ctx, owner, project, number, body)
 		}
 		if err != nil {
 			return
@@ -90,11 +125,87 @@ func updateIssue(gh *github.Client, ctx context.Context,
 	return
 }
 
-func triggerPayout(gh *github.Client, ctx context.Context,
-	owner, project, endpoint string, issue *github.Issue) (err error) {
+// pay requests the /pay url with the pay token
+func pay(url string) (resp *http.Response, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	if payToken != "" {
+		req.Header.Set("Authorization", "Bearer "+payToken)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// planPayout logs transfers that the donation server would send,
+// nothing is sent
+func planPayout(url string) (err error) {
+	resp, err := pay(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var plan struct {
+		State     string
+		Transfers []struct {
+			Type        c.Cryptocurrency
+			Source      string
+			Destination string
+			Reason      string
+		}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&plan)
+	if err != nil {
+		return
+	}
+
+	log.Println("payout plan, state:", plan.State)
+	for _, t := range plan.Transfers {
+		log.Printf("%s: %s -> %s (%s)", strings.ToUpper(t.Type.Symbol()),
+			t.Source, t.Destination, t.Reason)
+	}
+	return
+}
+
+const payoutCommentHeader = "Payout transactions:\n"
+
+// payoutComment of the issue, if it's already posted
+func payoutComment(fg forge.Forge, ctx context.Context,
+	owner, project string, number int) (comment forge.Comment,
+	found bool, err error) {
+
+	comments, err := fg.Comments(ctx, owner, project, number)
+	if err != nil {
+		return
+	}
+
+	for _, comment = range comments {
+		if strings.HasPrefix(comment.Body, payoutCommentHeader) {
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// transaction of the payout as it's returned by /transactions
+type transaction struct {
+	Type          c.Cryptocurrency
+	Tx            string
+	Status        database.PayoutStatus
+	Confirmations int
+	Fee           float64
+	FeeTx         string
+	To            int
+	From          int
+}
+
+func getTransactions(host, owner, project, endpoint string, issueNo int) (
+	transactions []transaction, err error) {
 
-	url := fmt.Sprintf("%s/pay?repo=github.com/%s/%s&issue=%d",
-		endpoint, owner, project, *issue.Number)
+	url := fmt.Sprintf("%s/transactions?repo=%s/%s/%s&issue=%d",
+		endpoint, host, owner, project, issueNo)
 
 	resp, err := http.Get(url)
 	if err != nil {
@@ -102,55 +213,174 @@ func triggerPayout(gh *github.Client, ctx context.Context,
 	}
 	defer resp.Body.Close()
 
-	transactions := make(map[c.Cryptocurrency]string)
 	err = json.NewDecoder(resp.Body).Decode(&transactions)
+	return
+}
+
+func formatTransaction(t transaction) (line string, ok bool) {
+	var api string
+	switch t.Type {
+	case c.Bitcoin:
+		api = "https://blockchair.com/bitcoin/transaction"
+	case c.Ethereum:
+		api = "https://blockchair.com/ethereum/transaction"
+	case c.Cardano:
+		api = "https://www.seiza.com/blockchain/transaction"
+	default:
+		log.Println("not supported transaction", t.Type, t.Tx)
+		return
+	}
+
+	var status string
+	switch t.Status {
+	case database.PayoutSent:
+		status = "broadcast, not confirmed yet"
+	case database.PayoutConfirmed:
+		status = fmt.Sprintf("confirmed, %d confirmations",
+			t.Confirmations)
+	case database.PayoutDropped:
+		status = "dropped, not found in the chain"
+	default:
+		status = string(t.Status)
+	}
+
+	symbol := strings.ToUpper(t.Type.Symbol())
+	line = fmt.Sprintf("- %s: [%s](%s/%s) (%s)", symbol, t.Tx, api,
+		t.Tx, status)
+	if t.Fee != 0 {
+		if t.FeeTx == "" || t.FeeTx == t.Tx {
+			line += fmt.Sprintf(", including %g%% fee to the repository",
+				t.Fee)
+		} else {
+			line += fmt.Sprintf(", %g%% fee to the repository: "+
+				"[%s](%s/%s)", t.Fee, t.FeeTx, api, t.FeeTx)
+		}
+	}
+	if t.To != 0 {
+		line += fmt.Sprintf(", moved to #%d", t.To)
+	}
+	if t.From != 0 {
+		line += fmt.Sprintf(", received from #%d", t.From)
+	}
+	line += "\n"
+	ok = true
+	return
+}
+
+func triggerPayout(fg forge.Forge, ctx context.Context,
+	host, owner, project, endpoint string, issue forge.Issue) (err error) {
+
+	url := fmt.Sprintf("%s/pay?repo=%s/%s/%s&issue=%d",
+		endpoint, host, owner, project, issue.Number)
+
+	if dryRun {
+		err = planPayout(url + "&dry_run=1")
+		return
+	}
+
+	resp, err := pay(url)
 	if err != nil {
 		return
 	}
+	resp.Body.Close()
+
+	// Payout could be already done (200) or approved by the
+	// maintainer after the previous run, in both cases the comment
+	// is updated with the current status of transactions
+	if resp.StatusCode != http.StatusCreated &&
+		resp.StatusCode != http.StatusOK {
+
+		// Payout is not possible yet (or waits for approval)
+		return
+	}
 
-	if len(transactions) == 0 {
+	transactions, err := getTransactions(host, owner, project, endpoint,
+		issue.Number)
+	if err != nil {
 		return
 	}
 
 	var body string
-	valid := false
-	for cc, tx := range transactions {
-		if tx == "" {
-			continue
+	for _, t := range transactions {
+		line, ok := formatTransaction(t)
+		if ok {
+			body += line
 		}
-		valid = true
-
-		var api string
-		switch cc {
-		case c.Bitcoin:
-			api = "https://blockchair.com/bitcoin/transaction"
-		case c.Ethereum:
-			api = "https://blockchair.com/ethereum/transaction"
-		case c.Cardano:
-			api = "https://www.seiza.com/blockchain/transaction"
-		default:
-			log.Println("not supported transaction", cc, tx)
-			continue
-		}
-		symbol := strings.ToUpper(cc.Symbol())
-		body += fmt.Sprintf("- %s: [%s](%s/%s)\n", symbol, tx, api, tx)
 	}
 
-	if !valid {
+	if body == "" {
 		log.Println("no valid transactions found")
 		return
 	}
 
-	body = "Payout transactions:\n" + body
+	body = payoutCommentHeader + body
+
+	comment, found, err := payoutComment(fg, ctx, owner, project,
+		issue.Number)
+	if err != nil {
+		return
+	}
+
+	if !found {
+		err = fg.CreateComment(ctx, owner, project, issue.Number, body)
+	} else if comment.Body != body {
+		err = fg.EditComment(ctx, owner, project, issue.Number,
+			comment.ID, body)
+	}
+	if err != nil {
+		return
+	}
+
+	for _, t := range transactions {
+		if t.To != 0 {
+			err = markMoved(fg, ctx, host, owner, project,
+				endpoint, issue.Number, t.To)
+			return
+		}
+	}
+	return
+}
+
+// movedBody replaces the donate comment of the issue which funds
+// are moved to another issue, so nobody donates to it anymore
+func movedBody(to int) string {
+	return fmt.Sprintf(donateMarker+donateHeader+"\n"+
+		"This issue is closed, funds are moved to #%d. "+
+		"Please donate to #%d instead.\n", to, to)
+}
+
+// markMoved edits the donate comment of the issue
+func markMoved(fg forge.Forge, ctx context.Context,
+	host, owner, project, endpoint string, number, to int) (err error) {
+
+	issue, _, err := getIssue(host, owner, project, endpoint, number)
+	if err != nil {
+		return
+	}
+
+	comments, err := fg.Comments(ctx, owner, project, number)
+	if err != nil {
+		return
+	}
+
+	body := movedBody(to)
+	for _, comment := range comments {
+		if comment.Body == body ||
+			!isDonateComment(comment.Body, issue) {
 
-	number := *issue.Number
-	comment := github.IssueComment{Body: &body}
-	_, _, err = gh.Issues.CreateComment(ctx, owner, project, number, &comment)
+			continue
+		}
+		err = fg.EditComment(ctx, owner, project, number,
+			comment.ID, body)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-func walkIssue(gh *github.Client, ctx context.Context,
-	owner, project, endpoint string, issue *github.Issue) (err error) {
+func walkIssue(fg forge.Forge, ctx context.Context,
+	host, owner, project, endpoint string, issue forge.Issue) (err error) {
 
 	if issue.ClosedAt != nil {
 		if issue.ClosedAt.Before(time.Now().Add(-24 * time.Hour)) {
@@ -159,35 +389,31 @@ func walkIssue(gh *github.Client, ctx context.Context,
 		}
 	}
 
-	if *issue.State == "open" {
-		err = updateIssue(gh, ctx, owner, project, endpoint, issue)
+	if issue.State == forge.Open {
+		err = updateIssue(fg, ctx, host, owner, project, endpoint, issue)
 	} else {
-		err = triggerPayout(gh, ctx, owner, project, endpoint, issue)
+		err = triggerPayout(fg, ctx, host, owner, project, endpoint, issue)
 	}
 	return
 }
 
-func walk(gh *github.Client, ctx context.Context, repo, endpoint string) (err error) {
+func walk(fg forge.Forge, ctx context.Context,
+	host, repo, endpoint string) (err error) {
+
 	// GITHUB_REPOSITORY=jollheef/test-repo-please-ignore
-	fields := strings.Split(repo, "/")
-	if len(fields) != 2 {
+	// CI_PROJECT_PATH=group/subgroup/project
+	i := strings.LastIndex(repo, "/")
+	if i <= 0 || i == len(repo)-1 {
 		err = errors.New("invalid repo")
 		return
 	}
-	owner := fields[0]
-	project := fields[1]
+	owner := repo[:i]
+	project := repo[i+1:]
 
-	options := github.IssueListByRepoOptions{State: "all"}
-	issues, _, err := gh.Issues.ListByRepo(ctx, owner, project, &options)
+	// Pull requests are not included
+	issues, err := fg.Issues(ctx, owner, project)
 	for _, issue := range issues {
-		// Note: GitHub's REST API v3 considers every pull
-		// request an issue, but not every issue is a pull
-		// request.
-		if issue.IsPullRequest() {
-			continue
-		}
-
-		err = walkIssue(gh, ctx, owner, project, endpoint, issue)
+		err = walkIssue(fg, ctx, host, owner, project, endpoint, issue)
 		if err != nil {
 			log.Println(err)
 			err = nil // do not exit
@@ -198,6 +424,18 @@ func walk(gh *github.Client, ctx context.Context, repo, endpoint string) (err er
 
 var dryRun = false
 
+// payToken is sent to /pay as a bearer token
+var payToken string
+
+// hostOf the forge instance URL, exits if URL is not valid
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		log.Fatal("invalid forge url ", rawurl)
+	}
+	return u.Host
+}
+
 func main() {
 	log.SetFlags(log.Lshortfile)
 	rand.Seed(time.Now().UnixNano())
@@ -206,24 +444,63 @@ func main() {
 	app.Author("Mikhail Klementev <root@dumpstack.io>")
 	app.Version("3.2.1")
 
-	token := app.Flag("token", "GitHub access token").Envar("GITHUB_TOKEN").Required().String()
-	repo := app.Flag("repo", "GitHub repository").Envar("GITHUB_REPOSITORY").Required().String()
+	token := app.Flag("token", "GitHub (Gitea) access token").Envar("GITHUB_TOKEN").String()
+	repo := app.Flag("repo", "GitHub (Gitea) repository or GitLab project path").Envar("GITHUB_REPOSITORY").String()
 	endpoint := app.Flag("endpoint", "URL of donation server").Envar("DONATE_ENDPOINT").Default("https://donate.dumpstack.io").String()
-	dry := app.Flag("dry-run", "Do not post any comments").Default("false").Bool()
+	dry := app.Flag("dry-run", "Do not post any comments and show payout plans instead of payouts").Default("false").Bool()
+	pay := app.Flag("pay-token", "Token for /pay of donation server").Envar("DONATE_PAY_TOKEN").String()
+	gitlab := app.Flag("gitlab", "Run on GitLab (set by GitLab CI)").Envar("GITLAB_CI").Default("false").Bool()
+	gitlabURL := app.Flag("gitlab-url", "GitLab instance URL").Envar("CI_SERVER_URL").Default("https://gitlab.com").String()
+	gitlabToken := app.Flag("gitlab-token", "GitLab access token (api scope)").Envar("GITLAB_TOKEN").String()
+	gitea := app.Flag("gitea", "Run on Gitea/Forgejo (set by Gitea Actions)").Envar("GITEA_ACTIONS").Default("false").Bool()
+	giteaURL := app.Flag("gitea-url", "Gitea instance URL").Envar("GITHUB_SERVER_URL").String()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	dryRun = *dry
+	payToken = *pay
 
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: *token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
 
-	gh := github.NewClient(tc)
+	var fg forge.Forge
+	var host string
+	switch {
+	case *gitlab:
+		if *gitlabToken == "" {
+			log.Fatal("required flag --gitlab-token not provided")
+		}
+		if *repo == "" {
+			*repo = os.Getenv("CI_PROJECT_PATH")
+		}
+
+		host = hostOf(*gitlabURL)
+		fg = forge.NewGitLab(*gitlabURL, *gitlabToken)
+	case *gitea:
+		if *token == "" {
+			log.Fatal("required flag --token not provided")
+		}
+
+		host = hostOf(*giteaURL)
+		fg = forge.NewGitea(*giteaURL, *token)
+	default:
+		if *token == "" {
+			log.Fatal("required flag --token not provided")
+		}
+
+		ts := oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: *token},
+		)
+		tc := oauth2.NewClient(ctx, ts)
+
+		host = "github.com"
+		fg = forge.NewGitHub(github.NewClient(tc))
+	}
+
+	if *repo == "" {
+		log.Fatal("required flag --repo not provided")
+	}
 
-	err := walk(gh, ctx, *repo, *endpoint)
+	err := walk(fg, ctx, host, *repo, *endpoint)
 	if err != nil {
 		log.Fatal(err)
 	}
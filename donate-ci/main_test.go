@@ -0,0 +1,376 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func TestWalkPayout(t *testing.T) {
+	var mutex sync.Mutex
+	var paid []string
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/transactions" {
+				json.NewEncoder(w).Encode([]transaction{{
+					Type:   c.Bitcoin,
+					Tx:     "txid",
+					Status: database.PayoutSent,
+				}})
+				return
+			}
+
+			if r.URL.Path != "/pay" {
+				t.Error("unexpected request", r.URL)
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if r.URL.Query().Get("repo") != "gitlab.com/group/project" {
+				t.Error("unexpected repo", r.URL)
+			}
+
+			mutex.Lock()
+			paid = append(paid, r.URL.Query().Get("issue"))
+			mutex.Unlock()
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[c.Cryptocurrency]string{
+				c.Bitcoin: "txid",
+			})
+		}))
+	defer server.Close()
+
+	recently := time.Now().Add(-time.Hour)
+	longAgo := time.Now().Add(-48 * time.Hour)
+
+	fg := forge.NewFake()
+	fg.SetIssue("group", "project", forge.Issue{
+		Number:   1,
+		State:    forge.Closed,
+		ClosedAt: &recently,
+	})
+	fg.SetIssue("group", "project", forge.Issue{
+		Number:   2,
+		State:    forge.Closed,
+		ClosedAt: &longAgo,
+	})
+	fg.SetIssue("group", "project", forge.Issue{
+		Number:      3,
+		State:       forge.Closed,
+		PullRequest: true,
+		ClosedAt:    &recently,
+	})
+
+	payToken = "token"
+	defer func() { payToken = "" }()
+
+	err := walk(fg, context.Background(), "gitlab.com", "group/project",
+		server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paid) != 1 || paid[0] != "1" {
+		t.Fatal("invalid payouts", paid)
+	}
+
+	comments, err := fg.Comments(context.Background(), "group", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 {
+		t.Fatal("no payout comment")
+	}
+	if !strings.Contains(comments[0].Body, "Payout transactions") ||
+		!strings.Contains(comments[0].Body, "txid") {
+		t.Fatal("invalid payout comment", comments[0].Body)
+	}
+
+	err = walk(fg, context.Background(), "gitlab.com", "group",
+		server.URL)
+	if err == nil {
+		t.Fatal("invalid repo is accepted")
+	}
+}
+
+func TestWalkGitea(t *testing.T) {
+	recently := time.Now().Add(-time.Hour)
+
+	var mutex sync.Mutex
+	var comments []string
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			switch r.Method + " " + r.URL.Path {
+			case "GET /api/v1/repos/owner/project/issues":
+				json.NewEncoder(w).Encode([]interface{}{
+					map[string]interface{}{
+						"number":    1,
+						"state":     "closed",
+						"closed_at": recently,
+					},
+				})
+			case "GET /api/v1/repos/owner/project/issues/1/comments":
+				fmt.Fprint(w, "[]")
+			case "POST /api/v1/repos/owner/project/issues/1/comments":
+				var comment struct{ Body string }
+				json.NewDecoder(r.Body).Decode(&comment)
+				comments = append(comments, comment.Body)
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, "{}")
+			case "GET /pay":
+				repo := r.URL.Query().Get("repo")
+				if repo != r.Host+"/owner/project" {
+					t.Error("unexpected repo", repo)
+				}
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(map[c.Cryptocurrency]string{
+					c.Bitcoin: "txid",
+				})
+			case "GET /transactions":
+				json.NewEncoder(w).Encode([]transaction{{
+					Type:   c.Bitcoin,
+					Tx:     "txid",
+					Status: database.PayoutSent,
+				}})
+			default:
+				t.Error("unexpected request", r.Method, r.URL)
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer server.Close()
+
+	fg := forge.NewGitea(server.URL, "token")
+	err := walk(fg, context.Background(), hostOf(server.URL),
+		"owner/project", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(comments) != 1 || !strings.Contains(comments[0], "txid") {
+		t.Fatal("invalid payout comments", comments)
+	}
+}
+
+func TestTriggerPayoutApproved(t *testing.T) {
+	// Repeated /pay returns 200 with transactions that were sent
+	// after approval of the maintainer
+	var mutex sync.Mutex
+	status := database.PayoutSent
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if r.URL.Path == "/transactions" {
+				json.NewEncoder(w).Encode([]transaction{{
+					Type:          c.Bitcoin,
+					Tx:            "txid",
+					Status:        status,
+					Confirmations: 6,
+				}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[c.Cryptocurrency]string{
+				c.Bitcoin: "txid",
+			})
+		}))
+	defer server.Close()
+
+	fg := forge.NewFake()
+	issue := forge.Issue{Number: 1, State: forge.Closed}
+	fg.SetIssue("owner", "project", issue)
+
+	for i := 0; i < 2; i++ {
+		err := triggerPayout(fg, context.Background(), "github.com",
+			"owner", "project", server.URL, issue)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	comments, err := fg.Comments(context.Background(), "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 || !strings.Contains(comments[0].Body, "txid") ||
+		!strings.Contains(comments[0].Body, "not confirmed") {
+
+		t.Fatal("invalid payout comments", comments)
+	}
+
+	// The comment is updated after confirmation
+	mutex.Lock()
+	status = database.PayoutConfirmed
+	mutex.Unlock()
+	err = triggerPayout(fg, context.Background(), "github.com",
+		"owner", "project", server.URL, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err = fg.Comments(context.Background(), "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 ||
+		!strings.Contains(comments[0].Body, "confirmed, 6 confirmations") {
+
+		t.Fatal("payout comment is not updated", comments)
+	}
+}
+
+func TestTriggerPayoutDryRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("dry_run") != "1" {
+				t.Error("payout is triggered in dry run")
+			}
+			fmt.Fprint(w, `{"State": "idle", "Transfers": []}`)
+		}))
+	defer server.Close()
+
+	dryRun = true
+	defer func() { dryRun = false }()
+
+	fg := forge.NewFake()
+	issue := forge.Issue{Number: 1, State: forge.Closed}
+	fg.SetIssue("owner", "project", issue)
+
+	err := triggerPayout(fg, context.Background(), "github.com",
+		"owner", "project", server.URL, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := fg.Comments(context.Background(), "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 0 {
+		t.Fatal("comment is posted in dry run")
+	}
+}
+
+func TestTriggerPayoutMoved(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/transactions":
+				json.NewEncoder(w).Encode([]transaction{{
+					Type:   c.Bitcoin,
+					Tx:     "txid",
+					Status: database.PayoutSent,
+					To:     2,
+				}})
+			case "/query":
+				issue := database.NewIssue()
+				issue.Wallets[c.Bitcoin] = database.Wallet{
+					Address: "btcaddress",
+				}
+				json.NewEncoder(w).Encode(issue)
+			default:
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{}`)
+			}
+		}))
+	defer server.Close()
+
+	fg := forge.NewFake()
+	issue := forge.Issue{Number: 1, State: forge.Closed}
+	fg.SetIssue("owner", "project", issue)
+	err := fg.AddComment("owner", "project", 1, "bot",
+		"### Donate to this issue\n- BTC: btcaddress\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote := "Sent 0.1 BTC to btcaddress"
+	err = fg.AddComment("owner", "project", 1, "user", quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = triggerPayout(fg, context.Background(), "github.com",
+		"owner", "project", server.URL, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := fg.Comments(context.Background(), "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 3 || comments[0].Body != movedBody(2) ||
+		comments[1].Body != quote ||
+		!strings.Contains(comments[2].Body, "moved to #2") {
+
+		t.Fatal("invalid comments", comments)
+	}
+}
+
+func TestFormatTransactionSuffix(t *testing.T) {
+	for _, tc := range []struct {
+		t        transaction
+		expected string
+	}{
+		{transaction{Type: c.Bitcoin, Tx: "tx", Fee: 5},
+			", including 5% fee to the repository\n"},
+		{transaction{Type: c.Bitcoin, Tx: "tx", Fee: 5, FeeTx: "tx"},
+			", including 5% fee to the repository\n"},
+		{transaction{Type: c.Ethereum, Tx: "tx", Fee: 2.5, FeeTx: "feetx"},
+			", 2.5% fee to the repository: [feetx](" +
+				"https://blockchair.com/ethereum/transaction/feetx)\n"},
+		{transaction{Type: c.Bitcoin, Tx: "tx"}, ")\n"},
+		{transaction{Type: c.Bitcoin, Tx: "tx", To: 2}, ", moved to #2\n"},
+		{transaction{Type: c.Bitcoin, Tx: "tx", From: 3},
+			", received from #3\n"},
+	} {
+		line, ok := formatTransaction(tc.t)
+		if !ok || !strings.HasSuffix(line, tc.expected) {
+			t.Fatal("invalid line", line)
+		}
+	}
+}
+
+func TestIsDonateComment(t *testing.T) {
+	// Bitcoin is disabled, its address is empty
+	issue := database.NewIssue()
+	issue.Wallets[c.Ethereum] = database.Wallet{Address: "ethaddress"}
+
+	for body, expected := range map[string]bool{
+		donateMarker + donateHeader:                         true,
+		donateHeader + "- ETH: ethaddress\n":                true,
+		donateHeader + "- ETH: otheraddress\n":              false,
+		"Thanks!":                                           false,
+		"Please donate to ethaddress":                       false,
+		payoutCommentHeader + "- ETH: [tx](...) ethaddress": false,
+	} {
+		if isDonateComment(body, issue) != expected {
+			t.Fatal("invalid match", body)
+		}
+	}
+}
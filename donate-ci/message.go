@@ -19,13 +19,41 @@ import (
 
 	c "code.dumpstack.io/lib/cryptocurrency"
 	"code.dumpstack.io/tools/donate/database"
-	"github.com/google/go-github/v29/github"
+	"code.dumpstack.io/tools/donate/forge"
 )
 
-func genBody(gh *github.Client, ctx context.Context, issue database.Issue) (
-	body string, totalUSD float64) {
+// donateHeader of the donate comment
+const donateHeader = "### Donate to this issue\n"
 
-	body = "### Donate to this issue\n"
+// donateMarker is the hidden first line of the donate comment, the
+// comment is found by it
+const donateMarker = "<!-- donate -->\n"
+
+// isDonateComment of the issue. Comments that are posted before the
+// marker are found by the header and a wallet address of the issue.
+func isDonateComment(body string, issue database.Issue) bool {
+	if strings.HasPrefix(body, donateMarker) {
+		return true
+	}
+	if !strings.HasPrefix(body, donateHeader) {
+		return false
+	}
+	for _, wallet := range issue.Wallets {
+		if wallet.Address != "" &&
+			strings.Contains(body, wallet.Address) {
+
+			return true
+		}
+	}
+	return false
+}
+
+func genBody(fg forge.Forge, ctx context.Context, issue database.Issue,
+	rs repoSettings, received []transaction) (body string, totalUSD float64) {
+
+	body = donateMarker + donateHeader
+
+	host := strings.Split(issue.Repo, "/")[0]
 
 	var keys []c.Cryptocurrency
 	for k, _ := range issue.Wallets {
@@ -77,26 +105,61 @@ func genBody(gh *github.Client, ctx context.Context, issue database.Issue) (
 
 	body += fmt.Sprintf("- Total $%.2f\n", totalUSD)
 
+	if len(received) != 0 {
+		body += "#### Moved from other issues\n"
+		for _, t := range received {
+			line, ok := formatTransaction(t)
+			if ok {
+				body += line
+			}
+		}
+	}
+
 	// > How to claim a bounty
 
 	body += "\n<details><summary>How to claim a bounty</summary><p>\n\n"
 
-	body += "1. Specify this issue in commit message ([keywords]" +
-		"(https://help.github.com/en/github/managing-your-work-on-" +
-		"github/closing-issues-using-keywords));\n"
-	body += "2. Put to the body of pull request your"
-	for _, cc := range c.Cryptocurrencies {
-		body += " " + strings.ToUpper(cc.Symbol()) + ","
-	}
-	body = body[:len(body)-1]
-	body += " addresses in the format:"
+	body += "1. Specify this issue in the commit message or in the " +
+		"pull request ([keywords](https://help.github.com/en/github/" +
+		"managing-your-work-on-github/closing-issues-using-" +
+		"keywords));\n"
+
+	var symbols, format []string
 	for _, cc := range c.Cryptocurrencies {
 		symbol := strings.ToUpper(cc.Symbol())
-		body += fmt.Sprintf(" %s{your_%s_address},", symbol, cc.Symbol())
+		symbols = append(symbols, symbol)
+		format = append(format, fmt.Sprintf("%s{your_%s_address}",
+			symbol, cc.Symbol()))
+	}
+	body += "2. Put your " + strings.Join(symbols, ", ") + " addresses " +
+		"to the body of the pull request in the format: " +
+		strings.Join(format, " ") + ". Instead, post the comment `/claim " +
+		format[0] + "` on the pull request or on this issue after " +
+		"the merge, or register addresses once at the donation " +
+		"server (`/login`);\n"
+	body += "3. After the merge the bounty is sent to your addresses " +
+		"when this issue is closed. Currencies without an address " +
+		"wait for claims for 6 hours after the issue is closed, " +
+		"then they go to the donation addresses of the repository;\n"
+	if rs.Split {
+		body += "4. Several contributors (pull requests or " +
+			"`Co-authored-by:` lines with addresses) share the " +
+			"bounty, put WEIGHT{2} next to addresses in the pull " +
+			"request to get a bigger share.\n"
+	} else {
+		body += "4. The bounty goes to one contributor. If several " +
+			"contributors (pull requests or `Co-authored-by:` " +
+			"lines with addresses) claim it, the maintainer " +
+			"chooses one by the comment `/donate pay @user`.\n"
+	}
+	if rs.StrictClaims {
+		body += "5. Claims must be signed: sign the message `donate: " +
+			"claim " + issue.Repo + "#" + strconv.Itoa(issue.ID) +
+			" to ADDRESS` with the key of the address (\"Sign " +
+			"message\" of Bitcoin wallets, `personal_sign` of " +
+			"Ethereum wallets) and put the signature next to the " +
+			"address: BTCSIG{base64_signature}, ETHSIG{0x...}.\n"
 	}
-	body = body[:len(body)-1] + ";"
-	body += "\n3. When pull request will be accepted, you'll immediately " +
-		"get all cryptocurrency to wallets that you're specified.\n"
 
 	body += "\n</p></details>\n\n"
 
@@ -108,7 +171,7 @@ func genBody(gh *github.Client, ctx context.Context, issue database.Issue) (
 			"Top 10 issues with a bounty (this repository)" +
 			"</summary><p>\n\n"
 
-		body += dumpIssues(gh, ctx, issues, 10)
+		body += dumpIssues(fg, ctx, host, issues, 10)
 
 		body += "\n</p></details>\n\n"
 	}
@@ -121,36 +184,49 @@ func genBody(gh *github.Client, ctx context.Context, issue database.Issue) (
 			"Top 10 issues with a bounty (all repositories)" +
 			"</summary><p>\n\n"
 
-		body += dumpIssues(gh, ctx, issues, 10)
+		body += dumpIssues(fg, ctx, host, issues, 10)
 
 		body += "\n</p></details>\n\n"
 	}
 
 	// Footer
 
-	body += "###### The default fee is 0% (someone who will solve this " +
-		"issue will get all money without commission). " +
-		"Consider donating to the [donation project]" +
+	if fee := rs.Fee; fee != 0 {
+		body += fmt.Sprintf("###### The fee is %g%% (someone who "+
+			"will solve this issue will get %g%% of money, the "+
+			"rest is sent to the donation address of the "+
+			"repository). ", fee, 100-fee)
+	} else {
+		body += "###### The default fee is 0% (someone who will " +
+			"solve this issue will get all money without " +
+			"commission). "
+	}
+	body += "Consider donating to the [donation project]" +
 		"(https://github.com/jollheef/donate) " +
 		"itself, it'll help keep it work with zero fees. " +
 		"[List of all issues with bounties](https://donate.dumpstack.io).\n"
 	return
 }
 
-func dumpIssues(gh *github.Client, ctx context.Context, issues []issue, n int) (s string) {
+// dumpIssues as a list of links, titles are only queried for issues
+// hosted on the same forge
+func dumpIssues(fg forge.Forge, ctx context.Context, host string,
+	issues []issue, n int) (s string) {
+
 	for id, issue := range issues {
 		if id > n-1 {
 			break
 		}
 
+		// e.g. gitlab.com/group/subgroup/project/issues/1
 		fields := strings.Split(issue.URL, "/")
-		if len(fields) != 5 {
+		if len(fields) < 5 || fields[len(fields)-2] != "issues" {
 			log.Println("url inside database is not valid")
 			continue
 		}
-		owner := fields[1]
-		repo := fields[2]
-		no, err := strconv.Atoi(fields[4])
+		owner := strings.Join(fields[1:len(fields)-3], "/")
+		repo := fields[len(fields)-3]
+		no, err := strconv.Atoi(fields[len(fields)-1])
 		if err != nil {
 			log.Println("issue id is not valid")
 			continue
@@ -158,11 +234,13 @@ func dumpIssues(gh *github.Client, ctx context.Context, issues []issue, n int) (
 
 		redir := "https://donate.dumpstack.io/redirect?url=" + issue.URL
 
-		ghIssue, _, err := gh.Issues.Get(ctx, owner, repo, no)
 		var name string
-		if err == nil {
-			name = *ghIssue.Title
-			name += " — "
+		if fields[0] == host {
+			fgIssue, err := fg.Issue(ctx, owner, repo, no)
+			if err == nil {
+				name = fgIssue.Title
+				name += " — "
+			}
 		}
 
 		url := fmt.Sprintf("%s[%s/%s#%d](%s)", name, owner, repo, no, redir)
@@ -0,0 +1,321 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by Fake for unknown issues and comments
+var ErrNotFound = errors.New("not found")
+
+type fakeIssue struct {
+	issue     Issue
+	duplicate int
+	prs       []PullRequest
+	comments  []Comment
+}
+
+// Fake is an in-memory forge for tests
+type Fake struct {
+	mutex       sync.Mutex
+	issues      map[string]map[int]*fakeIssue
+	files       map[string]bool
+	maintainers map[string]bool
+	commits     map[string][]string
+	lastID      int64
+}
+
+// NewFake forge without issues
+func NewFake() *Fake {
+	return &Fake{
+		issues:      make(map[string]map[int]*fakeIssue),
+		files:       make(map[string]bool),
+		maintainers: make(map[string]bool),
+		commits:     make(map[string][]string),
+	}
+}
+
+func (f *Fake) get(owner, project string, number int) (
+	fi *fakeIssue, err error) {
+
+	fi, ok := f.issues[owner+"/"+project][number]
+	if !ok {
+		err = ErrNotFound
+	}
+	return
+}
+
+// SetIssue adds the issue, or replaces the existing one
+// with the same number
+func (f *Fake) SetIssue(owner, project string, issue Issue) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	repo := owner + "/" + project
+	if f.issues[repo] == nil {
+		f.issues[repo] = make(map[int]*fakeIssue)
+	}
+
+	fi, ok := f.issues[repo][issue.Number]
+	if !ok {
+		fi = &fakeIssue{}
+		f.issues[repo][issue.Number] = fi
+	}
+	fi.issue = issue
+}
+
+// SetFile adds the file to the repository
+func (f *Fake) SetFile(owner, project, path string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.files[owner+"/"+project+"/"+path] = true
+}
+
+// SetMaintainer of the repository
+func (f *Fake) SetMaintainer(owner, project, login string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.maintainers[owner+"/"+project+"/"+login] = true
+}
+
+// SetCommits of the pull request
+func (f *Fake) SetCommits(owner, project string, number int,
+	messages ...string) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.commits[fmt.Sprintf("%s/%s/%d", owner, project, number)] = messages
+}
+
+// SetDuplicate marks the existing issue as a duplicate of canonical
+func (f *Fake) SetDuplicate(owner, project string, number,
+	canonical int) (err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	fi.duplicate = canonical
+	return
+}
+
+// SetClosingPullRequest of the existing issue, replaces all
+// previously added pull requests
+func (f *Fake) SetClosingPullRequest(owner, project string, number int,
+	pr PullRequest) (err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	fi.prs = []PullRequest{pr}
+	return
+}
+
+// AddClosingPullRequest to the existing issue
+func (f *Fake) AddClosingPullRequest(owner, project string, number int,
+	pr PullRequest) (err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	fi.prs = append(fi.prs, pr)
+	return
+}
+
+// Issue by the number
+func (f *Fake) Issue(ctx context.Context, owner, project string,
+	number int) (issue Issue, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	issue = fi.issue
+	return
+}
+
+// Issues of the repository ordered by number
+func (f *Fake) Issues(ctx context.Context, owner, project string) (
+	issues []Issue, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, fi := range f.issues[owner+"/"+project] {
+		if fi.issue.PullRequest {
+			continue
+		}
+		issues = append(issues, fi.issue)
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].Number < issues[j].Number
+	})
+	return
+}
+
+// ClosingPullRequests of the issue
+func (f *Fake) ClosingPullRequests(ctx context.Context,
+	owner, project string, number int) (prs []PullRequest, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	prs = append(prs, fi.prs...)
+	return
+}
+
+// PullRequestComments are comments of the issue with the number
+// of the pull request, as on GitHub. Pull requests that are not set
+// as issues have no comments.
+func (f *Fake) PullRequestComments(ctx context.Context, owner,
+	project string, number int) (comments []Comment, err error) {
+
+	comments, err = f.Comments(ctx, owner, project, number)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// PullRequestCommits set by SetCommits, none by default
+func (f *Fake) PullRequestCommits(ctx context.Context, owner,
+	project string, number int) (messages []string, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := fmt.Sprintf("%s/%s/%d", owner, project, number)
+	messages = append(messages, f.commits[key]...)
+	return
+}
+
+// Comments of the issue
+func (f *Fake) Comments(ctx context.Context, owner, project string,
+	number int) (comments []Comment, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	comments = append(comments, fi.comments...)
+	return
+}
+
+// CreateComment on the issue, author is empty
+func (f *Fake) CreateComment(ctx context.Context, owner, project string,
+	number int, body string) (err error) {
+
+	return f.AddComment(owner, project, number, "", body)
+}
+
+// AddComment on the issue from the author
+func (f *Fake) AddComment(owner, project string, number int,
+	author, body string) (err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+
+	f.lastID++
+	fi.comments = append(fi.comments, Comment{
+		ID:     f.lastID,
+		Author: author,
+		Body:   body,
+	})
+	return
+}
+
+// EditComment of the issue
+func (f *Fake) EditComment(ctx context.Context, owner, project string,
+	number int, id int64, body string) (err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+
+	for i := range fi.comments {
+		if fi.comments[i].ID == id {
+			fi.comments[i].Body = body
+			return
+		}
+	}
+	return ErrNotFound
+}
+
+// FileExists in the repository
+func (f *Fake) FileExists(ctx context.Context, owner, project,
+	path string) (exists bool, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	exists = f.files[owner+"/"+project+"/"+path]
+	return
+}
+
+// IsMaintainer of the repository
+func (f *Fake) IsMaintainer(ctx context.Context, owner, project,
+	login string) (maintainer bool, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	maintainer = f.maintainers[owner+"/"+project+"/"+login]
+	return
+}
+
+// DuplicateOf the issue
+func (f *Fake) DuplicateOf(ctx context.Context, owner, project string,
+	number int) (canonical int, found bool, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fi, err := f.get(owner, project, number)
+	if err != nil {
+		return
+	}
+	canonical = fi.duplicate
+	found = canonical != 0
+	return
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+// Package forge provides operations on code hosting (GitHub, etc.)
+// that are required for donations.
+package forge
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// State of the issue
+type State string
+
+const (
+	// Open issue
+	Open State = "open"
+	// Closed issue
+	Closed State = "closed"
+)
+
+// Issue on the forge
+type Issue struct {
+	// Number of the issue inside repository
+	Number int
+	// Title of the issue
+	Title string
+	// State of the issue
+	State State
+	// PullRequest is true if the issue is actually a pull request
+	PullRequest bool
+	// ClosedAt is nil if the issue was never closed
+	ClosedAt *time.Time
+}
+
+// PullRequest (or merge request) that is merged
+type PullRequest struct {
+	// Number of the pull request inside repository
+	Number int
+	// Author login
+	Author string
+	// Body (description) of the pull request
+	Body string
+	// MergeSHA is the merge (or squash) commit, empty if the
+	// forge does not report it
+	MergeSHA string
+}
+
+// Comment of the issue
+type Comment struct {
+	// ID of the comment, unique for the forge
+	ID int64
+	// Author login
+	Author string
+	// Body of the comment
+	Body string
+}
+
+// Forge is a code hosting. Owner is the user or organization (or
+// the group path, for forges with nested groups), project is the
+// repository name.
+type Forge interface {
+	// Issue by the number
+	Issue(ctx context.Context, owner, project string, number int) (
+		issue Issue, err error)
+
+	// Issues of the repository in any state, pull requests
+	// are not included
+	Issues(ctx context.Context, owner, project string) (
+		issues []Issue, err error)
+
+	// ClosingPullRequests returns merged pull requests that are
+	// linked to the issue, in order of linking
+	ClosingPullRequests(ctx context.Context, owner, project string,
+		number int) (prs []PullRequest, err error)
+
+	// Comments of the issue
+	Comments(ctx context.Context, owner, project string, number int) (
+		comments []Comment, err error)
+
+	// PullRequestComments of the pull request (merge request)
+	PullRequestComments(ctx context.Context, owner, project string,
+		number int) (comments []Comment, err error)
+
+	// PullRequestCommits returns messages of commits of the pull
+	// request (merge request) in order of the branch
+	PullRequestCommits(ctx context.Context, owner, project string,
+		number int) (messages []string, err error)
+
+	// CreateComment on the issue
+	CreateComment(ctx context.Context, owner, project string,
+		number int, body string) (err error)
+
+	// EditComment of the issue
+	EditComment(ctx context.Context, owner, project string,
+		number int, id int64, body string) (err error)
+
+	// FileExists in the default branch of the repository
+	FileExists(ctx context.Context, owner, project, path string) (
+		exists bool, err error)
+
+	// IsMaintainer returns true if the user has write access
+	// to the repository (the maintainer role on GitLab)
+	IsMaintainer(ctx context.Context, owner, project, login string) (
+		maintainer bool, err error)
+
+	// DuplicateOf returns the canonical issue in the same repository
+	// if the issue is marked as a duplicate
+	DuplicateOf(ctx context.Context, owner, project string,
+		number int) (canonical int, found bool, err error)
+}
+
+var duplicateRe = regexp.MustCompile(`(?i)\bduplicate of #([0-9]+)\b`)
+
+// duplicateOf returns the issue of "Duplicate of #N" in the text
+func duplicateOf(text string) (number int, ok bool) {
+	match := duplicateRe.FindStringSubmatch(text)
+	if match == nil {
+		return
+	}
+	number, err := strconv.Atoi(match[1])
+	ok = err == nil
+	return
+}
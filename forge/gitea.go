@@ -0,0 +1,300 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gitea forge (also works with Forgejo)
+type Gitea struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewGitea forge, baseURL is e.g. https://gitea.example.org, token
+// is optional for public repositories if no comments are posted.
+func NewGitea(baseURL, token string) *Gitea {
+	return &Gitea{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  http.DefaultClient,
+	}
+}
+
+// request to the Gitea API v1, path is relative to the repository
+func (gt *Gitea) request(ctx context.Context, method, owner, project,
+	path string, in, out interface{}) (err error) {
+
+	u := fmt.Sprintf("%s/api/v1/repos/%s/%s%s", gt.baseURL,
+		url.PathEscape(owner), url.PathEscape(project), path)
+
+	header := make(http.Header)
+	if gt.token != "" {
+		header.Set("Authorization", "token "+gt.token)
+	}
+	return request(ctx, gt.client, method, u, header, in, out)
+}
+
+// giteaPageSize is the default maximum of items per page, closed
+// pull requests are paginated with it
+const giteaPageSize = 50
+
+type giteaUser struct {
+	Login string `json:"login"`
+}
+
+type giteaIssue struct {
+	Number      int        `json:"number"`
+	Title       string     `json:"title"`
+	State       string     `json:"state"`
+	ClosedAt    *time.Time `json:"closed_at"`
+	PullRequest *struct{}  `json:"pull_request"`
+}
+
+func (i giteaIssue) issue() (issue Issue) {
+	issue.Number = i.Number
+	issue.Title = i.Title
+	issue.State = Closed
+	if i.State == "open" {
+		issue.State = Open
+	}
+	issue.PullRequest = i.PullRequest != nil
+	issue.ClosedAt = i.ClosedAt
+	return
+}
+
+// Issue by the number
+func (gt *Gitea) Issue(ctx context.Context, owner, project string,
+	number int) (issue Issue, err error) {
+
+	var i giteaIssue
+	err = gt.request(ctx, "GET", owner, project,
+		fmt.Sprintf("/issues/%d", number), nil, &i)
+	if err != nil {
+		return
+	}
+
+	issue = i.issue()
+	return
+}
+
+// Issues of the repository in any state, pull requests are excluded
+func (gt *Gitea) Issues(ctx context.Context, owner, project string) (
+	issues []Issue, err error) {
+
+	var is []giteaIssue
+	err = gt.request(ctx, "GET", owner, project,
+		"/issues?state=all&type=issues&limit=50", nil, &is)
+	if err != nil {
+		return
+	}
+
+	for _, i := range is {
+		if i.PullRequest != nil {
+			continue
+		}
+		issues = append(issues, i.issue())
+	}
+	return
+}
+
+// closes reports whether the text closes the issue according
+// to the Gitea keywords, e.g. "Fixes #1".
+func closes(text string, number int) bool {
+	re := regexp.MustCompile(`(?i)\b(?:close[sd]?|fix(?:e[sd])?|` +
+		`resolve[sd]?):?\s+#` + strconv.Itoa(number) + `\b`)
+	return re.MatchString(text)
+}
+
+// ClosingPullRequests are merged pull requests that refer to the
+// issue with a closing keyword. Gitea does not link pull requests
+// to the issues they close, so recently closed pull requests are
+// checked.
+func (gt *Gitea) ClosingPullRequests(ctx context.Context,
+	owner, project string, number int) (prs []PullRequest, err error) {
+
+	for page := 1; ; page++ {
+		var pulls []struct {
+			Number         int       `json:"number"`
+			Title          string    `json:"title"`
+			Body           string    `json:"body"`
+			Merged         bool      `json:"merged"`
+			User           giteaUser `json:"user"`
+			MergeCommitSHA string    `json:"merge_commit_sha"`
+		}
+		err = gt.request(ctx, "GET", owner, project,
+			fmt.Sprintf("/pulls?state=closed&sort=recentupdate"+
+				"&limit=%d&page=%d", giteaPageSize, page),
+			nil, &pulls)
+		if err != nil {
+			return
+		}
+
+		for _, p := range pulls {
+			if !p.Merged || !closes(p.Title+"\n"+p.Body, number) {
+				continue
+			}
+
+			prs = append(prs, PullRequest{
+				Number:   p.Number,
+				Author:   p.User.Login,
+				Body:     p.Body,
+				MergeSHA: p.MergeCommitSHA,
+			})
+		}
+
+		if len(pulls) < giteaPageSize {
+			return
+		}
+	}
+}
+
+// PullRequestComments are comments of the issue of the pull request,
+// pull requests are issues on Gitea
+func (gt *Gitea) PullRequestComments(ctx context.Context, owner,
+	project string, number int) (comments []Comment, err error) {
+
+	return gt.Comments(ctx, owner, project, number)
+}
+
+// PullRequestCommits of the pull request
+func (gt *Gitea) PullRequestCommits(ctx context.Context, owner,
+	project string, number int) (messages []string, err error) {
+
+	for page := 1; ; page++ {
+		var commits []struct {
+			Commit struct {
+				Message string `json:"message"`
+			} `json:"commit"`
+		}
+		err = gt.request(ctx, "GET", owner, project,
+			fmt.Sprintf("/pulls/%d/commits?limit=%d&page=%d",
+				number, giteaPageSize, page), nil, &commits)
+		if err != nil {
+			return
+		}
+
+		for _, commit := range commits {
+			messages = append(messages, commit.Commit.Message)
+		}
+
+		if len(commits) < giteaPageSize {
+			return
+		}
+	}
+}
+
+// Comments of the issue
+func (gt *Gitea) Comments(ctx context.Context, owner, project string,
+	number int) (comments []Comment, err error) {
+
+	for page := 1; ; page++ {
+		var cs []struct {
+			ID   int64     `json:"id"`
+			Body string    `json:"body"`
+			User giteaUser `json:"user"`
+		}
+		err = gt.request(ctx, "GET", owner, project,
+			fmt.Sprintf("/issues/%d/comments?limit=%d&page=%d",
+				number, giteaPageSize, page), nil, &cs)
+		if err != nil {
+			return
+		}
+
+		for _, comment := range cs {
+			comments = append(comments, Comment{
+				ID:     comment.ID,
+				Author: comment.User.Login,
+				Body:   comment.Body,
+			})
+		}
+
+		if len(cs) < giteaPageSize {
+			return
+		}
+	}
+}
+
+// CreateComment on the issue
+func (gt *Gitea) CreateComment(ctx context.Context, owner, project string,
+	number int, body string) (err error) {
+
+	comment := struct {
+		Body string `json:"body"`
+	}{body}
+	return gt.request(ctx, "POST", owner, project,
+		fmt.Sprintf("/issues/%d/comments", number), comment, nil)
+}
+
+// EditComment of the issue, comment IDs are unique within
+// the repository in Gitea
+func (gt *Gitea) EditComment(ctx context.Context, owner, project string,
+	number int, id int64, body string) (err error) {
+
+	comment := struct {
+		Body string `json:"body"`
+	}{body}
+	return gt.request(ctx, "PATCH", owner, project,
+		fmt.Sprintf("/issues/comments/%d", id), comment, nil)
+}
+
+// FileExists in the default branch of the repository
+func (gt *Gitea) FileExists(ctx context.Context, owner, project,
+	path string) (exists bool, err error) {
+
+	var segments []string
+	for _, s := range strings.Split(path, "/") {
+		segments = append(segments, url.PathEscape(s))
+	}
+
+	err = gt.request(ctx, "GET", owner, project,
+		"/contents/"+strings.Join(segments, "/"), nil, nil)
+	if isNotFound(err) {
+		err = nil
+		return
+	}
+	exists = err == nil
+	return
+}
+
+// IsMaintainer if the user has owner, admin or write permission
+func (gt *Gitea) IsMaintainer(ctx context.Context, owner, project,
+	login string) (maintainer bool, err error) {
+
+	var result struct {
+		Permission string `json:"permission"`
+	}
+	err = gt.request(ctx, "GET", owner, project, "/collaborators/"+
+		url.PathEscape(login)+"/permission", nil, &result)
+	if isNotFound(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	switch result.Permission {
+	case "owner", "admin", "write":
+		maintainer = true
+	}
+	return
+}
+
+// DuplicateOf is never found, Gitea does not mark duplicates
+func (gt *Gitea) DuplicateOf(ctx context.Context, owner, project string,
+	number int) (canonical int, found bool, err error) {
+
+	return
+}
@@ -0,0 +1,257 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// giteaServer is a minimal Gitea-compatible API
+func giteaServer(comments map[string]string) *httptest.Server {
+	prefix := "/api/v1/repos/owner/project"
+	routes := map[string]interface{}{
+		prefix + "/issues/1": map[string]interface{}{
+			"number":    1,
+			"title":     "Issue",
+			"state":     "closed",
+			"closed_at": "2020-02-06T10:01:43Z",
+		},
+		prefix + "/issues": []interface{}{
+			map[string]interface{}{"number": 1, "state": "closed"},
+			map[string]interface{}{
+				"number":       2,
+				"state":        "closed",
+				"pull_request": map[string]interface{}{"merged": true},
+			},
+			map[string]interface{}{"number": 4, "state": "open"},
+		},
+		prefix + "/pulls?page=2": []interface{}{
+			map[string]interface{}{
+				"number":           2,
+				"body":             "Fixes #1\n\nBTC{right}",
+				"merged":           true,
+				"merge_commit_sha": "abc",
+				"user":             map[string]interface{}{"login": "contributor"},
+			},
+			map[string]interface{}{
+				"number": 3,
+				"body":   "Fixes #10\n\nBTC{wrong}",
+				"merged": true,
+			},
+			map[string]interface{}{
+				"number": 5,
+				"body":   "Closes #1\n\nBTC{second}",
+				"merged": true,
+				"user":   map[string]interface{}{"login": "other"},
+			},
+		},
+		prefix + "/contents/.gitea/workflows/donate.yml": map[string]interface{}{
+			"type": "file",
+		},
+		prefix + "/collaborators/maintainer/permission": map[string]interface{}{
+			"permission": "write",
+		},
+		prefix + "/collaborators/reader/permission": map[string]interface{}{
+			"permission": "read",
+		},
+		prefix + "/issues/1/comments?page=2": []interface{}{
+			map[string]interface{}{
+				"id":   11,
+				"body": "thanks",
+				"user": map[string]interface{}{"login": "user"},
+			},
+		},
+	}
+
+	routes[prefix+"/pulls/2/commits?page=1"] = []interface{}{
+		map[string]interface{}{
+			"commit": map[string]interface{}{"message": "first"},
+		},
+	}
+
+	// pull requests that close the issue are on the second page
+	var recent []interface{}
+	for i := 0; i < giteaPageSize; i++ {
+		recent = append(recent, map[string]interface{}{
+			"number": 100 + i,
+			"body":   "Fixes #10",
+			"merged": true,
+		})
+	}
+	routes[prefix+"/pulls?page=1"] = recent
+	routes[prefix+"/pulls?page=3"] = []interface{}{}
+
+	// the comment of the user is on the second page
+	var bot []interface{}
+	for i := 0; i < giteaPageSize; i++ {
+		bot = append(bot, map[string]interface{}{
+			"id":   100 + i,
+			"body": "ping",
+			"user": map[string]interface{}{"login": "bot"},
+		})
+	}
+	routes[prefix+"/issues/1/comments?page=1"] = bot
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "token token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if r.Method == "POST" || r.Method == "PATCH" {
+				var comment struct{ Body string }
+				json.NewDecoder(r.Body).Decode(&comment)
+				comments[r.Method+" "+r.URL.Path] = comment.Body
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{}`)
+				return
+			}
+
+			path := r.URL.Path
+			if page := r.URL.Query().Get("page"); page != "" {
+				path += "?page=" + page
+			}
+			v, ok := routes[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(v)
+		}))
+}
+
+func TestGitea(t *testing.T) {
+	comments := make(map[string]string)
+	server := giteaServer(comments)
+	defer server.Close()
+
+	gt := NewGitea(server.URL, "token")
+	ctx := context.Background()
+
+	issue, err := gt.Issue(ctx, "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue.Number != 1 || issue.State != Closed || issue.ClosedAt == nil {
+		t.Fatal("invalid issue", issue)
+	}
+
+	issues, err := gt.Issues(ctx, "owner", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 2 || issues[1].State != Open {
+		t.Fatal("invalid issues", issues)
+	}
+
+	prs, err := gt.ClosingPullRequests(ctx, "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 2 || prs[0].Number != 2 || prs[0].MergeSHA != "abc" ||
+		prs[0].Author != "contributor" || prs[1].Number != 5 {
+
+		t.Fatal("invalid pull requests", prs)
+	}
+
+	prs, err = gt.ClosingPullRequests(ctx, "owner", "project", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 0 {
+		t.Fatal("pull request is found for the open issue")
+	}
+
+	messages, err := gt.PullRequestCommits(ctx, "owner", "project", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0] != "first" {
+		t.Fatal("invalid commits", messages)
+	}
+
+	cs, err := gt.Comments(ctx, "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := len(cs) - 1
+	if len(cs) != giteaPageSize+1 || cs[last].ID != 11 ||
+		cs[last].Author != "user" {
+
+		t.Fatal("invalid comments", cs)
+	}
+
+	err = gt.CreateComment(ctx, "owner", "project", 1, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gt.EditComment(ctx, "owner", "project", 1, 11, "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "/api/v1/repos/owner/project/issues"
+	if comments["POST "+prefix+"/1/comments"] != "new" ||
+		comments["PATCH "+prefix+"/comments/11"] != "edit" {
+
+		t.Fatal("invalid comments", comments)
+	}
+
+	_, err = gt.Issue(ctx, "owner", "project", 5)
+	if err == nil {
+		t.Fatal("no error for unknown issue")
+	}
+
+	for path, expected := range map[string]bool{
+		".gitea/workflows/donate.yml": true,
+		".donate.yml":                 false,
+	} {
+		exists, err := gt.FileExists(ctx, "owner", "project", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != expected {
+			t.Fatal(path, exists)
+		}
+	}
+
+	for login, expected := range map[string]bool{
+		"maintainer": true,
+		"reader":     false,
+		"nobody":     false,
+	} {
+		maintainer, err := gt.IsMaintainer(ctx, "owner", "project", login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maintainer != expected {
+			t.Fatal(login, maintainer)
+		}
+	}
+}
+
+func TestCloses(t *testing.T) {
+	for text, expected := range map[string]bool{
+		"Fixes #1":       true,
+		"closes: #1":     true,
+		"Resolved #1.":   true,
+		"Fixes #10":      false,
+		"See #1":         false,
+		"Fixes #2, #1":   false,
+		"fix #3\nfix #1": true,
+	} {
+		if closes(text, 1) != expected {
+			t.Fatal(text, "expected", expected)
+		}
+	}
+}
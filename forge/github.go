@@ -0,0 +1,293 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+)
+
+// GitHub forge
+type GitHub struct {
+	client *github.Client
+}
+
+// NewGitHub forge with the (authenticated) client
+func NewGitHub(client *github.Client) *GitHub {
+	return &GitHub{client: client}
+}
+
+func githubIssue(ghIssue *github.Issue) (issue Issue) {
+	issue.Number = ghIssue.GetNumber()
+	issue.Title = ghIssue.GetTitle()
+	issue.State = State(ghIssue.GetState())
+	// Note: GitHub's REST API v3 considers every pull
+	// request an issue, but not every issue is a pull
+	// request.
+	issue.PullRequest = ghIssue.IsPullRequest()
+	issue.ClosedAt = ghIssue.ClosedAt
+	return
+}
+
+// Issue by the number
+func (gh *GitHub) Issue(ctx context.Context, owner, project string,
+	number int) (issue Issue, err error) {
+
+	ghIssue, _, err := gh.client.Issues.Get(ctx, owner, project, number)
+	if err != nil {
+		return
+	}
+
+	issue = githubIssue(ghIssue)
+	return
+}
+
+// Issues of the repository in any state
+func (gh *GitHub) Issues(ctx context.Context, owner, project string) (
+	issues []Issue, err error) {
+
+	options := github.IssueListByRepoOptions{State: "all"}
+	ghIssues, _, err := gh.client.Issues.ListByRepo(ctx, owner, project,
+		&options)
+	if err != nil {
+		return
+	}
+
+	for _, ghIssue := range ghIssues {
+		if ghIssue.IsPullRequest() {
+			continue
+		}
+		issues = append(issues, githubIssue(ghIssue))
+	}
+	return
+}
+
+// ClosingPullRequests are looked up by the commits that are
+// referenced in the issue events
+func (gh *GitHub) ClosingPullRequests(ctx context.Context,
+	owner, project string, number int) (prs []PullRequest, err error) {
+
+	events, _, err := gh.client.Issues.ListIssueEvents(ctx,
+		owner, project, number, nil)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[int]bool)
+	for _, event := range events {
+		if event.CommitID == nil {
+			continue
+		}
+
+		pr, found, err := gh.lookupPR(ctx, owner, project,
+			*event.CommitID)
+		if err != nil {
+			return nil, err
+		}
+		if !found || seen[pr.Number] {
+			continue
+		}
+		seen[pr.Number] = true
+		prs = append(prs, pr)
+	}
+	return
+}
+
+func (gh *GitHub) lookupPR(ctx context.Context, owner, project,
+	commit string) (pr PullRequest, found bool, err error) {
+
+	pullRequests, _, err := gh.client.PullRequests.ListPullRequestsWithCommit(
+		ctx, owner, project, commit, nil)
+	if err != nil {
+		return
+	}
+
+	for _, ghPR := range pullRequests {
+		if ghPR.MergedAt == nil {
+			continue
+		}
+
+		found = true
+		pr.Number = ghPR.GetNumber()
+		pr.Author = ghPR.GetUser().GetLogin()
+		pr.Body = ghPR.GetBody()
+		pr.MergeSHA = ghPR.GetMergeCommitSHA()
+		break
+	}
+	return
+}
+
+// PullRequestComments are comments of the issue of the pull request,
+// pull requests are issues on GitHub
+func (gh *GitHub) PullRequestComments(ctx context.Context, owner,
+	project string, number int) (comments []Comment, err error) {
+
+	return gh.Comments(ctx, owner, project, number)
+}
+
+// PullRequestCommits of the pull request
+func (gh *GitHub) PullRequestCommits(ctx context.Context, owner,
+	project string, number int) (messages []string, err error) {
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		commits, resp, err := gh.client.PullRequests.ListCommits(ctx,
+			owner, project, number, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, commit := range commits {
+			messages = append(messages,
+				commit.GetCommit().GetMessage())
+		}
+		if resp.NextPage == 0 {
+			return messages, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// Comments of the issue
+func (gh *GitHub) Comments(ctx context.Context, owner, project string,
+	number int) (comments []Comment, err error) {
+
+	opts := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		ghComments, resp, err := gh.client.Issues.ListComments(ctx,
+			owner, project, number, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, ghComment := range ghComments {
+			comments = append(comments, Comment{
+				ID:     ghComment.GetID(),
+				Author: ghComment.GetUser().GetLogin(),
+				Body:   ghComment.GetBody(),
+			})
+		}
+		if resp.NextPage == 0 {
+			return comments, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// CreateComment on the issue
+func (gh *GitHub) CreateComment(ctx context.Context, owner, project string,
+	number int, body string) (err error) {
+
+	comment := github.IssueComment{Body: &body}
+	_, _, err = gh.client.Issues.CreateComment(ctx, owner, project,
+		number, &comment)
+	return
+}
+
+// EditComment of the issue
+func (gh *GitHub) EditComment(ctx context.Context, owner, project string,
+	number int, id int64, body string) (err error) {
+
+	comment := github.IssueComment{Body: &body}
+	_, _, err = gh.client.Issues.EditComment(ctx, owner, project,
+		id, &comment)
+	return
+}
+
+// FileExists in the default branch of the repository
+func (gh *GitHub) FileExists(ctx context.Context, owner, project,
+	path string) (exists bool, err error) {
+
+	_, _, resp, err := gh.client.Repositories.GetContents(ctx, owner,
+		project, path, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		err = nil
+		return
+	}
+	exists = err == nil
+	return
+}
+
+// IsMaintainer if the user has admin or write permission
+func (gh *GitHub) IsMaintainer(ctx context.Context, owner, project,
+	login string) (maintainer bool, err error) {
+
+	level, _, err := gh.client.Repositories.GetPermissionLevel(ctx,
+		owner, project, login)
+	if err != nil {
+		return
+	}
+
+	switch level.GetPermission() {
+	case "admin", "write":
+		maintainer = true
+	}
+	return
+}
+
+// DuplicateOf is the issue of the last "Duplicate of #N" comment,
+// GitHub marks the issue as a duplicate by such comment. Only comments
+// of the user who marked the issue or of maintainers are considered.
+func (gh *GitHub) DuplicateOf(ctx context.Context, owner, project string,
+	number int) (canonical int, found bool, err error) {
+
+	marked, actor := false, ""
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		events, resp, err := gh.client.Issues.ListIssueEvents(ctx,
+			owner, project, number, opts)
+		if err != nil {
+			return 0, false, err
+		}
+		for _, event := range events {
+			switch event.GetEvent() {
+			case "marked_as_duplicate":
+				marked = true
+				actor = event.GetActor().GetLogin()
+			case "unmarked_as_duplicate":
+				marked = false
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	if !marked {
+		return
+	}
+
+	comments, err := gh.Comments(ctx, owner, project, number)
+	if err != nil {
+		return
+	}
+
+	for i := len(comments) - 1; i >= 0; i-- {
+		n, ok := duplicateOf(comments[i].Body)
+		if !ok {
+			continue
+		}
+
+		author := comments[i].Author
+		if !strings.EqualFold(author, actor) {
+			var maintainer bool
+			maintainer, err = gh.IsMaintainer(ctx, owner, project,
+				author)
+			if err != nil {
+				return
+			}
+			if !maintainer {
+				continue
+			}
+		}
+
+		canonical, found = n, true
+		return
+	}
+	return
+}
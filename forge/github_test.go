@@ -0,0 +1,278 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-github/v29/github"
+)
+
+func TestGitHubClosingPullRequests(t *testing.T) {
+	routes := map[string]interface{}{
+		"/repos/owner/project/issues/1/events": []interface{}{
+			map[string]interface{}{"event": "subscribed"},
+			map[string]interface{}{
+				"event":     "referenced",
+				"commit_id": "notmerged",
+			},
+			map[string]interface{}{
+				"event":     "closed",
+				"commit_id": "merged",
+			},
+			map[string]interface{}{
+				"event":     "referenced",
+				"commit_id": "merged2",
+			},
+			map[string]interface{}{
+				"event":     "referenced",
+				"commit_id": "merged",
+			},
+		},
+		"/repos/owner/project/commits/notmerged/pulls": []interface{}{
+			map[string]interface{}{
+				"number": 2,
+				"body":   "BTC{wrong}",
+			},
+		},
+		"/repos/owner/project/commits/merged/pulls": []interface{}{
+			map[string]interface{}{
+				"number":           3,
+				"body":             "BTC{right}",
+				"merged_at":        "2020-02-06T10:01:43Z",
+				"merge_commit_sha": "merged",
+				"user":             map[string]interface{}{"login": "contributor"},
+			},
+		},
+		"/repos/owner/project/commits/merged2/pulls": []interface{}{
+			map[string]interface{}{
+				"number":    4,
+				"body":      "BTC{second}",
+				"merged_at": "2020-02-07T10:01:43Z",
+				"user":      map[string]interface{}{"login": "other"},
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			v, ok := routes[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(v)
+		}))
+	defer server.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	gh := NewGitHub(client)
+
+	prs, err := gh.ClosingPullRequests(context.Background(),
+		"owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 2 {
+		t.Fatal("invalid pull requests", prs)
+	}
+	if prs[0].Number != 3 || prs[0].Body != "BTC{right}" ||
+		prs[0].Author != "contributor" || prs[0].MergeSHA != "merged" {
+
+		t.Fatal("invalid pull request", prs[0])
+	}
+	if prs[1].Number != 4 || prs[1].Author != "other" {
+		t.Fatal("invalid pull request", prs[1])
+	}
+
+	_, err = gh.ClosingPullRequests(context.Background(),
+		"owner", "project", 2)
+	if err == nil {
+		t.Fatal("no error for unknown issue")
+	}
+}
+
+func TestGitHubPullRequestCommits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/repos/owner/project/pulls/3/commits" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+
+			// the second page is linked from the first one
+			if r.URL.Query().Get("page") != "2" {
+				w.Header().Set("Link", fmt.Sprintf(
+					`<http://%s%s?page=2>; rel="next"`,
+					r.Host, r.URL.Path))
+				fmt.Fprint(w, `[{"commit": {"message": "first"}}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"commit": {"message": "second"}}]`)
+		}))
+	defer server.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	gh := NewGitHub(client)
+
+	messages, err := gh.PullRequestCommits(context.Background(),
+		"owner", "project", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0] != "first" ||
+		messages[1] != "second" {
+
+		t.Fatal("invalid commits", messages)
+	}
+}
+
+func TestGitHubComments(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/repos/owner/project/issues/1/comments" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+
+			// the second page is linked from the first one
+			if r.URL.Query().Get("page") != "2" {
+				w.Header().Set("Link", fmt.Sprintf(
+					`<http://%s%s?page=2>; rel="next"`,
+					r.Host, r.URL.Path))
+				fmt.Fprint(w, `[{"id": 1, "body": "first",
+					"user": {"login": "author"}}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"id": 2, "body": "second"}]`)
+		}))
+	defer server.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	gh := NewGitHub(client)
+
+	comments, err := gh.Comments(context.Background(), "owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].Author != "author" ||
+		comments[1].ID != 2 || comments[1].Body != "second" {
+
+		t.Fatal("invalid comments", comments)
+	}
+}
+
+func TestGitHubIsMaintainer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			permission := "read"
+			if r.URL.Path == "/repos/owner/project/collaborators/"+
+				"maintainer/permission" {
+
+				permission = "write"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"permission": "%s"}`, permission)
+		}))
+	defer server.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	gh := NewGitHub(client)
+
+	for login, expected := range map[string]bool{
+		"maintainer": true,
+		"reader":     false,
+	} {
+		maintainer, err := gh.IsMaintainer(context.Background(),
+			"owner", "project", login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maintainer != expected {
+			t.Fatal(login, maintainer)
+		}
+	}
+}
+
+func TestGitHubDuplicateOf(t *testing.T) {
+	collaborators := "/repos/owner/project/collaborators/"
+	routes := map[string]interface{}{
+		"/repos/owner/project/issues/1/events": []interface{}{
+			map[string]interface{}{
+				"event": "marked_as_duplicate",
+				"actor": map[string]interface{}{"login": "reporter"},
+			},
+		},
+		"/repos/owner/project/issues/1/comments": []interface{}{
+			map[string]interface{}{"id": 1, "body": "Duplicate of #2",
+				"user": map[string]interface{}{"login": "Reporter"}},
+			map[string]interface{}{"id": 2, "body": "Duplicate of #3",
+				"user": map[string]interface{}{"login": "maintainer"}},
+			map[string]interface{}{"id": 3, "body": "Duplicate of #5",
+				"user": map[string]interface{}{"login": "stranger"}},
+			map[string]interface{}{"id": 4, "body": "thanks",
+				"user": map[string]interface{}{"login": "stranger"}},
+		},
+		collaborators + "maintainer/permission": map[string]interface{}{
+			"permission": "write",
+		},
+		collaborators + "stranger/permission": map[string]interface{}{
+			"permission": "read",
+		},
+		"/repos/owner/project/issues/4/events": []interface{}{
+			map[string]interface{}{"event": "marked_as_duplicate"},
+			map[string]interface{}{"event": "unmarked_as_duplicate"},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			v, ok := routes[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "Not Found"}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(v)
+		}))
+	defer server.Close()
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	gh := NewGitHub(client)
+
+	canonical, found, err := gh.DuplicateOf(context.Background(),
+		"owner", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || canonical != 3 {
+		t.Fatal("invalid canonical issue", canonical, found)
+	}
+
+	_, found, err = gh.DuplicateOf(context.Background(),
+		"owner", "project", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("unmarked duplicate is found")
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GitLab forge (gitlab.com or self-hosted)
+type GitLab struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewGitLab forge, baseURL is e.g. https://gitlab.com, token is
+// a personal (or project) access token with the api scope.
+func NewGitLab(baseURL, token string) *GitLab {
+	return &GitLab{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  http.DefaultClient,
+	}
+}
+
+// request to the GitLab API v4, path is relative to the project
+func (gl *GitLab) request(ctx context.Context, method, owner, project,
+	path string, in, out interface{}) (err error) {
+
+	_, err = gl.requestHeader(ctx, method, owner, project, path, in, out)
+	return
+}
+
+// requestHeader is request that also returns the response header
+func (gl *GitLab) requestHeader(ctx context.Context, method, owner,
+	project, path string, in, out interface{}) (
+	respHeader http.Header, err error) {
+
+	id := url.PathEscape(owner + "/" + project)
+	u := fmt.Sprintf("%s/api/v4/projects/%s%s", gl.baseURL, id, path)
+
+	header := make(http.Header)
+	if gl.token != "" {
+		header.Set("PRIVATE-TOKEN", gl.token)
+	}
+	return requestHeader(ctx, gl.client, method, u, header, in, out)
+}
+
+type gitlabUser struct {
+	Username string `json:"username"`
+}
+
+type gitlabIssue struct {
+	IID      int        `json:"iid"`
+	Title    string     `json:"title"`
+	State    string     `json:"state"`
+	ClosedAt *time.Time `json:"closed_at"`
+}
+
+func (i gitlabIssue) issue() (issue Issue) {
+	issue.Number = i.IID
+	issue.Title = i.Title
+	// GitLab issue state is "opened" or "closed"
+	issue.State = Closed
+	if i.State == "opened" {
+		issue.State = Open
+	}
+	issue.ClosedAt = i.ClosedAt
+	return
+}
+
+// Issue by the internal (project) ID
+func (gl *GitLab) Issue(ctx context.Context, owner, project string,
+	number int) (issue Issue, err error) {
+
+	var i gitlabIssue
+	err = gl.request(ctx, "GET", owner, project,
+		fmt.Sprintf("/issues/%d", number), nil, &i)
+	if err != nil {
+		return
+	}
+
+	issue = i.issue()
+	return
+}
+
+// Issues of the project in any state. Merge requests are
+// not issues in GitLab, so they are never returned.
+func (gl *GitLab) Issues(ctx context.Context, owner, project string) (
+	issues []Issue, err error) {
+
+	var is []gitlabIssue
+	err = gl.request(ctx, "GET", owner, project,
+		"/issues?scope=all&per_page=100", nil, &is)
+	if err != nil {
+		return
+	}
+
+	for _, i := range is {
+		issues = append(issues, i.issue())
+	}
+	return
+}
+
+// ClosingPullRequests are merged merge requests that closed
+// the issue
+func (gl *GitLab) ClosingPullRequests(ctx context.Context,
+	owner, project string, number int) (prs []PullRequest, err error) {
+
+	var mrs []struct {
+		IID             int        `json:"iid"`
+		State           string     `json:"state"`
+		Description     string     `json:"description"`
+		Author          gitlabUser `json:"author"`
+		MergeCommitSHA  string     `json:"merge_commit_sha"`
+		SquashCommitSHA string     `json:"squash_commit_sha"`
+	}
+	err = gl.request(ctx, "GET", owner, project,
+		fmt.Sprintf("/issues/%d/closed_by", number), nil, &mrs)
+	if err != nil {
+		return
+	}
+
+	for _, mr := range mrs {
+		if mr.State != "merged" {
+			continue
+		}
+
+		sha := mr.MergeCommitSHA
+		if sha == "" {
+			// fast-forward merge with squash
+			sha = mr.SquashCommitSHA
+		}
+
+		prs = append(prs, PullRequest{
+			Number:   mr.IID,
+			Author:   mr.Author.Username,
+			Body:     mr.Description,
+			MergeSHA: sha,
+		})
+	}
+	return
+}
+
+// Comments (notes) of the issue, system notes are skipped
+func (gl *GitLab) Comments(ctx context.Context, owner, project string,
+	number int) (comments []Comment, err error) {
+
+	return gl.notes(ctx, owner, project,
+		fmt.Sprintf("/issues/%d/notes", number))
+}
+
+// PullRequestComments (notes) of the merge request, system notes
+// are skipped
+func (gl *GitLab) PullRequestComments(ctx context.Context, owner,
+	project string, number int) (comments []Comment, err error) {
+
+	return gl.notes(ctx, owner, project,
+		fmt.Sprintf("/merge_requests/%d/notes", number))
+}
+
+// PullRequestCommits of the merge request
+func (gl *GitLab) PullRequestCommits(ctx context.Context, owner,
+	project string, number int) (messages []string, err error) {
+
+	var commits []struct {
+		Message string `json:"message"`
+	}
+	err = gl.request(ctx, "GET", owner, project,
+		fmt.Sprintf("/merge_requests/%d/commits?per_page=100", number),
+		nil, &commits)
+	if err != nil {
+		return
+	}
+
+	// GitLab lists the newest commit first
+	for i := len(commits) - 1; i >= 0; i-- {
+		messages = append(messages, commits[i].Message)
+	}
+	return
+}
+
+// notes by the path of the noteable, pages are followed by the
+// X-Next-Page header
+func (gl *GitLab) notes(ctx context.Context, owner, project,
+	path string) (comments []Comment, err error) {
+
+	for page := "1"; page != ""; {
+		var notes []struct {
+			ID     int64      `json:"id"`
+			Body   string     `json:"body"`
+			System bool       `json:"system"`
+			Author gitlabUser `json:"author"`
+		}
+		var header http.Header
+		header, err = gl.requestHeader(ctx, "GET", owner, project,
+			path+"?sort=asc&per_page=100&page="+page, nil, &notes)
+		if err != nil {
+			return
+		}
+
+		for _, note := range notes {
+			if note.System {
+				continue
+			}
+			comments = append(comments, Comment{
+				ID:     note.ID,
+				Author: note.Author.Username,
+				Body:   note.Body,
+			})
+		}
+		page = header.Get("X-Next-Page")
+	}
+	return
+}
+
+// CreateComment (note) on the issue
+func (gl *GitLab) CreateComment(ctx context.Context, owner, project string,
+	number int, body string) (err error) {
+
+	note := struct {
+		Body string `json:"body"`
+	}{body}
+	return gl.request(ctx, "POST", owner, project,
+		fmt.Sprintf("/issues/%d/notes", number), note, nil)
+}
+
+// EditComment (note) of the issue
+func (gl *GitLab) EditComment(ctx context.Context, owner, project string,
+	number int, id int64, body string) (err error) {
+
+	note := struct {
+		Body string `json:"body"`
+	}{body}
+	return gl.request(ctx, "PUT", owner, project,
+		fmt.Sprintf("/issues/%d/notes/%d", number, id), note, nil)
+}
+
+// FileExists in the default branch of the repository
+func (gl *GitLab) FileExists(ctx context.Context, owner, project,
+	path string) (exists bool, err error) {
+
+	err = gl.request(ctx, "HEAD", owner, project,
+		"/repository/files/"+url.PathEscape(path)+"?ref=HEAD", nil, nil)
+	if isNotFound(err) {
+		err = nil
+		return
+	}
+	exists = err == nil
+	return
+}
+
+// gitlabMaintainer is the lowest access level that allows to manage
+// the project, developers are able to push to unprotected branches
+// only
+const gitlabMaintainer = 40
+
+// IsMaintainer if the user is a member (including inherited) with
+// the maintainer access level or higher
+func (gl *GitLab) IsMaintainer(ctx context.Context, owner, project,
+	login string) (maintainer bool, err error) {
+
+	var members []struct {
+		Username    string `json:"username"`
+		AccessLevel int    `json:"access_level"`
+	}
+	err = gl.request(ctx, "GET", owner, project,
+		"/members/all?query="+url.QueryEscape(login), nil, &members)
+	if err != nil {
+		return
+	}
+
+	for _, member := range members {
+		if member.Username == login {
+			maintainer = member.AccessLevel >= gitlabMaintainer
+			return
+		}
+	}
+	return
+}
+
+// DuplicateOf is the issue of the last system note "marked this
+// issue as a duplicate of #N" (/duplicate quick action)
+func (gl *GitLab) DuplicateOf(ctx context.Context, owner, project string,
+	number int) (canonical int, found bool, err error) {
+
+	var notes []struct {
+		Body   string `json:"body"`
+		System bool   `json:"system"`
+	}
+	err = gl.request(ctx, "GET", owner, project,
+		fmt.Sprintf("/issues/%d/notes?sort=desc&per_page=100", number),
+		nil, &notes)
+	if err != nil {
+		return
+	}
+
+	for _, note := range notes {
+		if !note.System {
+			continue
+		}
+		canonical, found = duplicateOf(note.Body)
+		if found {
+			return
+		}
+	}
+	return
+}
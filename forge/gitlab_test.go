@@ -0,0 +1,257 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitLab(t *testing.T) {
+	prefix := "/api/v4/projects/group%2Fsubgroup%2Fproject"
+	routes := map[string]interface{}{
+		prefix + "/issues/1": map[string]interface{}{
+			"iid":       1,
+			"title":     "Issue",
+			"state":     "closed",
+			"closed_at": "2020-02-06T10:01:43Z",
+		},
+		prefix + "/issues/1/closed_by": []interface{}{
+			map[string]interface{}{
+				"iid":         2,
+				"state":       "opened",
+				"description": "ETH{wrong}",
+			},
+			map[string]interface{}{
+				"iid":              3,
+				"state":            "merged",
+				"description":      "ETH{right}",
+				"merge_commit_sha": "abc",
+				"author": map[string]interface{}{
+					"username": "contributor",
+				},
+			},
+			map[string]interface{}{
+				"iid":         4,
+				"state":       "merged",
+				"description": "ETH{second}",
+			},
+		},
+		prefix + "/repository/files/ci%2Fdonate.yml": map[string]interface{}{
+			"file_path": "ci/donate.yml",
+		},
+		prefix + "/members/all": []interface{}{
+			map[string]interface{}{
+				"username":     "maintainer",
+				"access_level": 40,
+			},
+			map[string]interface{}{
+				"username":     "developer",
+				"access_level": 30,
+			},
+			map[string]interface{}{
+				"username":     "reporter",
+				"access_level": 20,
+			},
+		},
+		prefix + "/merge_requests/3/commits": []interface{}{
+			map[string]interface{}{"message": "second"},
+			map[string]interface{}{"message": "first"},
+		},
+		prefix + "/merge_requests/3/notes": []interface{}{
+			map[string]interface{}{
+				"id":     20,
+				"body":   "/claim ETH{claimed}",
+				"author": map[string]interface{}{"username": "contributor"},
+			},
+		},
+		prefix + "/issues/1/notes": []interface{}{
+			map[string]interface{}{
+				"id":     10,
+				"body":   "closed via merge request !3",
+				"system": true,
+			},
+			map[string]interface{}{
+				"id":     11,
+				"body":   "thanks",
+				"author": map[string]interface{}{"username": "user"},
+			},
+			map[string]interface{}{
+				"id":     12,
+				"body":   "marked this issue as a duplicate of #5",
+				"system": true,
+			},
+		},
+	}
+
+	// second pages of notes
+	nextPages := map[string]interface{}{
+		prefix + "/merge_requests/3/notes": []interface{}{
+			map[string]interface{}{
+				"id":     21,
+				"body":   "/claim BTC{claimed}",
+				"author": map[string]interface{}{"username": "contributor"},
+			},
+		},
+	}
+
+	var created, edited string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("PRIVATE-TOKEN") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var note struct{ Body string }
+			switch r.Method {
+			case "POST":
+				json.NewDecoder(r.Body).Decode(&note)
+				created = r.URL.EscapedPath() + " " + note.Body
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{}`)
+				return
+			case "PUT":
+				json.NewDecoder(r.Body).Decode(&note)
+				edited = r.URL.EscapedPath() + " " + note.Body
+				fmt.Fprint(w, `{}`)
+				return
+			}
+
+			v, ok := routes[r.URL.EscapedPath()]
+			if next, paged := nextPages[r.URL.EscapedPath()]; paged {
+				if r.URL.Query().Get("page") == "2" {
+					v = next
+				} else {
+					w.Header().Set("X-Next-Page", "2")
+				}
+			}
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"message": "404 Not found"}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(v)
+		}))
+	defer server.Close()
+
+	gl := NewGitLab(server.URL+"/", "token")
+	ctx := context.Background()
+
+	issue, err := gl.Issue(ctx, "group/subgroup", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue.Number != 1 || issue.State != Closed || issue.ClosedAt == nil {
+		t.Fatal("invalid issue", issue)
+	}
+
+	prs, err := gl.ClosingPullRequests(ctx, "group/subgroup",
+		"project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 2 || prs[1].Number != 4 {
+		t.Fatal("invalid merge requests", prs)
+	}
+	if prs[0].Number != 3 || prs[0].Body != "ETH{right}" ||
+		prs[0].Author != "contributor" || prs[0].MergeSHA != "abc" {
+
+		t.Fatal("invalid merge request", prs[0])
+	}
+
+	messages, err := gl.PullRequestCommits(ctx, "group/subgroup",
+		"project", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0] != "first" {
+		t.Fatal("invalid commits", messages)
+	}
+
+	comments, err := gl.Comments(ctx, "group/subgroup", "project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 1 || comments[0].ID != 11 {
+		t.Fatal("invalid comments", comments)
+	}
+
+	canonical, found, err := gl.DuplicateOf(ctx, "group/subgroup",
+		"project", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || canonical != 5 {
+		t.Fatal("invalid canonical issue", canonical, found)
+	}
+
+	comments, err = gl.PullRequestComments(ctx, "group/subgroup",
+		"project", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].ID != 20 ||
+		comments[1].ID != 21 || comments[0].Author != "contributor" {
+
+		t.Fatal("invalid merge request comments", comments)
+	}
+
+	err = gl.CreateComment(ctx, "group/subgroup", "project", 1, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != prefix+"/issues/1/notes new" {
+		t.Fatal("invalid note", created)
+	}
+
+	err = gl.EditComment(ctx, "group/subgroup", "project", 1, 11, "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited != prefix+"/issues/1/notes/11 edit" {
+		t.Fatal("invalid note", edited)
+	}
+
+	_, err = gl.Issue(ctx, "group/subgroup", "project", 2)
+	if err == nil {
+		t.Fatal("no error for unknown issue")
+	}
+
+	for path, expected := range map[string]bool{
+		"ci/donate.yml": true,
+		".donate.yml":   false,
+	} {
+		exists, err := gl.FileExists(ctx, "group/subgroup", "project",
+			path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != expected {
+			t.Fatal(path, exists)
+		}
+	}
+
+	for login, expected := range map[string]bool{
+		"maintainer": true,
+		"developer":  false,
+		"reporter":   false,
+		"nobody":     false,
+	} {
+		maintainer, err := gl.IsMaintainer(ctx, "group/subgroup",
+			"project", login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if maintainer != expected {
+			t.Fatal(login, maintainer)
+		}
+	}
+}
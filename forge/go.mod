@@ -0,0 +1,5 @@
+module code.dumpstack.io/tools/donate/forge
+
+go 1.12
+
+require github.com/google/go-github/v29 v29.0.2
@@ -0,0 +1,84 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package forge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// statusError is returned by request for non-2xx responses
+type statusError struct {
+	method, url string
+	code        int
+	status      string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.method, e.url, e.status)
+}
+
+// isNotFound returns true if the error is 404 Not Found response
+func isNotFound(err error) bool {
+	se, ok := err.(statusError)
+	return ok && se.code == http.StatusNotFound
+}
+
+// request to the JSON REST API, in is encoded to the request body
+// and the response body is decoded to out (if not nil)
+func request(ctx context.Context, client *http.Client, method, u string,
+	header http.Header, in, out interface{}) (err error) {
+
+	_, err = requestHeader(ctx, client, method, u, header, in, out)
+	return
+}
+
+// requestHeader is request that also returns the response header,
+// e.g. for pagination
+func requestHeader(ctx context.Context, client *http.Client, method,
+	u string, header http.Header, in, out interface{}) (
+	respHeader http.Header, err error) {
+
+	var body io.Reader
+	if in != nil {
+		var raw []byte
+		raw, err = json.Marshal(in)
+		if err != nil {
+			return
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = statusError{method, u, resp.StatusCode, resp.Status}
+		return
+	}
+	respHeader = resp.Header
+
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return
+}
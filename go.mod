@@ -2,12 +2,19 @@ module code.dumpstack.io/tools/donate
 
 replace code.dumpstack.io/tools/donate/database => ./database
 
+replace code.dumpstack.io/tools/donate/forge => ./forge
+
 go 1.12
 
 require (
 	code.dumpstack.io/lib/cryptocurrency v1.5.1
 	code.dumpstack.io/tools/donate/database v0.0.0-20200119115012-a4556df0c12e
+	code.dumpstack.io/tools/donate/forge v0.0.0-00010101000000-000000000000
+	github.com/BurntSushi/toml v0.3.1
+	github.com/btcsuite/btcd v0.0.0-20190824003749-130ea5bddde3
+	github.com/btcsuite/btcutil v0.0.0-20190425235716-9e5f4b9a998d
 	github.com/google/go-github/v29 v29.0.2
+	golang.org/x/crypto v0.0.0-20190911031432-227b76d455e7
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
@@ -7,6 +7,14 @@ package main
 import (
 	"errors"
 	"net/url"
+	"strings"
+
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+var (
+	errInvalidRepo       = errors.New("invalid repo")
+	errForgeNotSupported = errors.New("repo hosting is not supported")
 )
 
 func parse(url *url.URL) (repo, issue string, err error) {
@@ -24,3 +32,40 @@ func parse(url *url.URL) (repo, issue string, err error) {
 	}
 	return
 }
+
+// splitRepo splits e.g. gitlab.com/group/subgroup/project to
+// the host, the owner (GitLab group path) and the project
+func splitRepo(repo string) (host, owner, project string, err error) {
+	fields := strings.Split(repo, "/")
+	if len(fields) < 3 {
+		err = errInvalidRepo
+		return
+	}
+	for _, field := range fields {
+		if field == "" {
+			err = errInvalidRepo
+			return
+		}
+	}
+
+	host = fields[0]
+	owner = strings.Join(fields[1:len(fields)-1], "/")
+	project = fields[len(fields)-1]
+	return
+}
+
+// lookupForge of the repo by its host
+func lookupForge(forges map[string]forge.Forge, repo string) (
+	fg forge.Forge, owner, project string, err error) {
+
+	host, owner, project, err := splitRepo(repo)
+	if err != nil {
+		return
+	}
+
+	fg, ok := forges[host]
+	if !ok {
+		err = errForgeNotSupported
+	}
+	return
+}
@@ -9,7 +9,9 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	c "code.dumpstack.io/lib/cryptocurrency"
@@ -18,6 +20,7 @@ import (
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 
 	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
 )
 
 func main() {
@@ -29,57 +32,312 @@ func main() {
 	app.Version("3.2.1")
 
 	databasePath := app.Flag("database", "Path to database").Envar("DONATE_DB_PATH").Required().String()
-	token := app.Flag("token", "GitHub access token").Envar("GITHUB_TOKEN").Required().String()
-	donationAddressBTC := app.Flag("donation-address-btc",
-		"Set the Bitcoin address to which any not acquired donation will be sent").Envar(
-		"DONATION_ADDRESS_BTC").Default(
-		// default donation address is donating to this project
-		"bc1q23fyuq7kmngrgqgp6yq9hk8a5q460f39m8nv87").String()
-	donationAddressETH := app.Flag("donation-address-eth",
-		"Set the Ethereum address to which any not acquired donation will be sent").Envar(
-		"DONATION_ADDRESS_ETH").Default(
-		// default donation address is donating to this project
-		"0xD2237129937E40b32db36Cda0Ae2c82B5ceD2380").String()
-	donationAddressADA := app.Flag("donation-address-ada",
-		"Set the Cardano address to which any not acquired donation will be sent").Envar(
-		"DONATION_ADDRESS_ADA").Default(
-		// default donation address is donating to this project
-		"Ae2tdPwUPEZ68cfEjZjKKRabiqbazMtP69uGaM2pMZRg87fvn4FGvR95BEV").String()
-
-	kingpin.MustParse(app.Parse(os.Args[1:]))
-
-	if len(c.Cryptocurrencies) != 3 {
-		log.Println("lib/cryptocurrency supports new cryptocurrencies")
-		log.Println("please update source code")
-		return
+	masterKey := app.Flag("master-key",
+		"Hex-encoded 256-bit key for encryption of wallet seeds").Envar(
+		"DONATE_MASTER_KEY").String()
+	masterKeyFile := app.Flag("master-key-file",
+		"Path to file with hex-encoded 256-bit key for encryption of wallet seeds").Envar(
+		"DONATE_MASTER_KEY_FILE").String()
+	token := app.Flag("token", "GitHub access token").Envar("GITHUB_TOKEN").String()
+	gitlabURL := app.Flag("gitlab-url",
+		"GitLab instance URL").Envar("DONATE_GITLAB_URL").Default(
+		"https://gitlab.com").String()
+	gitlabToken := app.Flag("gitlab-token",
+		"GitLab access token, GitLab is disabled if not set").Envar(
+		"GITLAB_TOKEN").String()
+	giteaURL := app.Flag("gitea-url",
+		"Gitea (Forgejo) instance URL, Gitea is disabled if not set").Envar(
+		"DONATE_GITEA_URL").String()
+	giteaToken := app.Flag("gitea-token",
+		"Gitea (Forgejo) access token").Envar("GITEA_TOKEN").String()
+	webhookSecret := app.Flag("webhook-secret",
+		"Secret of the GitHub webhook, /webhook is disabled if not set").Envar(
+		"DONATE_WEBHOOK_SECRET").String()
+	adminToken := app.Flag("admin-token",
+		"Token for /pay of any repository").Envar(
+		"DONATE_ADMIN_TOKEN").String()
+	repoTokens := app.Flag("repo-token",
+		"Token for /pay of the repository, e.g. github.com/owner/project=TOKEN").Envar(
+		"DONATE_REPO_TOKENS").StringMap()
+	insecurePay := app.Flag("insecure-pay",
+		"Allow /pay without authentication if no tokens are set").Envar(
+		"DONATE_INSECURE_PAY").Default("false").Bool()
+	approval := app.Flag("approval",
+		"Do not send payouts until they are approved by the maintainer").Envar(
+		"DONATE_APPROVAL").Default("false").Bool()
+	strictClaims := app.Flag("strict-claims",
+		"Pay only claims that are signed by keys of addresses").Envar(
+		"DONATE_STRICT_CLAIMS").Default("false").Bool()
+	githubClientID := app.Flag("github-client-id",
+		"Client ID of the GitHub OAuth app, the address registry "+
+			"is disabled if not set").Envar(
+		"DONATE_GITHUB_CLIENT_ID").String()
+	githubClientSecret := app.Flag("github-client-secret",
+		"Client secret of the GitHub OAuth app").Envar(
+		"DONATE_GITHUB_CLIENT_SECRET").String()
+	retryInterval := app.Flag("retry-interval",
+		"Interval of checking for failed and deferred payouts").Envar(
+		"DONATE_RETRY_INTERVAL").Default("1m").Duration()
+	chainBackend := app.Flag("chain",
+		"Chain backend for confirmation tracking of payouts").Envar(
+		"DONATE_CHAIN").Default("blockchair").Enum("blockchair", "none")
+	blockchairKey := app.Flag("blockchair-key",
+		"Blockchair API key").Envar("DONATE_BLOCKCHAIR_KEY").String()
+	confirmInterval := app.Flag("confirm-interval",
+		"Interval of checking for confirmations of payouts").Envar(
+		"DONATE_CONFIRM_INTERVAL").Default("10m").Duration()
+	fee := app.Flag("fee",
+		"Fee in percents of payouts that is sent to the donation "+
+			"address").Envar("DONATE_FEE").Default("0").Float64()
+	configPath := app.Flag("config",
+		"Path to config file (TOML), reloaded on SIGHUP").Envar(
+		"DONATE_CONFIG").String()
+	listen := app.Flag("listen",
+		"Listen address of the HTTP server").Envar(
+		"DONATE_LISTEN").Default(":8080").String()
+	migrateOnly := app.Flag("migrate-only",
+		"Apply database migrations and exit").Default("false").Bool()
+
+	var wallets Wallets = libWallets{}
+
+	donationAddresses := make(map[c.Cryptocurrency]*string)
+	for _, cc := range wallets.Currencies() {
+		symbol := strings.ToUpper(cc.Symbol())
+		flag := app.Flag("donation-address-"+cc.Symbol(),
+			"Set the "+symbol+" address to which any not acquired "+
+				"donation will be sent").Envar("DONATION_ADDRESS_" + symbol)
+		if address, ok := defaultDonationAddresses[cc]; ok {
+			flag = flag.Default(address)
+		} else {
+			flag = flag.Required()
+		}
+		donationAddresses[cc] = flag.String()
 	}
 
-	defaultDests := map[c.Cryptocurrency]string{
-		c.Bitcoin:  *donationAddressBTC,
-		c.Ethereum: *donationAddressETH,
-		c.Cardano:  *donationAddressADA,
+	app.Command("serve", "Run the donation daemon").Default()
+	app.Command("pending", "List payouts waiting for approval")
+	approveIDs := app.Command("approve",
+		"Approve and send pending payouts").Arg("id",
+		"ID of the payout").Required().Int64List()
+	rejectIDs := app.Command("reject",
+		"Reject pending payouts").Arg("id",
+		"ID of the payout").Required().Int64List()
+	resendIDs := app.Command("resend",
+		"Send dropped payouts again").Arg("id",
+		"ID of the payout").Required().Int64List()
+	resetIssues := app.Command("reset",
+		"Release payouts that were interrupted in progress").Arg("issue",
+		"Issue, e.g. github.com/owner/project#1").Required().Strings()
+	repo := app.Command("repo", "Manage registered repositories")
+	repo.Command("list", "List registered repositories")
+	addRepos := repo.Command("add",
+		"Register repositories").Arg("repo",
+		"Repository, e.g. github.com/owner/project").Required().Strings()
+	removeRepos := repo.Command("remove",
+		"Remove registration of repositories").Arg("repo",
+		"Repository, e.g. github.com/owner/project").Required().Strings()
+
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	// flags are the defaults of the config file
+	flagsConfig := config{
+		Listen: *listen,
+		defaults: settings{
+			Currencies:   wallets.Currencies(),
+			DefaultDests: make(map[c.Cryptocurrency]string),
+			Approval:     *approval,
+			Fee:          *fee,
+			StrictClaims: *strictClaims,
+		},
+	}
+	for cc, address := range donationAddresses {
+		flagsConfig.defaults.DefaultDests[cc] = *address
 	}
 
-	db, err := database.Open(*databasePath)
+	err := checkFee(*fee, wallets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	live := &liveConfig{cfg: &flagsConfig}
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath, flagsConfig, wallets)
+		if err != nil {
+			log.Fatal(err)
+		}
+		live.set(cfg)
+		go reloadOnSIGHUP(live, *configPath, flagsConfig, wallets)
+	}
+
+	var key []byte
+	if *masterKeyFile != "" {
+		key, err = database.ReadKey(*masterKeyFile)
+	} else {
+		key, err = database.ParseKey(*masterKey)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	db, err := database.Open(*databasePath, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *migrateOnly {
+		version, err := database.Version(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("database schema version", version)
+		return
+	}
+
+	switch command {
+	case "pending", "approve", "reject":
+		ids := *approveIDs
+		if command == "reject" {
+			ids = *rejectIDs
+		}
+		err = approvalCommand(db, wallets, command, ids)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "resend":
+		err = resendCommand(db, *resendIDs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "reset":
+		err = resetCommand(db, *resetIssues)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "repo list", "repo add", "repo remove":
+		repos := *addRepos
+		if command == "repo remove" {
+			repos = *removeRepos
+		}
+		err = repoCommand(db, command, repos)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	ctx := context.Background()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: *token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
 
-	client := github.NewClient(tc)
+	// forges by host of the repo
+	forges := make(map[string]forge.Forge)
+
+	if *token != "" {
+		ts := oauth2.StaticTokenSource(
+			&oauth2.Token{AccessToken: *token},
+		)
+		tc := oauth2.NewClient(ctx, ts)
+
+		forges["github.com"] = forge.NewGitHub(github.NewClient(tc))
+	}
+
+	if *gitlabToken != "" {
+		u, err := url.Parse(*gitlabURL)
+		if err != nil || u.Host == "" {
+			log.Fatal("invalid --gitlab-url ", *gitlabURL)
+		}
+		forges[u.Host] = forge.NewGitLab(*gitlabURL, *gitlabToken)
+	}
+
+	if *giteaURL != "" {
+		u, err := url.Parse(*giteaURL)
+		if err != nil || u.Host == "" {
+			log.Fatal("invalid --gitea-url ", *giteaURL)
+		}
+		forges[u.Host] = forge.NewGitea(*giteaURL, *giteaToken)
+	}
+
+	if len(forges) == 0 {
+		log.Fatal("required flag --token, --gitlab-token " +
+			"or --gitea-url not provided")
+	}
 
 	http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
-		queryHandler(db, client, ctx, w, r)
+		queryHandler(db, wallets, forges, ctx, w, r, live.get())
 	})
 
-	http.HandleFunc("/pay", func(w http.ResponseWriter, r *http.Request) {
-		payHandler(db, client, ctx, w, r, defaultDests)
+	http.HandleFunc("/transactions", func(w http.ResponseWriter, r *http.Request) {
+		transactionsHandler(db, w, r)
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	creds := credentials{admin: *adminToken, repos: *repoTokens,
+		insecure: *insecurePay}
+	if creds.empty() && creds.insecure {
+		log.Println("warning: no --admin-token or --repo-token, " +
+			"/pay is not authenticated")
+	} else if creds.empty() {
+		log.Println("warning: no --admin-token or --repo-token, " +
+			"/pay rejects all requests (see --insecure-pay)")
+	}
+
+	http.HandleFunc("/pay", requireAuth(creds,
+		func(w http.ResponseWriter, r *http.Request) {
+			payHandler(db, wallets, forges, ctx, w, r, live.get())
+		}))
+
+	// Approval is never insecure, maintainers of the repo approve
+	// payouts of the repo with its token
+	approvers := credentials{admin: *adminToken, repos: *repoTokens}
+	http.HandleFunc("/pending", requireAuth(approvers,
+		func(w http.ResponseWriter, r *http.Request) {
+			pendingHandler(db, w, r)
+		}))
+	http.HandleFunc("/approve", func(w http.ResponseWriter, r *http.Request) {
+		approveHandler(db, wallets, approvers, w, r, false)
+	})
+	http.HandleFunc("/reject", func(w http.ResponseWriter, r *http.Request) {
+		approveHandler(db, wallets, approvers, w, r, true)
+	})
+
+	if *adminToken != "" {
+		admin := credentials{admin: *adminToken}
+		http.HandleFunc("/payouts", requireAuth(admin,
+			func(w http.ResponseWriter, r *http.Request) {
+				payoutsHandler(db, w, r)
+			}))
+	}
+
+	if fg, ok := forges["github.com"]; ok && *webhookSecret != "" {
+		secret := []byte(*webhookSecret)
+		http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+			webhookHandler(db, wallets, fg, ctx, w, r, secret,
+				live.get())
+		})
+	}
+
+	if *githubClientID != "" && *githubClientSecret != "" {
+		rg, err := newRegistry(*githubClientID, *githubClientSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+			loginHandler(rg, w, r)
+		})
+		http.HandleFunc("/oauth/callback", func(w http.ResponseWriter, r *http.Request) {
+			callbackHandler(rg, ctx, w, r)
+		})
+		http.HandleFunc("/addresses", func(w http.ResponseWriter, r *http.Request) {
+			addressesHandler(db, wallets, rg, w, r)
+		})
+	}
+
+	go retryWorker(db, wallets, forges, ctx, live, *retryInterval)
+
+	if *chainBackend == "blockchair" {
+		go confirmWorker(db, newBlockchair(*blockchairKey),
+			*confirmInterval)
+	}
+
+	log.Fatal(http.ListenAndServe(live.get().Listen, nil))
 }
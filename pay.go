@@ -6,173 +6,795 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	c "code.dumpstack.io/lib/cryptocurrency"
-	"github.com/google/go-github/v29/github"
 
 	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
 )
 
-func lookupPR(gh *github.Client, ctx context.Context,
-	owner, project, commit string) (body string, found bool, err error) {
+func findAddress(body, symbol string) (address string) {
+	re := regexp.MustCompile(strings.ToUpper(symbol) + "{([a-zA-Z0-9]*)}")
+	match := re.FindStringSubmatch(body)
+	if len(match) >= 2 {
+		address = match[1]
+	}
+	return
+}
 
-	pullRequests, _, err := gh.PullRequests.ListPullRequestsWithCommit(
-		ctx, owner, project, commit, nil)
-	if err != nil {
-		return
+// maxWeight of the share, larger weights are capped
+const maxWeight = 10
+
+// findWeight of the share in the format WEIGHT{2}, default is 1
+func findWeight(text string) (weight float64) {
+	weight = 1
+	re := regexp.MustCompile(`WEIGHT{([0-9]+(?:\.[0-9]+)?)}`)
+	match := re.FindStringSubmatch(text)
+	if len(match) >= 2 {
+		w, err := strconv.ParseFloat(match[1], 64)
+		if err == nil && w > 0 {
+			weight = math.Min(w, maxWeight)
+		}
 	}
+	return
+}
 
-	for _, pr := range pullRequests {
-		if pr.MergedAt == nil {
+// coAuthorRe matches Co-authored-by trailers, addresses of the
+// co-author are on the same line
+var coAuthorRe = regexp.MustCompile(`(?im)^co-authored-by:.*$`)
+
+// coAuthorEmailRe matches the email of the co-author in the trailer
+var coAuthorEmailRe = regexp.MustCompile(`<[^>]*>`)
+
+// findContributor with addresses of the text, registered addresses
+// are used for currencies that are not in the text
+func findContributor(currencies []c.Cryptocurrency, text string,
+	registered map[c.Cryptocurrency]string) (ctr database.Contributor,
+	found bool) {
+
+	ctr = database.Contributor{
+		Addresses:  make(map[c.Cryptocurrency]string),
+		Signatures: make(map[c.Cryptocurrency]string),
+		Registered: make(map[c.Cryptocurrency]bool),
+		Weight:     findWeight(text),
+	}
+	for _, cc := range currencies {
+		address := findAddress(text, cc.Symbol())
+		if address == "" && registered[cc] != "" {
+			ctr.Addresses[cc] = registered[cc]
+			ctr.Registered[cc] = true
 			continue
 		}
+		if address == "" {
+			continue
+		}
+		ctr.Addresses[cc] = address
+		signature := findSignature(text, cc.Symbol())
+		if signature != "" {
+			ctr.Signatures[cc] = signature
+		}
+	}
+	found = len(ctr.Addresses) != 0
+	return
+}
+
+// findContributors of the pull request that have addresses: the
+// author with addresses of the body (registered addresses are used
+// for currencies that are not in the body) and co-authors of
+// Co-authored-by trailers of merged commits, in order of appearance.
+// Trailers of the body are ignored. Weights are normalized, so every
+// pull request has the same total weight.
+func findContributors(currencies []c.Cryptocurrency, pr forge.PullRequest,
+	commits []string, registered map[c.Cryptocurrency]string) (
+	contributors []database.Contributor) {
+
+	var total float64
+	add := func(text string, fallback map[c.Cryptocurrency]string) {
+		ctr, found := findContributor(currencies, text, fallback)
+		if found {
+			contributors = append(contributors, ctr)
+			total += ctr.Weight
+		}
+	}
 
+	add(coAuthorRe.ReplaceAllString(pr.Body, ""), registered)
+
+	// the same co-author is usually in several commits
+	seen := make(map[string]bool)
+	for _, message := range commits {
+		for _, line := range coAuthorRe.FindAllString(message, -1) {
+			key := strings.ToLower(coAuthorEmailRe.FindString(line))
+			if key == "" {
+				key = line
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			add(line, nil)
+		}
+	}
+
+	for i := range contributors {
+		contributors[i].Weight /= total
+	}
+	return
+}
+
+// verifiedContributors are contributors with addresses which claims
+// are signed (or registered by the author), rejected are currencies
+// of dropped addresses
+func verifiedContributors(issue database.Issue,
+	contributors []database.Contributor) (
+	verified []database.Contributor,
+	rejected map[c.Cryptocurrency]bool) {
+
+	rejected = make(map[c.Cryptocurrency]bool)
+
+	for _, ctr := range contributors {
+		v := database.Contributor{
+			Addresses:  make(map[c.Cryptocurrency]string),
+			Signatures: ctr.Signatures,
+			Registered: ctr.Registered,
+			Weight:     ctr.Weight,
+		}
+		for cc, address := range ctr.Addresses {
+			if ctr.Registered[cc] {
+				// the author is logged in to register it
+				v.Addresses[cc] = address
+				continue
+			}
+			message := claimMessage(issue.Repo, issue.ID, address)
+			if !verifyClaim(cc, address, message,
+				ctr.Signatures[cc]) {
+
+				log.Printf("%s#%d: claim of %s is not verified",
+					issue.Repo, issue.ID, address)
+				rejected[cc] = true
+				continue
+			}
+			v.Addresses[cc] = address
+		}
+		if len(v.Addresses) != 0 {
+			verified = append(verified, v)
+		}
+	}
+	return
+}
+
+// contributorShares of the currency, shares of the same address are
+// merged. Found is false if no one has an address of the currency,
+// invalid addresses are skipped.
+func contributorShares(wallets Wallets, cc c.Cryptocurrency, source string,
+	contributors []database.Contributor) (shares []database.Share,
+	found bool, err error) {
+
+	index := make(map[string]int)
+	for _, ctr := range contributors {
+		address, ok := ctr.Addresses[cc]
+		if !ok {
+			continue
+		}
 		found = true
-		body = *pr.Body
-		break
+
+		var valid bool
+		valid, err = wallets.Validate(cc, address)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", address, err)
+			return
+		}
+		if !valid {
+			continue
+		}
+
+		if address == source {
+			log.Println("destination address is the same")
+			continue
+		}
+
+		if i, ok := index[address]; ok {
+			shares[i].Weight += ctr.Weight
+			continue
+		}
+		index[address] = len(shares)
+		shares = append(shares, database.Share{
+			Destination: address,
+			Weight:      ctr.Weight,
+		})
 	}
 	return
 }
 
-func findAddress(body, symbol string) (address string) {
-	re := regexp.MustCompile(strings.ToUpper(symbol) + "{([a-zA-Z0-9]*)}")
-	match := re.FindStringSubmatch(body)
-	if len(match) >= 2 {
-		address = match[1]
+// issueCurrencies of the issue wallets, in order of the backend
+func issueCurrencies(wallets Wallets, issue database.Issue) (
+	currencies []c.Cryptocurrency) {
+
+	for _, cc := range wallets.Currencies() {
+		// Older versions stored empty wallets of currencies
+		// that are not generated for the repo
+		if wallet, ok := issue.Wallets[cc]; ok && wallet.Address != "" {
+			currencies = append(currencies, cc)
+		}
 	}
 	return
 }
 
-type userWallet struct {
+// payoutLocks serialize payouts of the same issue inside the daemon,
+// locks are removed when nobody holds or waits for them
+var payoutLocks = struct {
+	sync.Mutex
+	issues map[string]*issueLock
+}{issues: make(map[string]*issueLock)}
+
+type issueLock struct {
+	sync.Mutex
+	users int
+}
+
+func lockPayout(issue database.Issue) (unlock func()) {
+	key := fmt.Sprintf("%s#%d", issue.Repo, issue.ID)
+
+	payoutLocks.Lock()
+	lock, ok := payoutLocks.issues[key]
+	if !ok {
+		lock = &issueLock{}
+		payoutLocks.issues[key] = lock
+	}
+	lock.users++
+	payoutLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		payoutLocks.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(payoutLocks.issues, key)
+		}
+		payoutLocks.Unlock()
+	}
+}
+
+// resetCommand releases payouts of issues (in the format
+// host/owner/project#number) that were interrupted in progress
+func resetCommand(db *database.DB, issues []string) (err error) {
+	for _, s := range issues {
+		parts := strings.SplitN(s, "#", 2)
+		if len(parts) != 2 {
+			err = fmt.Errorf("invalid issue %s", s)
+			return
+		}
+
+		issue := database.NewIssue()
+		issue.Repo = parts[0]
+		issue.ID, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return
+		}
+
+		var reset bool
+		reset, err = database.ResetPayout(db, issue)
+		if err != nil {
+			return
+		}
+		if !reset {
+			fmt.Println(s, "payout is not in progress")
+			continue
+		}
+		fmt.Println(s, "payout is reset")
+	}
+	return
+}
+
+// plan of the payout that is returned for dry run
+type payoutPlan struct {
+	// State of the payout, nothing will be sent if it's not idle
+	State database.PayoutState
+	// Transfers that would be sent (or planned for approval)
+	Transfers []transfer
+}
+
+// transfer of all funds of the issue wallet
+type transfer struct {
 	// Type is Bitcoin/Ethereum/etc.
 	Type c.Cryptocurrency
-	// Found address in pull request body or not
-	Found bool
-	// Tx represents transaction
-	Tx string
+	// Source is the address of the issue wallet
+	Source string
+	// Destination address
+	Destination string
+	// Reason of the destination choice
+	Reason database.PayoutReason
+	// Fee in percents that is sent to FeeDestination
+	Fee float64
+	// FeeDestination is the donation address of the project
+	FeeDestination string
+	// Shares of contributors if there are several of them
+	Shares []database.Share
+	// Target issue of the rollover
+	Target int
+	// Hold is the reason why the transfer waits for approval even
+	// if approval is not required
+	Hold string
+}
 
-	database.Wallet
+// payout to be recorded to the ledger
+func (t transfer) payout() database.Payout {
+	return database.Payout{
+		Type:           t.Type,
+		Source:         t.Source,
+		Destination:    t.Destination,
+		Reason:         t.Reason,
+		Fee:            t.Fee,
+		FeeDestination: t.FeeDestination,
+		Shares:         t.Shares,
+		Target:         t.Target,
+		Hold:           t.Hold,
+	}
 }
 
-func findWallets(body string) (wallets []userWallet) {
-	for _, cc := range c.Cryptocurrencies {
-		wallet := userWallet{Type: cc, Found: false}
+// send all funds of the issue wallet to the destination and record
+// the result to the payouts ledger
+func send(db *database.DB, wallets Wallets, issue database.Issue,
+	t transfer) (tx string) {
 
-		address := findAddress(body, cc.Symbol())
-		if address != "" {
-			wallet.Found = true
-			wallet.Address = address
+	payout := t.payout()
+	payout.Attempts = 1
+
+	// Note that we're getting seed from the issue' wallet
+	seed := issue.Wallets[t.Type].Seed
+	tx, err := sendPayout(wallets, payout, seed)
+	if err != nil {
+		log.Println("sendall error", err)
+		payout.Status = database.PayoutFailed
+		payout.Error = err.Error()
+		// will be retried by retryWorker
+		payout.NextAttempt = nextAttempt(time.Now(), 1, err)
+		if payout.NextAttempt.IsZero() {
+			payout.Status = database.PayoutAbandoned
 		}
+	} else {
+		payout.Status = database.PayoutSent
+		payout.Tx = tx
+	}
 
-		wallets = append(wallets, wallet)
+	err = database.AddPayout(db, issue, payout)
+	if err != nil {
+		log.Println("payout is not recorded", err)
 	}
 	return
 }
 
-func payHandler(db *sql.DB, gh *github.Client, ctx context.Context,
-	w http.ResponseWriter, r *http.Request,
-	defaultDests map[c.Cryptocurrency]string) (err error) {
+// plan the transfer, it is recorded as pending and waits for
+// approval of the maintainer
+func plan(db *database.DB, issue database.Issue, t transfer) (err error) {
+	payout := t.payout()
+	payout.Status = database.PayoutPending
+	return database.AddPayout(db, issue, payout)
+}
+
+// recordedTransactions in the same format as payHandler returns
+func recordedTransactions(payouts []database.Payout) (
+	transactions map[c.Cryptocurrency]string) {
+
+	transactions = make(map[c.Cryptocurrency]string)
+	for _, payout := range payouts {
+		// Transactions to the default destination are not
+		// shown, see payHandler
+		if payout.Reason != database.ReasonContributor {
+			continue
+		}
+		transactions[payout.Type] = payout.Tx
+	}
+	return
+}
+
+// transaction of the payout to the contributor (or of the rollover)
+// as it's shown by transactionsHandler
+type transaction struct {
+	// Type is Bitcoin/Ethereum/etc.
+	Type c.Cryptocurrency
+	// Tx is the transaction ID
+	Tx string
+	// Status is sent (broadcasted), confirmed or dropped
+	Status database.PayoutStatus
+	// Confirmations of the transaction at the last check
+	Confirmations int
+	// Fee in percents that is sent to the project
+	Fee float64
+	// FeeTx is the transaction ID of the fee, empty if the fee
+	// is sent in Tx
+	FeeTx string
+	// To is the target issue of the rollover from this issue
+	To int
+	// From is the source issue of the rollover to this issue
+	From int
+}
+
+// feeTx of the payout if the fee is sent in a separate transaction,
+// older payouts record the same transaction as the fee one
+func feeTx(payout database.Payout) string {
+	if payout.FeeTx == payout.Tx {
+		return ""
+	}
+	return payout.FeeTx
+}
+
+// transactionsHandler shows transactions of the issue payout to the
+// contributor and rollovers from/to the issue with their
+// confirmation status
+func transactionsHandler(db *database.DB, w http.ResponseWriter,
+	r *http.Request) {
 
 	issue := database.NewIssue()
-	var issueS string
-	issue.Repo, issueS, err = parse(r.URL)
+	repo, issueS, err := parse(r.URL)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	issue.Repo = repo
 
 	issue.ID, err = strconv.Atoi(issueS)
 	if err != nil {
-		log.Println(err)
+		fmt.Fprint(w, "invalid issue\n")
 		return
 	}
 
-	fields := strings.Split(issue.Repo, "/")
-	if len(fields) != 3 {
-		fmt.Fprint(w, "invalid repo\n")
+	payouts, err := database.Payouts(db, issue)
+	if err != nil {
+		fmt.Fprint(w, "repo/issue not found in database\n")
 		return
 	}
-	// fields[0] is 'github.com'
-	owner := fields[1]
-	project := fields[2]
 
-	err = database.GetWallets(db, &issue, database.ShowSeed)
+	transactions := []transaction{}
+	for _, payout := range payouts {
+		// see recordedTransactions
+		if payout.Reason == database.ReasonDefault ||
+			payout.Tx == "" {
+
+			continue
+		}
+		transactions = append(transactions, transaction{
+			Type:          payout.Type,
+			Tx:            payout.Tx,
+			Status:        payout.Status,
+			Confirmations: payout.Confirmations,
+			Fee:           payout.Fee,
+			FeeTx:         feeTx(payout),
+			To:            payout.Target,
+		})
+	}
+
+	incoming, err := database.IncomingRollovers(db, issue)
 	if err != nil {
 		log.Println(err)
-		fmt.Fprint(w, "repo/issue not found in database\n")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	for _, payout := range incoming {
+		if payout.Tx == "" {
+			continue
+		}
+		transactions = append(transactions, transaction{
+			Type:          payout.Type,
+			Tx:            payout.Tx,
+			Status:        payout.Status,
+			Confirmations: payout.Confirmations,
+			From:          payout.Issue,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transactions)
+}
+
+// Errors of payout that are reported to the caller as is
+var (
+	errInvalidIssue     = errors.New("invalid repo/issue")
+	errIssueOpen        = errors.New("issue is still open")
+	errPayoutInProgress = errors.New("payout is in progress")
+	errPayoutPending    = errors.New("payout is waiting for approval")
+	errInvalidRollover  = errors.New("invalid rollover target")
+	errClaimMissing     = errors.New("no claim of the designated user")
+	errClaimWindow      = errors.New("waiting for claims")
+)
+
+// claimWindow after the issue is closed, the payout waits for claim
+// comments of currencies without addresses. It's shorter than the day
+// donate-ci triggers payouts of closed issues for.
+const claimWindow = 6 * time.Hour
+
+// claimedAll is true if contributors have addresses of all currencies
+func claimedAll(currencies []c.Cryptocurrency,
+	contributors []database.Contributor) bool {
+
+	for _, cc := range currencies {
+		found := false
+		for _, ctr := range contributors {
+			if ctr.Addresses[cc] != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// errClaimNotVerified is the hold reason of payouts to unverified
+// claims in strict claim mode
+var errClaimNotVerified = errors.New("claim is not verified")
+
+// planTransfers of the closed issue to authors of the merged pull
+// requests (or to the rollover target, or to the default
+// destinations). Funds are split between contributors by weights,
+// the fee of the repo settings is split to the default destination.
+// The payout waits for claim comments for claimWindow after the issue
+// is closed. If the wallets backend can't split funds, payouts to
+// several contributors are refused with errSplitRequired. In strict
+// claim mode unverified claims are treated as absent, the transfer to
+// them is held if there is no rollover target. With approval they are
+// planned as usual and flagged. In dry run the rollover target is not
+// created. Wallets of the issue should be filled.
+func planTransfers(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, owner, project string, issue database.Issue,
+	cfg *config, dryRun bool) (transfers []transfer, err error) {
+
+	s := cfg.repo(issue.Repo)
 
 	// 1. Check that issue is closed
-	ghIssue, _, err := gh.Issues.Get(ctx, owner, project, issue.ID)
+	fgIssue, err := fg.Issue(ctx, owner, project, issue.ID)
 	if err != nil {
 		log.Println(err)
-		fmt.Fprint(w, "invalid repo/issue\n")
+		err = errInvalidIssue
 		return
 	}
-	if *ghIssue.State == "open" {
-		fmt.Fprint(w, "issue is still open\n")
+	if fgIssue.State == forge.Open {
+		err = errIssueOpen
 		return
 	}
 
-	// 2. Lookup for pull request that was close this issue
-	events, _, err := gh.Issues.ListIssueEvents(ctx, owner, project, issue.ID, nil)
+	// 2. Lookup for pull requests that were close this issue
+	prs, err := fg.ClosingPullRequests(ctx, owner, project, issue.ID)
 	if err != nil {
-		log.Println(err)
-		fmt.Fprint(w, "{}")
 		return
 	}
 
-	var wallets []userWallet
-	for _, event := range events {
-		if event.CommitID != nil {
-			commit := *event.CommitID
+	currencies := issueCurrencies(wallets, issue)
 
-			// 3. Check that there's pull request
-			var body string
-			var found bool
-			body, found, err = lookupPR(gh, ctx, owner, project, commit)
+	// Addresses are taken from snapshots made at merge and from
+	// claim comments
+	contributors, redirected, err := claimedContributors(db, fg, ctx,
+		owner, project, issue, currencies, prs)
+	if err != nil {
+		return
+	}
+
+	// 3. Claims must be signed by keys of addresses
+	claimed := contributors
+	var rejected map[c.Cryptocurrency]bool
+	if s.StrictClaims {
+		var verified []database.Contributor
+		verified, rejected = verifiedContributors(issue, contributors)
+		if !s.Approval {
+			contributors = verified
+		}
+	}
+
+	// 4. Claim comments can come after the merge, so the payout
+	// waits for them if some currencies have no addresses and is
+	// run by retryWorker when the claim window is over
+	if len(prs) != 0 && !redirected && fgIssue.ClosedAt != nil &&
+		time.Since(*fgIssue.ClosedAt) < claimWindow &&
+		!claimedAll(currencies, contributors) {
+
+		if !dryRun {
+			err = database.DeferPayout(db, issue,
+				fgIssue.ClosedAt.Add(claimWindow))
 			if err != nil {
 				return
 			}
+		}
+		err = errClaimWindow
+		return
+	}
+
+	// 5. Funds stay in the project if nothing is merged (or
+	// claimed) and the payout is not redirected by the maintainer
+	var rollover database.Issue
+	if (len(prs) == 0 && !redirected) ||
+		(len(rejected) != 0 && !s.Approval) {
+
+		rollover, err = rolloverIssue(db, wallets, fg, ctx, owner,
+			project, issue, cfg, dryRun)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, cc := range currencies {
+		t := transfer{
+			Type:   cc,
+			Source: issue.Wallets[cc].Address,
+		}
+
+		shares, found, err := contributorShares(wallets, cc, t.Source,
+			contributors)
+		if err != nil {
+			// Error here does not mean that address is invalid
+			// Do not send to anyone in this case
+			log.Println("validate error", err)
+			continue
+		}
+
+		// The wallet of the target is created at payout in dry run
+		if wallet, ok := rollover.Wallets[cc]; !found && ok &&
+			(wallet.Address != "" || dryRun) {
+
+			t.Destination = wallet.Address
+			t.Reason = database.ReasonRollover
+			t.Target = rollover.ID
+			transfers = append(transfers, t)
+			continue
+		}
+
+		// The maintainer decides on unverified claims
+		hold := ""
+		if rejected[cc] && (s.Approval || !found) {
 			if !found {
-				continue
+				shares, found, err = contributorShares(wallets,
+					cc, t.Source, claimed)
+				if err != nil {
+					log.Println("validate error", err)
+					continue
+				}
 			}
+			hold = errClaimNotVerified.Error()
+		}
 
-			// Looking for all cryptocurrency wallets
-			wallets = findWallets(body)
-			break
+		if !found {
+			// b. If no address then send to the donation address
+			t.Destination = s.DefaultDests[cc]
+			t.Reason = database.ReasonDefault
+			transfers = append(transfers, t)
+			continue
+		}
+
+		if len(shares) == 0 {
+			// All addresses are invalid
+			continue
+		}
+
+		t.Destination = shares[0].Destination
+		t.Reason = database.ReasonContributor
+		if len(shares) > 1 {
+			t.Shares = shares
+		}
+		if feeDest := s.DefaultDests[cc]; s.Fee != 0 &&
+			feeDest != "" && feeDest != t.Destination {
+
+			t.Fee = s.Fee
+			t.FeeDestination = feeDest
+		}
+		if !canSend(wallets, t.payout()) {
+			return nil, errSplitRequired
 		}
+		t.Hold = hold
+		transfers = append(transfers, t)
 	}
+	return
+}
+
+// payout of the closed issue to the pull request author (or to the
+// default destinations). Returns transactions that are sent to the
+// contributor, sent is false if they were recorded by the previous
+// payout. With approval (or for held transfers) transfers are only
+// planned and errPayoutPending is returned until all of them are
+// approved or rejected. Wallets of the issue should be filled with
+// seeds.
+func payout(db *database.DB, wallets Wallets, fg forge.Forge, ctx context.Context,
+	owner, project string, issue database.Issue, cfg *config) (
+	transactions map[c.Cryptocurrency]string, sent bool, err error) {
 
-	// No pull request was found, create dummy wallets
-	if len(wallets) == 0 {
-		for _, cc := range c.Cryptocurrencies {
-			wallet := userWallet{Type: cc, Found: false}
-			wallets = append(wallets, wallet)
+	// Payouts of the same issue are serialized, so the second
+	// caller waits for the first one and gets its result
+	unlock := lockPayout(issue)
+	defer unlock()
+
+	claimed, state, err := database.ClaimPayout(db, issue)
+	if err != nil {
+		return
+	}
+	if !claimed {
+		if state == database.PayoutInProgress {
+			// Claimed, but never finished, e.g. the daemon
+			// was stopped in the middle of payout. The
+			// operator checks the recorded transactions
+			// and releases it with the reset command.
+			err = errPayoutInProgress
+			return
 		}
+
+		// Do not pay twice, return recorded transactions instead
+		var payouts []database.Payout
+		payouts, err = database.Payouts(db, issue)
+		if err != nil {
+			return
+		}
+		for _, p := range payouts {
+			if p.Status == database.PayoutPending ||
+				p.Status == database.PayoutApproved {
+
+				err = errPayoutPending
+				return
+			}
+		}
+		transactions = recordedTransactions(payouts)
+		return
 	}
 
-	transactions := make(map[c.Cryptocurrency]string)
-	for _, wallet := range wallets {
-		if !wallet.Found {
-			// b. If no address then send to the donation address
-			address := defaultDests[wallet.Type]
-			// Note that we're getting seed from the issue' wallet
-			seed := issue.Wallets[wallet.Type].Seed
-			tx, err := wallet.Type.SendAll(seed, address)
+	// Release the claim if nothing was sent (or planned)
+	planned := false
+	defer func() {
+		state := database.PayoutIdle
+		if sent || planned {
+			state = database.PayoutDone
+		}
+		serr := database.SetPayoutState(db, issue, state)
+		if serr != nil {
+			log.Println("payout state is not updated", serr)
+		}
+	}()
+
+	transfers, err := planTransfers(db, wallets, fg, ctx, owner, project,
+		issue, cfg, false)
+	if err != nil {
+		return
+	}
+
+	if cfg.repo(issue.Repo).Approval {
+		for _, t := range transfers {
+			err = plan(db, issue, t)
+			if err != nil {
+				return
+			}
+			planned = true
+		}
+		if planned {
+			err = errPayoutPending
+		}
+		return
+	}
+
+	sent = true
+	transactions = make(map[c.Cryptocurrency]string)
+	for _, t := range transfers {
+		if t.Hold != "" {
+			log.Printf("%s#%d %s payout is held: %s", issue.Repo,
+				issue.ID, t.Type.Symbol(), t.Hold)
+			err = plan(db, issue, t)
 			if err != nil {
-				log.Println("sendall error", err)
-				err = nil
+				return
 			}
+			planned = true
+			continue
+		}
+
+		tx := send(db, wallets, issue, t)
+		if t.Reason != database.ReasonContributor {
 			log.Print("tx -> default dest:", tx)
 			// We don't show this transaction to user, to
 			// avoid confusion. Of course, those transactions
@@ -180,34 +802,118 @@ func payHandler(db *sql.DB, gh *github.Client, ctx context.Context,
 			// wants to know.
 			continue
 		}
+		transactions[t.Type] = tx
+	}
+	if planned {
+		err = errPayoutPending
+	}
+	return
+}
 
-		valid, err := wallet.Type.Validate(wallet.Address)
-		if err != nil {
-			// Error here does not mean that address is invalid
-			// Do not send to anyone in this case
-			err = nil
-			log.Println("validate error", wallet.Address, err)
-			continue
-		}
+// dryRunPayout writes the plan of the payout, nothing is sent or
+// recorded except snapshots of claims. Wallets of the issue should be
+// filled without seeds.
+func dryRunPayout(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, w http.ResponseWriter, owner, project string,
+	issue database.Issue, cfg *config) (err error) {
 
-		if valid {
-			if issue.Wallets[wallet.Type].Address == wallet.Address {
-				log.Println("destination address is the same")
-				continue
-			}
-			// Note that we're getting seed from the issue' wallet
-			seed := issue.Wallets[wallet.Type].Seed
-			tx, err := wallet.Type.SendAll(seed, wallet.Address)
-			if err != nil {
-				log.Println("sendall error", err)
-				err = nil
-			}
-			transactions[wallet.Type] = tx
-		}
+	var plan payoutPlan
+	plan.State, err = database.GetPayoutState(db, issue)
+	if err != nil {
+		log.Println(err)
+		fmt.Fprint(w, "{}")
+		return
+	}
+
+	plan.Transfers, err = planTransfers(db, wallets, fg, ctx, owner,
+		project, issue, cfg, true)
+	switch err {
+	case nil:
+	case errInvalidIssue, errIssueOpen, errInvalidRollover,
+		errClaimMissing, errClaimWindow, errSplitRequired:
+		fmt.Fprintln(w, err)
+		return
+	default:
+		log.Println(err)
+		fmt.Fprint(w, "{}")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(plan)
+	return
+}
+
+func payHandler(db *database.DB, wallets Wallets, forges map[string]forge.Forge,
+	ctx context.Context, w http.ResponseWriter, r *http.Request,
+	cfg *config) (err error) {
+
+	issue := database.NewIssue()
+	var issueS string
+	issue.Repo, issueS, err = parse(r.URL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	issue.ID, err = strconv.Atoi(issueS)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	fg, owner, project, err := lookupForge(forges, issue.Repo)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	// Dry run never signs, so seeds are not decrypted
+	dryRun := r.URL.Query().Get("dry_run") == "1"
+	sp := database.ShowSeed
+	if dryRun {
+		sp = database.HideSeed
+	}
+
+	err = database.GetWallets(db, &issue, sp)
+	if err != nil {
+		log.Println(err)
+		fmt.Fprint(w, "repo/issue not found in database\n")
+		return
+	}
+
+	if dryRun {
+		err = dryRunPayout(db, wallets, fg, ctx, w, owner, project,
+			issue, cfg)
+		return
+	}
+
+	transactions, sent, err := payout(db, wallets, fg, ctx, owner,
+		project, issue, cfg)
+	switch err {
+	case nil:
+	case errPayoutPending:
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, err)
+		return
+	case errPayoutInProgress:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, err)
+		return
+	case errInvalidIssue, errIssueOpen, errInvalidRollover,
+		errClaimMissing, errClaimWindow, errSplitRequired:
+		fmt.Fprintln(w, err)
+		return
+	default:
+		log.Println(err)
+		fmt.Fprint(w, "{}")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if sent {
+		w.WriteHeader(http.StatusCreated)
+	}
 	err = json.NewEncoder(w).Encode(transactions)
 	return
 }
@@ -0,0 +1,544 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func openTestDB(t *testing.T) (db *database.DB, cleanup func()) {
+	dir, err := ioutil.TempDir("/tmp/", "donate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = database.Open(filepath.Join(dir, "db.sqlite3"), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup = func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func addTestIssue(t *testing.T, db *database.DB, repo string, id int) (
+	issue database.Issue) {
+
+	issue = database.NewIssue()
+	issue.Repo = repo
+	issue.ID = id
+	for _, cc := range c.Cryptocurrencies {
+		issue.Wallets[cc] = database.Wallet{
+			Seed:    fmt.Sprintf("seed-%s-%d-%s", repo, id, cc.Symbol()),
+			Address: fmt.Sprintf("address-%s-%d-%s", repo, id, cc.Symbol()),
+		}
+	}
+
+	err := database.Add(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestPayConcurrent(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+	wallets.delay = 50 * time.Millisecond
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payHandler(db, wallets, forges, ctx, w, r,
+				testConfig(defaultDests, false))
+		}))
+	defer server.Close()
+
+	n := 8
+	codes := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(server.URL +
+				"/pay?repo=github.com/owner/project&issue=1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Fatal("unexpected status", code)
+		}
+	}
+	if created != 1 {
+		t.Fatal("payout is done", created, "times")
+	}
+
+	if len(wallets.sent()) != len(c.Cryptocurrencies) {
+		t.Fatal("SendAll is called", len(wallets.sent()), "times")
+	}
+
+	payoutLocks.Lock()
+	locks := len(payoutLocks.issues)
+	payoutLocks.Unlock()
+	if locks != 0 {
+		t.Fatal("payout locks are not removed", locks)
+	}
+}
+
+func TestPayReleaseClaim(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 2)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 2,
+		State:  forge.Open,
+	})
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=2", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(nil, false))
+
+	if len(wallets.sent()) != 0 {
+		t.Fatal("open issue is paid")
+	}
+
+	claimed, _, err := database.ClaimPayout(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Fatal("claim of open issue is not released")
+	}
+}
+
+func TestPayForges(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "gitlab.example.com/group/subgroup/project"
+	addTestIssue(t, db, repo, 3)
+
+	fg := forge.NewFake()
+	fg.SetIssue("group/subgroup", "project", forge.Issue{
+		Number: 3,
+		State:  forge.Closed,
+	})
+	forges := map[string]forge.Forge{"gitlab.example.com": fg}
+
+	wallets := newFakeWallets()
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=3", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(nil, false))
+
+	if !strings.Contains(w.Body.String(), errForgeNotSupported.Error()) {
+		t.Fatal("unknown host is accepted", w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=3", nil)
+	w = httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(nil, false))
+
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+	if len(wallets.sent()) != len(c.Cryptocurrencies) {
+		t.Fatal("SendAll is called", len(wallets.sent()), "times")
+	}
+
+	payoutLocks.Lock()
+	locks := len(payoutLocks.issues)
+	payoutLocks.Unlock()
+	if locks != 0 {
+		t.Fatal("payout locks are not removed", locks)
+	}
+}
+
+func TestPayDryRun(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 4)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 4,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 4, forge.PullRequest{
+		Body: "BTC{contributor}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	// Seeds are not decrypted for the dry run
+	_, err = db.Exec("UPDATE wallets SET seed = 'aes256gcm:AAAA'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=4&dry_run=1", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(defaultDests, false))
+
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	var plan payoutPlan
+	err = json.NewDecoder(w.Body).Decode(&plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.State != database.PayoutIdle ||
+		len(plan.Transfers) != len(c.Cryptocurrencies) {
+
+		t.Fatal("invalid plan", plan)
+	}
+	for _, tr := range plan.Transfers {
+		expected := transfer{
+			Type:        tr.Type,
+			Source:      issue.Wallets[tr.Type].Address,
+			Destination: defaultDests[tr.Type],
+			Reason:      database.ReasonDefault,
+		}
+		if tr.Type == c.Bitcoin {
+			expected.Destination = "contributor"
+			expected.Reason = database.ReasonContributor
+		}
+		if !reflect.DeepEqual(tr, expected) {
+			t.Fatal("invalid transfer", tr)
+		}
+	}
+
+	if len(wallets.sent()) != 0 {
+		t.Fatal("dry run sends", wallets.sent())
+	}
+
+	payouts, err := database.Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := database.GetPayoutState(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payouts) != 0 || state != database.PayoutIdle {
+		t.Fatal("dry run is recorded", payouts, state)
+	}
+}
+
+func TestPayFee(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 5)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 5,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 5, forge.PullRequest{
+		Body: "BTC{contributor}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+	cfg := testConfig(defaultDests, false)
+	cfg.defaults.Fee = 5
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=5", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r, cfg)
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	// The fee is not taken from funds sent to the default destination
+	expected := []string{"contributor (95%)", "default-btc (5%)",
+		"default-eth", "default-ada"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+
+	r = httptest.NewRequest("GET",
+		"/transactions?repo=github.com/owner/project&issue=5", nil)
+	w = httptest.NewRecorder()
+	transactionsHandler(db, w, r)
+
+	var transactions []transaction
+	err = json.NewDecoder(w.Body).Decode(&transactions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fee is sent in the same transaction
+	tx := "tx-" + issue.Wallets[c.Bitcoin].Seed
+	if len(transactions) != 1 || transactions[0].Tx != tx ||
+		transactions[0].Fee != 5 || transactions[0].FeeTx != "" {
+
+		t.Fatal("invalid transactions", transactions)
+	}
+}
+
+func TestPaySplitRequired(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 5)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 5,
+		State:  forge.Closed,
+	})
+	for i, author := range []string{"first", "second"} {
+		err := fg.AddClosingPullRequest("owner", "project", 5,
+			forge.PullRequest{
+				Number: 6 + i,
+				Author: author,
+				Body:   "Fixes #5\n\nBTC{" + author + "}",
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fg.SetMaintainer("owner", "project", "owner")
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	// Backend without split send
+	fake := newFakeWallets()
+	wallets := struct{ Wallets }{fake}
+
+	pay := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET",
+			"/pay?repo=github.com/owner/project&issue=5", nil)
+		w := httptest.NewRecorder()
+		payHandler(db, wallets, forges, context.Background(), w, r,
+			testConfig(defaultDests, false))
+		return w
+	}
+
+	// The payout is refused, nothing is sent or planned
+	w := pay()
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), errSplitRequired.Error()) {
+
+		t.Fatal("unexpected response", w.Code, w.Body.String())
+	}
+	if len(fake.sent()) != 0 {
+		t.Fatal("split payout is sent", fake.sent())
+	}
+	payouts, err := database.Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := database.GetPayoutState(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payouts) != 0 || state != database.PayoutIdle {
+		t.Fatal("split payout is recorded", payouts, state)
+	}
+
+	// The maintainer designates one of contributors
+	for _, comment := range []struct{ author, body string }{
+		{"owner", "/donate pay @first"},
+		{"first", "/claim BTC{first}"},
+	} {
+		err = fg.AddComment("owner", "project", 5, comment.author,
+			comment.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w = pay()
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+	expected := []string{"first", "default-eth", "default-ada"}
+	if strings.Join(fake.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", fake.sent())
+	}
+}
+
+func TestPaySplit(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 6)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 6,
+		State:  forge.Closed,
+	})
+	for i, body := range []string{
+		// Trailers of the body are not a part of the history
+		"Fixes #6\n\nBTC{first} ETH{first} WEIGHT{3}\n\n" +
+			"Co-authored-by: Body <body@example.org> " +
+			"BTC{body} WEIGHT{100}",
+		// The weight is normalized per pull request
+		"Fixes #6 too\n\nBTC{third} WEIGHT{1000}",
+	} {
+		err := fg.AddClosingPullRequest("owner", "project", 6,
+			forge.PullRequest{Number: 7 + i, Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fg.SetCommits("owner", "project", 7,
+		"Fix\n\nCo-authored-by: Second <second@example.org> "+
+			"BTC{second} WEIGHT{1}\n"+
+			"Co-authored-by: Nobody <nobody@example.org>",
+		"Fix again\n\nCo-authored-by: Second <Second@example.org> "+
+			"BTC{other} WEIGHT{1}")
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	wallets := newFakeWallets()
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=6&dry_run=1", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(defaultDests, false))
+
+	var plan payoutPlan
+	err := json.NewDecoder(w.Body).Decode(&plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Transfers) == 0 || len(plan.Transfers[0].Shares) != 3 {
+		t.Fatal("invalid plan", plan)
+	}
+
+	r = httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=6", nil)
+	w = httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(defaultDests, false))
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	// One transaction per currency, ETH is not split
+	expected := []string{"first (37.5%)", "second (12.5%)", "third (50%)",
+		"first", "default-ada"}
+	if !reflect.DeepEqual(wallets.sent(), expected) {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+
+	payouts, err := database.Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares := []database.Share{
+		{Destination: "first", Weight: 0.75},
+		{Destination: "second", Weight: 0.25},
+		{Destination: "third", Weight: 1},
+	}
+	if len(payouts) != 3 || payouts[0].Type != c.Bitcoin ||
+		!reflect.DeepEqual(payouts[0].Shares, shares) ||
+		payouts[0].Tx != "tx-"+issue.Wallets[c.Bitcoin].Seed {
+
+		t.Fatal("invalid payouts", payouts)
+	}
+}
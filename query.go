@@ -6,22 +6,22 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
 
 	c "code.dumpstack.io/lib/cryptocurrency"
-	"github.com/google/go-github/v29/github"
 
 	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
 )
 
-func queryHandler(db *sql.DB, gh *github.Client, ctx context.Context,
-	w http.ResponseWriter, r *http.Request) {
+func queryHandler(db *database.DB, wallets Wallets, forges map[string]forge.Forge,
+	ctx context.Context, w http.ResponseWriter, r *http.Request,
+	cfg *config) {
 
 	var err error
 
@@ -33,25 +33,18 @@ func queryHandler(db *sql.DB, gh *github.Client, ctx context.Context,
 		return
 	}
 
-	if !strings.HasPrefix(issue.Repo, "github.com/") {
-		fmt.Fprint(w, "non-github repos are not supported yet\n")
-		return
-	}
-
-	fields := strings.Split(issue.Repo, "/")
-	if len(fields) != 3 {
-		fmt.Fprint(w, "invalid repo\n")
+	fg, owner, project, err := lookupForge(forges, issue.Repo)
+	if err != nil {
+		fmt.Fprintln(w, err)
 		return
 	}
-	// fields[0] is 'github.com'
-	owner := fields[1]
-	project := fields[2]
 
 	if issueS == "all" {
 		var issues []database.Issue
 		issues, err = database.AllIssues(db, issue.Repo, database.HideSeed)
 		if err != nil {
 			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
@@ -74,68 +67,113 @@ func queryHandler(db *sql.DB, gh *github.Client, ctx context.Context,
 		return
 	}
 
-	exists, err := database.IsExists(db, issue)
+	err = getOrCreateIssue(db, wallets, fg, ctx, owner, project, &issue,
+		cfg)
+	switch err {
+	case nil:
+	case errRepoNotRegistered:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	case errInvalidIssue, errNotAnIssue, errIssueNotOpen:
+		fmt.Fprintln(w, err)
+		return
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Fee of payouts, the claim mode and whether the bounty is
+	// shared by several contributors are shown in the issue comment
+	s := cfg.repo(issue.Repo)
+	_, split := wallets.(SplitWallets)
+	js, err := json.Marshal(struct {
+		database.Issue
+		Fee          float64
+		StrictClaims bool
+		Split        bool
+	}{issue, s.Fee, s.StrictClaims, split})
 	if err != nil {
 		log.Println(err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Errors of getOrCreateIssue that are reported to the caller as is
+var (
+	errNotAnIssue   = errors.New("not an issue")
+	errIssueNotOpen = errors.New("issue is not open")
+)
+
+// getOrCreateIssue returns wallets of the issue without seeds,
+// wallets are generated if the repo is registered and the issue
+// is open and not known yet. Repo and ID of the issue should be
+// filled.
+func getOrCreateIssue(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, owner, project string, issue *database.Issue,
+	cfg *config) (err error) {
+
+	exists, err := database.IsExists(db, *issue)
+	if err != nil {
+		return
+	}
 	if !exists {
-		// Check that issue is really exists on GitHub
-		ghIssue, _, err := gh.Issues.Get(ctx, owner, project, issue.ID)
+		ok, err := registered(db, fg, ctx, cfg, issue.Repo, owner,
+			project)
 		if err != nil {
-			log.Println(err)
-			fmt.Fprint(w, "invalid repo/issue\n")
-			return
-		}
-
-		// Note: GitHub's REST API v3 considers every pull
-		// request an issue, but not every issue is a pull
-		// request.
-		if ghIssue.IsPullRequest() {
-			fmt.Fprint(w, "not an issue\n")
-			return
+			return err
 		}
-
-		if *ghIssue.State != "open" {
-			fmt.Fprint(w, "issue is not open\n")
-			return
+		if !ok {
+			return errRepoNotRegistered
 		}
 
-		err = genWallets(db, issue)
+		// Check that issue is really exists on forge
+		fgIssue, err := fg.Issue(ctx, owner, project, issue.ID)
 		if err != nil {
 			log.Println(err)
-			return
+			return errInvalidIssue
 		}
-	}
 
-	err = database.GetWallets(db, &issue, database.HideSeed)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	js, err := json.Marshal(issue)
-	if err != nil {
-		log.Println(err)
-		return
+		if fgIssue.PullRequest {
+			return errNotAnIssue
+		}
+
+		if fgIssue.State != forge.Open {
+			return errIssueNotOpen
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	// Issue could be added by the concurrent request after the
+	// check above, wallets are generated only if it's not so
+	_, err = database.GetOrCreate(db, issue, database.HideSeed,
+		func() (map[c.Cryptocurrency]database.Wallet, error) {
+			return genWallets(wallets, cfg.repo(issue.Repo).Currencies)
+		})
+	return
 }
 
-func genWallets(db *sql.DB, issue database.Issue) (err error) {
-	for _, cc := range c.Cryptocurrencies {
+func genWallets(backend Wallets, currencies []c.Cryptocurrency) (
+	wallets map[c.Cryptocurrency]database.Wallet, err error) {
+
+	wallets = make(map[c.Cryptocurrency]database.Wallet)
+	for _, cc := range currencies {
 		var seed, address string
-		seed, address, err = cc.GenWallet()
+		seed, address, err = backend.GenWallet(cc)
 		if err != nil {
 			return
 		}
 
-		issue.Wallets[cc] = database.Wallet{
+		wallets[cc] = database.Wallet{
 			Seed:    seed,
 			Address: address,
 		}
 	}
-
-	return database.Add(db, issue)
+	return
 }
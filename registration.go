@@ -0,0 +1,155 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+var errRepoNotRegistered = errors.New("repo is not registered, " +
+	"add .donate.yml to the repo or ask the administrator to add it")
+
+// optInFiles in the repository prove that the owner wants donations
+var optInFiles = []string{
+	".donate.yml",
+	".github/workflows/donate.yml",
+	".gitea/workflows/donate.yml",
+}
+
+const (
+	// optInTTL of the cached opt-in of the repo
+	optInTTL = time.Hour
+	// noOptInTTL of the cached absence of opt-in files, it's short
+	// so the repo is registered soon after the file is added
+	noOptInTTL = 5 * time.Minute
+	// maxOptIns that are cached, expired ones are removed when
+	// it's reached
+	maxOptIns = 10000
+)
+
+// optIns cache results of optInFiles lookups, /query is not
+// authenticated and should not hit the forge API for every request.
+// Forges are created once, so the forge is a part of the key.
+var optIns = struct {
+	sync.Mutex
+	repos map[optInKey]optIn
+}{repos: make(map[optInKey]optIn)}
+
+type optInKey struct {
+	fg   forge.Forge
+	repo string
+}
+
+type optIn struct {
+	ok      bool
+	expires time.Time
+}
+
+// hasOptIn returns true if the repo contains one of optInFiles
+func hasOptIn(fg forge.Forge, ctx context.Context,
+	repo, owner, project string) (ok bool, err error) {
+
+	key := optInKey{fg, repo}
+	now := time.Now()
+
+	optIns.Lock()
+	cached, found := optIns.repos[key]
+	optIns.Unlock()
+	if found && now.Before(cached.expires) {
+		ok = cached.ok
+		return
+	}
+
+	for _, path := range optInFiles {
+		ok, err = fg.FileExists(ctx, owner, project, path)
+		if err != nil {
+			// errors are not cached
+			return
+		}
+		if ok {
+			break
+		}
+	}
+
+	ttl := noOptInTTL
+	if ok {
+		ttl = optInTTL
+	}
+
+	optIns.Lock()
+	if len(optIns.repos) >= maxOptIns {
+		for k, v := range optIns.repos {
+			if !now.Before(v.expires) {
+				delete(optIns.repos, k)
+			}
+		}
+	}
+	if len(optIns.repos) < maxOptIns {
+		optIns.repos[key] = optIn{ok: ok, expires: now.Add(ttl)}
+	}
+	optIns.Unlock()
+	return
+}
+
+// registered returns true if the repo is configured, added by the
+// administrator or contains one of optInFiles
+func registered(db *database.DB, fg forge.Forge, ctx context.Context,
+	cfg *config, repo, owner, project string) (ok bool, err error) {
+
+	if _, ok = cfg.repos[repo]; ok {
+		return
+	}
+
+	ok, err = database.IsRepoRegistered(db, repo)
+	if err != nil || ok {
+		return
+	}
+
+	ok, err = hasOptIn(fg, ctx, repo, owner, project)
+	return
+}
+
+// repoCommand implements repo add, remove and list subcommands
+func repoCommand(db *database.DB, command string, repos []string) (err error) {
+	if command == "repo list" {
+		repos, err = database.Repos(db)
+		if err != nil {
+			return
+		}
+		for _, repo := range repos {
+			fmt.Println(repo)
+		}
+		return
+	}
+
+	for _, repo := range repos {
+		switch command {
+		case "repo add":
+			_, _, _, err = splitRepo(repo)
+			if err != nil {
+				return
+			}
+			err = database.AddRepo(db, repo)
+			if err != nil {
+				return
+			}
+			fmt.Println(repo, "added")
+		case "repo remove":
+			err = database.RemoveRepo(db, repo)
+			if err != nil {
+				return
+			}
+			fmt.Println(repo, "removed")
+		}
+	}
+	return
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func TestQueryRegistration(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	fg := forge.NewFake()
+	for _, project := range []string{"optin", "configured", "added"} {
+		fg.SetIssue("owner", project, forge.Issue{
+			Number: 1,
+			State:  forge.Open,
+		})
+	}
+	fg.SetIssue("owner", "other", forge.Issue{Number: 1, State: forge.Open})
+	fg.SetFile("owner", "optin", ".donate.yml")
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	cfg := testConfig(nil, false)
+	cfg.repos = map[string]settings{
+		"github.com/owner/configured": cfg.defaults,
+	}
+
+	err := repoCommand(db, "repo add", []string{"github.com/owner/added"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(project string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", fmt.Sprintf(
+			"/query?repo=github.com/owner/%s&issue=1", project), nil)
+		w := httptest.NewRecorder()
+		queryHandler(db, wallets, forges, context.Background(), w, r,
+			cfg)
+		return w
+	}
+
+	for _, project := range []string{"optin", "configured", "added"} {
+		w := query(project)
+		if w.Code != http.StatusOK {
+			t.Fatal(project, "unexpected status", w.Code)
+		}
+
+		var issue database.Issue
+		err = json.NewDecoder(w.Body).Decode(&issue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(issue.Wallets) == 0 {
+			t.Fatal(project, "wallets are not created")
+		}
+	}
+
+	w := query("other")
+	if w.Code != http.StatusForbidden {
+		t.Fatal("unregistered repo is accepted", w.Code)
+	}
+
+	var e struct{ Error string }
+	err = json.NewDecoder(w.Body).Decode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Error != errRepoNotRegistered.Error() {
+		t.Fatal("invalid error", e.Error)
+	}
+
+	exists, err := database.IsExists(db, database.Issue{
+		Repo: "github.com/owner/other",
+		ID:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("wallets are created for unregistered repo")
+	}
+
+	// Wallets of the removed repo are still shown
+	err = repoCommand(db, "repo remove", []string{"github.com/owner/added"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := query("added"); w.Code != http.StatusOK {
+		t.Fatal("unexpected status", w.Code)
+	}
+
+	err = repoCommand(db, "repo add", []string{"owner/project"})
+	if err == nil {
+		t.Fatal("invalid repo is added")
+	}
+}
+
+func TestQuerySplit(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{Number: 1, State: forge.Open})
+	fg.SetFile("owner", "project", ".donate.yml")
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	fake := newFakeWallets()
+	for _, split := range []bool{true, false} {
+		var wallets Wallets = fake
+		if !split {
+			wallets = struct{ Wallets }{fake}
+		}
+
+		r := httptest.NewRequest("GET",
+			"/query?repo=github.com/owner/project&issue=1", nil)
+		w := httptest.NewRecorder()
+		queryHandler(db, wallets, forges, context.Background(), w, r,
+			testConfig(nil, false))
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status", w.Code)
+		}
+
+		var result struct{ Split bool }
+		err := json.NewDecoder(w.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Split != split {
+			t.Fatal("invalid split", result.Split)
+		}
+	}
+}
+
+func TestQueryCurrencies(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	fg := forge.NewFake()
+	for _, number := range []int{1, 2} {
+		fg.SetIssue("owner", "project", forge.Issue{
+			Number: number,
+			State:  forge.Open,
+		})
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+
+	cfg := testConfig(nil, false)
+	s := cfg.defaults
+	s.Currencies = []c.Cryptocurrency{c.Cardano}
+	cfg.repos = map[string]settings{repo: s}
+
+	for _, number := range []int{1, 2} {
+		r := httptest.NewRequest("GET", fmt.Sprintf(
+			"/query?repo=%s&issue=%d", repo, number), nil)
+		w := httptest.NewRecorder()
+		queryHandler(db, wallets, forges, context.Background(), w, r,
+			cfg)
+		if w.Code != http.StatusOK {
+			t.Fatal(number, "unexpected status", w.Code)
+		}
+
+		var issue database.Issue
+		err := json.NewDecoder(w.Body).Decode(&issue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(issue.Wallets) != 1 ||
+			issue.Wallets[c.Cardano].Address == "" {
+
+			t.Fatal(number, "invalid wallets", issue.Wallets)
+		}
+
+		// Only wallets of the repo currencies are stored
+		stored := database.NewIssue()
+		stored.Repo = repo
+		stored.ID = number
+		err = database.GetWallets(db, &stored, database.HideSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored.Wallets) != 1 {
+			t.Fatal(number, "invalid stored wallets", stored.Wallets)
+		}
+	}
+}
+
+// countingForge counts FileExists calls
+type countingForge struct {
+	*forge.Fake
+	files int
+}
+
+func (f *countingForge) FileExists(ctx context.Context, owner, project,
+	path string) (exists bool, err error) {
+
+	f.files++
+	return f.Fake.FileExists(ctx, owner, project, path)
+}
+
+func TestOptInCache(t *testing.T) {
+	fg := &countingForge{Fake: forge.NewFake()}
+	fg.SetFile("owner", "optin", ".donate.yml")
+
+	for _, tc := range []struct {
+		project string
+		ok      bool
+		files   int
+	}{
+		{"optin", true, 1},
+		{"other", false, len(optInFiles)},
+	} {
+		for i := 0; i < 3; i++ {
+			ok, err := hasOptIn(fg, context.Background(),
+				"github.com/owner/"+tc.project, "owner",
+				tc.project)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.ok {
+				t.Fatal(tc.project, "invalid opt-in", ok)
+			}
+		}
+		if fg.files != tc.files {
+			t.Fatal(tc.project, "opt-in is not cached", fg.files)
+		}
+		fg.files = 0
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v29/github"
+	"golang.org/x/oauth2"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+)
+
+// sessionAge of the registry login
+const sessionAge = 24 * time.Hour
+
+const (
+	sessionCookie = "donate_session"
+	stateCookie   = "donate_oauth_state"
+)
+
+// registry of payout addresses of contributors, contributors log in
+// with GitHub OAuth. Addresses are used for pull requests of the
+// login that have no address of the currency in the body.
+type registry struct {
+	oauth *oauth2.Config
+	// login of the owner of the token
+	login func(ctx context.Context, token *oauth2.Token) (
+		login string, err error)
+	// key of session cookies, sessions are not valid after restart
+	key []byte
+}
+
+func newRegistry(clientID, clientSecret string) (rg registry, err error) {
+	rg.oauth = &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://github.com/login/oauth/authorize",
+			TokenURL: "https://github.com/login/oauth/access_token",
+		},
+	}
+
+	rg.login = func(ctx context.Context, token *oauth2.Token) (
+		login string, err error) {
+
+		client := github.NewClient(rg.oauth.Client(ctx, token))
+		user, _, err := client.Users.Get(ctx, "")
+		login = user.GetLogin()
+		return
+	}
+
+	rg.key = make([]byte, 32)
+	_, err = rand.Read(rg.key)
+	return
+}
+
+func (rg registry) mac(parts ...string) string {
+	mac := hmac.New(sha256.New, rg.key)
+	fmt.Fprint(mac, strings.Join(parts, "\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// session cookie value of the login, valid until expires
+func (rg registry) session(login string, expires time.Time) string {
+	ts := strconv.FormatInt(expires.Unix(), 10)
+	return login + ":" + ts + ":" + rg.mac("session", login, ts)
+}
+
+// sessionLogin of the request
+func (rg registry) sessionLogin(r *http.Request) (login string, err error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		err = errors.New("not logged in")
+		return
+	}
+
+	parts := strings.Split(cookie.Value, ":")
+	if len(parts) != 3 {
+		err = errors.New("invalid session")
+		return
+	}
+
+	expected := rg.mac("session", parts[0], parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		err = errors.New("invalid session")
+		return
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		err = errors.New("session is expired")
+		return
+	}
+
+	login = parts[0]
+	return
+}
+
+// csrf token of the address form of the login
+func (rg registry) csrf(login string) string {
+	return rg.mac("csrf", login)
+}
+
+// secureRequest is true if the request is served over HTTPS, directly
+// or by the reverse proxy
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// loginHandler redirects to GitHub for authorization
+func loginHandler(rg registry, w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   600,
+		Secure:   secureRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, rg.oauth.AuthCodeURL(state), http.StatusFound)
+}
+
+// callbackHandler exchanges the code and starts the session
+func callbackHandler(rg registry, ctx context.Context, w http.ResponseWriter,
+	r *http.Request) {
+
+	state, err := r.Cookie(stateCookie)
+	if err != nil || state.Value == "" ||
+		state.Value != r.URL.Query().Get("state") {
+
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "invalid state")
+		return
+	}
+
+	token, err := rg.oauth.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		log.Println("oauth:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "unauthorized")
+		return
+	}
+
+	login, err := rg.login(ctx, token)
+	if err != nil || login == "" {
+		log.Println("oauth:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "unauthorized")
+		return
+	}
+
+	expires := time.Now().Add(sessionAge)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    rg.session(login, expires),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secureRequest(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/",
+		MaxAge: -1, Secure: secureRequest(r)})
+	http.Redirect(w, r, "/addresses", http.StatusSeeOther)
+}
+
+var addressesTemplate = template.Must(template.New("addresses").Parse(`
+<!DOCTYPE html>
+<html>
+<head><title>Payout addresses</title></head>
+<body>
+<h3>Payout addresses of {{.Login}}</h3>
+<p>Bounties are sent to these addresses if the pull request has no
+address of the currency.</p>
+<form method="POST" action="/addresses">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+{{range .Addresses}}
+<p><label>{{.Symbol}} <input name="{{.Symbol}}" value="{{.Address}}" size="64"></label></p>
+{{end}}
+<p><input type="submit" value="Save"></p>
+</form>
+</body>
+</html>
+`))
+
+// addressesHandler shows (GET) and saves (POST) payout addresses
+// of the logged in contributor
+func addressesHandler(db *database.DB, wallets Wallets, rg registry,
+	w http.ResponseWriter, r *http.Request) {
+
+	login, err := rg.sessionLogin(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		err = saveAddresses(db, wallets, rg, login, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		http.Redirect(w, r, "/addresses", http.StatusSeeOther)
+		return
+	}
+
+	registered, err := database.ContributorAddresses(db, "github.com",
+		login)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	type address struct {
+		Symbol  string
+		Address string
+	}
+	data := struct {
+		Login     string
+		CSRF      string
+		Addresses []address
+	}{Login: login, CSRF: rg.csrf(login)}
+	for _, cc := range wallets.Currencies() {
+		data.Addresses = append(data.Addresses, address{
+			Symbol:  strings.ToUpper(cc.Symbol()),
+			Address: registered[cc],
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = addressesTemplate.Execute(w, data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// saveAddresses of the form, empty addresses are removed
+func saveAddresses(db *database.DB, wallets Wallets, rg registry, login string,
+	r *http.Request) (err error) {
+
+	err = r.ParseForm()
+	if err != nil {
+		return
+	}
+
+	if !hmac.Equal([]byte(r.PostForm.Get("csrf")), []byte(rg.csrf(login))) {
+		err = errors.New("invalid csrf token")
+		return
+	}
+
+	addresses := make(map[c.Cryptocurrency]string)
+	for _, cc := range wallets.Currencies() {
+		symbol := strings.ToUpper(cc.Symbol())
+		address := strings.TrimSpace(r.PostForm.Get(symbol))
+		if address != "" {
+			var valid bool
+			valid, err = wallets.Validate(cc, address)
+			if err != nil {
+				return
+			}
+			if !valid {
+				err = fmt.Errorf("invalid %s address", symbol)
+				return
+			}
+		}
+		addresses[cc] = address
+	}
+
+	for cc, address := range addresses {
+		err = database.SetContributorAddress(db, "github.com", login,
+			cc, address)
+		if err != nil {
+			return
+		}
+	}
+	log.Println("registry:", login, "addresses are updated")
+	return
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func testRegistry() (rg registry, cleanup func()) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("code") != "code" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "token", `+
+				`"token_type": "bearer"}`)
+		}))
+
+	rg = registry{
+		oauth: &oauth2.Config{
+			ClientID:     "id",
+			ClientSecret: "secret",
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  server.URL + "/authorize",
+				TokenURL: server.URL + "/token",
+			},
+		},
+		login: func(ctx context.Context, token *oauth2.Token) (
+			login string, err error) {
+
+			if token.AccessToken != "token" {
+				err = fmt.Errorf("invalid token")
+				return
+			}
+			login = "Contributor"
+			return
+		},
+		key: []byte("key"),
+	}
+	return rg, server.Close
+}
+
+func TestRegistry(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	rg, cleanupRegistry := testRegistry()
+	defer cleanupRegistry()
+
+	wallets := newFakeWallets()
+	wallets.invalid["invalid"] = true
+	ctx := context.Background()
+
+	addresses := func(method, form string,
+		cookies ...*http.Cookie) *httptest.ResponseRecorder {
+
+		r := httptest.NewRequest(method, "/addresses",
+			strings.NewReader(form))
+		if method == "POST" {
+			r.Header.Set("Content-Type",
+				"application/x-www-form-urlencoded")
+		}
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		addressesHandler(db, wallets, rg, w, r)
+		return w
+	}
+
+	w := addresses("GET", "")
+	if w.Code != http.StatusFound ||
+		w.Header().Get("Location") != "/login" {
+
+		t.Fatal("not logged in user is not redirected", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	loginHandler(rg, w, httptest.NewRequest("GET", "/login", nil))
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	if w.Code != http.StatusFound || state == "" {
+		t.Fatal("invalid redirect", w.Code, location)
+	}
+	stateCookie := w.Result().Cookies()[0]
+	if stateCookie.Secure {
+		t.Fatal("secure cookie over plain HTTP")
+	}
+
+	callback := func(state, code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/oauth/callback?state="+
+			state+"&code="+code, nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.AddCookie(stateCookie)
+		w := httptest.NewRecorder()
+		callbackHandler(rg, ctx, w, r)
+		return w
+	}
+
+	if w = callback("forged", "code"); w.Code != http.StatusBadRequest {
+		t.Fatal("forged state is accepted", w.Code)
+	}
+	if w = callback(state, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatal("wrong code is accepted", w.Code)
+	}
+
+	w = callback(state, "code")
+	if w.Code != http.StatusSeeOther {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil || !session.Secure {
+		t.Fatal("no secure session cookie", session)
+	}
+
+	w = addresses("GET", "", session)
+	csrf := rg.csrf("Contributor")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), csrf) {
+		t.Fatal("invalid form", w.Code, w.Body.String())
+	}
+
+	forged := *session
+	forged.Value = strings.Replace(session.Value, "Contributor", "other", 1)
+	w = addresses("GET", "", &forged)
+	if w.Code != http.StatusFound {
+		t.Fatal("forged session is accepted", w.Code)
+	}
+
+	for _, form := range []string{
+		"BTC=registered",
+		"csrf=wrong&BTC=registered",
+		"csrf=" + csrf + "&BTC=invalid",
+	} {
+		w = addresses("POST", form, session)
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(form, "is accepted", w.Code)
+		}
+	}
+
+	w = addresses("POST", "csrf="+csrf+"&BTC=registered&ETH=", session)
+	if w.Code != http.StatusSeeOther {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	registered, err := database.ContributorAddresses(db, "github.com",
+		"contributor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) != 1 || registered[c.Bitcoin] != "registered" {
+		t.Fatal("invalid addresses", registered)
+	}
+}
+
+func TestPayRegistry(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 11)
+
+	for cc, address := range map[c.Cryptocurrency]string{
+		c.Bitcoin:  "registeredbtc",
+		c.Ethereum: "registeredeth",
+	} {
+		err := database.SetContributorAddress(db, "github.com",
+			"contributor", cc, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 11,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 11, forge.PullRequest{
+		Number: 12,
+		Author: "Contributor",
+		Body:   "Fixes #11\n\nETH{frombody}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	wallets := newFakeWallets()
+	r := httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=11", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(defaultDests, false))
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	// The body takes precedence over the registry
+	expected := []string{"registeredbtc", "frombody", "default-ada"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+const (
+	// retryLease postpones the next attempt while the payout is
+	// being sent, e.g. if the daemon is stopped in the middle
+	retryLease = 10 * time.Minute
+	// maxRetryBackoff between attempts of sending
+	maxRetryBackoff = 24 * time.Hour
+	// maxAttempts of sending, the payout is abandoned after that
+	// (about a week with retryBackoff)
+	maxAttempts = 16
+	// deferredRetry postpones the deferred payout that is failed,
+	// e.g. if the forge is not available
+	deferredRetry = 10 * time.Minute
+)
+
+// retryBackoff after the failed attempt, doubles from a minute
+// up to maxRetryBackoff
+func retryBackoff(attempts int) (backoff time.Duration) {
+	backoff = time.Minute
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= maxRetryBackoff {
+			return maxRetryBackoff
+		}
+	}
+	return
+}
+
+// nextAttempt after the failed attempt of sending, zero if the
+// payout should be abandoned: the wallet is empty or there are too
+// many attempts
+func nextAttempt(now time.Time, attempts int, err error) (next time.Time) {
+	if err == errNoFunds || attempts >= maxAttempts {
+		return
+	}
+	return now.Add(retryBackoff(attempts))
+}
+
+// retryFailed sends failed payouts which retry is due
+func retryFailed(db *database.DB, wallets Wallets, now time.Time) (err error) {
+	due, err := database.DuePayouts(db, now)
+	if err != nil {
+		return
+	}
+
+	for _, p := range due {
+		err = retryPayout(db, wallets, p, now)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// retryPayout under the payout lock of the issue
+func retryPayout(db *database.DB, wallets Wallets, p database.IssuePayout,
+	now time.Time) (err error) {
+
+	unlock := lockPayout(database.Issue{Repo: p.Repo, ID: p.Issue})
+	defer unlock()
+
+	payout, seed, err := database.ClaimRetry(db, p.ID, now,
+		now.Add(retryLease))
+	if err == database.ErrNotDue {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	attempts := payout.Attempts + 1
+	tx, serr := sendPayout(wallets, payout.Payout, seed)
+	next := nextAttempt(now, attempts, serr)
+	if serr == nil {
+		log.Printf("payout %d (%s#%d) is sent: %s",
+			payout.ID, payout.Repo, payout.Issue, tx)
+	} else if next.IsZero() {
+		log.Printf("payout %d (%s#%d) is abandoned after %d "+
+			"attempts: %v", payout.ID, payout.Repo, payout.Issue,
+			attempts, serr)
+	} else {
+		log.Printf("retry %d of payout %d (%s#%d) is failed: %v",
+			attempts, payout.ID, payout.Repo, payout.Issue, serr)
+	}
+
+	err = database.SetPayoutResult(db, payout.ID, tx, serr, next)
+	return
+}
+
+// payDeferred runs payouts which deferral is due at now, e.g. the
+// claim window of the issue is over
+func payDeferred(db *database.DB, wallets Wallets,
+	forges map[string]forge.Forge, ctx context.Context, cfg *config,
+	now time.Time) (err error) {
+
+	issues, err := database.DeferredPayouts(db, now)
+	if err != nil {
+		return
+	}
+
+	for _, issue := range issues {
+		// The payout defers itself again if it still waits
+		err = database.RemoveDeferredPayout(db, issue)
+		if err != nil {
+			return
+		}
+
+		perr := deferredPayout(db, wallets, forges, ctx, cfg, issue)
+		if perr == nil {
+			continue
+		}
+
+		log.Printf("deferred payout of %s#%d is failed: %v",
+			issue.Repo, issue.ID, perr)
+		err = database.DeferPayout(db, issue, now.Add(deferredRetry))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// deferredPayout of the issue, only Repo and ID should be filled
+func deferredPayout(db *database.DB, wallets Wallets,
+	forges map[string]forge.Forge, ctx context.Context, cfg *config,
+	issue database.Issue) (err error) {
+
+	fg, owner, project, err := lookupForge(forges, issue.Repo)
+	if err != nil {
+		return
+	}
+
+	err = database.GetWallets(db, &issue, database.ShowSeed)
+	if err != nil {
+		return
+	}
+
+	transactions, sent, err := payout(db, wallets, fg, ctx, owner,
+		project, issue, cfg)
+	switch err {
+	case nil:
+	case errPayoutPending, errClaimMissing, errClaimWindow,
+		errSplitRequired:
+
+		log.Printf("deferred payout of %s#%d: %v", issue.Repo,
+			issue.ID, err)
+		err = nil
+		return
+	case errIssueOpen:
+		err = nil
+		return
+	default:
+		return
+	}
+
+	if sent {
+		log.Printf("deferred payout of %s#%d is sent: %v",
+			issue.Repo, issue.ID, transactions)
+	}
+	return
+}
+
+// resendCommand sends dropped payouts again
+func resendCommand(db *database.DB, ids []int64) (err error) {
+	for _, id := range ids {
+		err = database.ResendPayout(db, id, time.Now())
+		if err != nil {
+			err = fmt.Errorf("payout %d: %v", id, err)
+			return
+		}
+		fmt.Println(id, "will be sent again")
+	}
+	return
+}
+
+// retryWorker retries failed payouts and runs deferred ones every
+// interval
+func retryWorker(db *database.DB, wallets Wallets,
+	forges map[string]forge.Forge, ctx context.Context, live *liveConfig,
+	interval time.Duration) {
+
+	for range time.Tick(interval) {
+		err := retryFailed(db, wallets, time.Now())
+		if err != nil {
+			log.Println("retry:", err)
+		}
+
+		err = payDeferred(db, wallets, forges, ctx, live.get(),
+			time.Now())
+		if err != nil {
+			log.Println("deferred:", err)
+		}
+	}
+}
+
+func payoutsHandler(db *database.DB, w http.ResponseWriter, r *http.Request) {
+	status := database.PayoutStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "":
+		status = database.PayoutFailed
+	case database.PayoutSent, database.PayoutConfirmed,
+		database.PayoutDropped, database.PayoutFailed,
+		database.PayoutPending, database.PayoutApproved,
+		database.PayoutRejected, database.PayoutAbandoned:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "invalid status")
+		return
+	}
+
+	payouts, err := database.PayoutsByStatus(db, status)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
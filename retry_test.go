@@ -0,0 +1,333 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		12: maxRetryBackoff,
+		99: maxRetryBackoff,
+	} {
+		if retryBackoff(attempts) != expected {
+			t.Fatal(attempts, retryBackoff(attempts))
+		}
+	}
+}
+
+func TestIsNoFunds(t *testing.T) {
+	for msg, expected := range map[string]bool{
+		"insufficient funds for gas * price + value": true,
+		"Not enough funds":                           true,
+		"no funds":                                   true,
+		"insufficient fee":                           false,
+		"not enough inputs confirmed":                false,
+		"connection refused":                         false,
+	} {
+		if isNoFunds(errors.New(msg)) != expected {
+			t.Fatal(msg, !expected)
+		}
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	// Bitcoin node is down
+	wallets := newFakeWallets()
+	wallets.setFailing(c.Bitcoin, errors.New("connection refused"))
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=1", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(nil, false))
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	payoutsHandler(db, w, httptest.NewRequest("GET",
+		"/payouts?status=failed", nil))
+
+	var failed []database.IssuePayout
+	err := json.NewDecoder(w.Body).Decode(&failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Type != c.Bitcoin ||
+		failed[0].Error != "connection refused" {
+
+		t.Fatal("invalid failed payouts", failed)
+	}
+
+	// Not due yet
+	err = retryFailed(db, wallets, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets.setFailing(c.Bitcoin, nil)
+
+	err = retryFailed(db, wallets, time.Now().Add(retryBackoff(1)+time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payouts, err := database.Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range payouts {
+		if p.Status != database.PayoutSent {
+			t.Fatal("payout is not sent", p)
+		}
+		if p.Type == c.Bitcoin && p.Attempts != 2 {
+			t.Fatal("invalid attempts", p.Attempts)
+		}
+	}
+}
+
+func TestRetryApproved(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 1)
+
+	claimed, _, err := database.ClaimPayout(db, issue)
+	if err != nil || !claimed {
+		t.Fatal("not claimed", err)
+	}
+	err = database.AddPayout(db, issue, database.Payout{
+		Type:        c.Bitcoin,
+		Source:      issue.Wallets[c.Bitcoin].Address,
+		Destination: "contributor",
+		Reason:      database.ReasonContributor,
+		Status:      database.PayoutPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.SetPayoutState(db, issue, database.PayoutDone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := database.PayoutsByStatus(db, database.PayoutPending)
+	if err != nil || len(pending) != 1 {
+		t.Fatal("invalid pending payouts", pending, err)
+	}
+
+	// The daemon is stopped after the approval, nothing is sent
+	now := time.Now()
+	_, _, err = database.ApprovePayout(db, pending[0].ID,
+		now.Add(retryLease))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := newFakeWallets()
+	err = retryFailed(db, wallets, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wallets.sent()) != 0 {
+		t.Fatal("approved payout is retried before the lease",
+			wallets.sent())
+	}
+
+	err = retryFailed(db, wallets, now.Add(retryLease+time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wallets.sent()) != 1 || wallets.sent()[0] != "contributor" {
+		t.Fatal("interrupted approval is not sent", wallets.sent())
+	}
+}
+
+func TestRetryAbandoned(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	issue := addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+	wallets.setFailing(c.Bitcoin, errNoFunds)
+	wallets.setFailing(c.Ethereum, errors.New("connection refused"))
+
+	r := httptest.NewRequest("GET",
+		"/pay?repo=github.com/owner/project&issue=1", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, context.Background(), w, r,
+		testConfig(nil, false))
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code)
+	}
+
+	// Retries of the unreachable node are exhausted, the empty
+	// wallet is not retried at all
+	now := time.Now()
+	for i := 0; i < maxAttempts+1; i++ {
+		now = now.Add(maxRetryBackoff + time.Second)
+		err := retryFailed(db, wallets, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payouts, err := database.Payouts(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range payouts {
+		var attempts int
+		switch p.Type {
+		case c.Bitcoin:
+			attempts = 1
+		case c.Ethereum:
+			attempts = maxAttempts
+		default:
+			continue
+		}
+		if p.Status != database.PayoutAbandoned ||
+			p.Attempts != attempts {
+
+			t.Fatal("payout is not abandoned", p)
+		}
+	}
+
+	due, err := database.DuePayouts(db, now.Add(maxRetryBackoff))
+	if err != nil || len(due) != 0 {
+		t.Fatal("abandoned payouts are due", due, err)
+	}
+}
+
+func TestPayDeferred(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 17)
+
+	closedAt := time.Now()
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number:   17,
+		State:    forge.Closed,
+		ClosedAt: &closedAt,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 17, forge.PullRequest{
+		Number: 18,
+		Author: "contributor",
+		Body:   "Fixes #17\n\nBTC{frombody}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+	cfg := testConfig(defaultDests, false)
+
+	wallets := newFakeWallets()
+	ctx := context.Background()
+
+	// The payout waits for claims and is deferred until the end
+	// of the claim window
+	r := httptest.NewRequest("GET", "/pay?repo="+repo+"&issue=17", nil)
+	w := httptest.NewRecorder()
+	payHandler(db, wallets, forges, ctx, w, r, cfg)
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), errClaimWindow.Error()) {
+
+		t.Fatal("unexpected response", w.Code, w.Body.String())
+	}
+
+	due := closedAt.Add(claimWindow)
+	issues, err := database.DeferredPayouts(db, due)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Repo != repo || issues[0].ID != 17 {
+		t.Fatal("payout is not deferred", issues)
+	}
+
+	err = payDeferred(db, wallets, forges, ctx, cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wallets.sent()) != 0 {
+		t.Fatal("deferred payout is sent before due", wallets.sent())
+	}
+
+	err = fg.AddComment("owner", "project", 17, "contributor",
+		"/claim ETH{claimed}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The claim window is over
+	closedAt = time.Now().Add(-claimWindow)
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number:   17,
+		State:    forge.Closed,
+		ClosedAt: &closedAt,
+	})
+
+	err = payDeferred(db, wallets, forges, ctx, cfg, due)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"frombody", "claimed", "default-ada"}
+	if strings.Join(wallets.sent(), ",") != strings.Join(expected, ",") {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+
+	issues, err = database.DeferredPayouts(db, due)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatal("paid payout is still deferred", issues)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strconv"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// rolloverRe matches the command of the maintainer, e.g.
+// "/donate rollover #123"
+var rolloverRe = regexp.MustCompile(`(?m)^/donate rollover #([0-9]+)\s*$`)
+
+// rolloverTarget of the issue is the last rollover command of the
+// maintainer in comments, the canonical issue if the issue is marked
+// as a duplicate, or the rollover issue of the repo settings.
+// Zero if there is no target.
+func rolloverTarget(fg forge.Forge, ctx context.Context,
+	owner, project string, number int, s settings) (target int,
+	err error) {
+
+	comments, err := fg.Comments(ctx, owner, project, number)
+	if err != nil {
+		return
+	}
+
+	for i := len(comments) - 1; i >= 0; i-- {
+		match := rolloverRe.FindStringSubmatch(comments[i].Body)
+		if match == nil {
+			continue
+		}
+
+		var maintainer bool
+		maintainer, err = fg.IsMaintainer(ctx, owner, project,
+			comments[i].Author)
+		if err != nil {
+			return
+		}
+		if !maintainer {
+			log.Println("rollover by", comments[i].Author,
+				"who is not a maintainer")
+			continue
+		}
+
+		target, err = strconv.Atoi(match[1])
+		return
+	}
+
+	target, found, err := fg.DuplicateOf(ctx, owner, project, number)
+	if err != nil || found {
+		return
+	}
+
+	target = s.Rollover
+	return
+}
+
+// rolloverIssue returns the target issue with wallets (without
+// seeds), wallets are created if the target issue is not known yet.
+// In dry run nothing is created, wallets of the unknown target have
+// no addresses then. ID is zero if there is no target.
+func rolloverIssue(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, owner, project string, issue database.Issue,
+	cfg *config, dryRun bool) (target database.Issue, err error) {
+
+	id, err := rolloverTarget(fg, ctx, owner, project, issue.ID,
+		cfg.repo(issue.Repo))
+	if err != nil || id == 0 {
+		return
+	}
+
+	if id == issue.ID {
+		log.Printf("%s#%d: rollover to itself", issue.Repo, issue.ID)
+		err = errInvalidRollover
+		return
+	}
+
+	// Funds of the closed target would never be paid out
+	fgIssue, err := fg.Issue(ctx, owner, project, id)
+	if err != nil || fgIssue.PullRequest || fgIssue.State != forge.Open {
+		log.Printf("%s#%d: rollover to #%d that is not an open "+
+			"issue (%v)", issue.Repo, issue.ID, id, err)
+		err = errInvalidRollover
+		return
+	}
+
+	target = database.NewIssue()
+	target.Repo = issue.Repo
+	target.ID = id
+
+	if dryRun {
+		var exists bool
+		exists, err = database.IsExists(db, target)
+		if err != nil {
+			return
+		}
+		if exists {
+			err = database.GetWallets(db, &target,
+				database.HideSeed)
+			return
+		}
+		target.Wallets = make(map[c.Cryptocurrency]database.Wallet)
+		for _, cc := range cfg.repo(issue.Repo).Currencies {
+			target.Wallets[cc] = database.Wallet{}
+		}
+		return
+	}
+
+	err = getOrCreateIssue(db, wallets, fg, ctx, owner, project, &target,
+		cfg)
+	return
+}
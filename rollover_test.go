@@ -0,0 +1,177 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+func TestPayRollover(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	repo := "github.com/owner/project"
+	addTestIssue(t, db, repo, 1)
+	addTestIssue(t, db, repo, 4)
+
+	fg := forge.NewFake()
+	for number, state := range map[int]forge.State{
+		1: forge.Closed,
+		2: forge.Open,
+		3: forge.Closed,
+		4: forge.Closed,
+	} {
+		fg.SetIssue("owner", "project", forge.Issue{
+			Number: number,
+			State:  state,
+		})
+	}
+	fg.SetMaintainer("owner", "project", "maintainer")
+	for _, comment := range []struct {
+		number       int
+		author, body string
+	}{
+		{1, "maintainer", "Not planned\n/donate rollover #2"},
+		{1, "someone", "/donate rollover #3"},
+		{4, "maintainer", "/donate rollover #3"},
+	} {
+		err := fg.AddComment("owner", "project", comment.number,
+			comment.author, comment.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	forges := map[string]forge.Forge{"github.com": fg}
+
+	wallets := newFakeWallets()
+	cfg := testConfig(nil, false)
+	cfg.repos = map[string]settings{repo: cfg.defaults}
+
+	pay := func(issue string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET",
+			"/pay?repo="+repo+"&issue="+issue, nil)
+		w := httptest.NewRecorder()
+		payHandler(db, wallets, forges, context.Background(), w, r,
+			cfg)
+		return w
+	}
+
+	// The closed issue is not a valid target
+	w := pay("4")
+	if !strings.Contains(w.Body.String(), errInvalidRollover.Error()) {
+		t.Fatal("rollover to the closed issue", w.Body.String())
+	}
+	if len(wallets.sent()) != 0 {
+		t.Fatal("invalid rollover is sent", wallets.sent())
+	}
+
+	// Dry run does not create the target issue
+	w = pay("1&dry_run=1")
+	var plan payoutPlan
+	err := json.NewDecoder(w.Body).Decode(&plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range plan.Transfers {
+		if tr.Reason != database.ReasonRollover || tr.Target != 2 {
+			t.Fatal("invalid transfer", tr)
+		}
+	}
+	exists, err := database.IsExists(db, database.Issue{Repo: repo, ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Transfers) == 0 || exists {
+		t.Fatal("dry run creates the target", plan, exists)
+	}
+
+	w = pay("1")
+	if w.Code != http.StatusCreated {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
+
+	// Wallets of the target issue are created
+	target := database.NewIssue()
+	target.Repo = repo
+	target.ID = 2
+	err = database.GetWallets(db, &target, database.HideSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for _, cc := range c.Cryptocurrencies {
+		expected = append(expected, target.Wallets[cc].Address)
+	}
+	if !reflect.DeepEqual(wallets.sent(), expected) {
+		t.Fatal("invalid destinations", wallets.sent())
+	}
+
+	transactions := func(issue string) (ts []transaction) {
+		r := httptest.NewRequest("GET",
+			"/transactions?repo="+repo+"&issue="+issue, nil)
+		w := httptest.NewRecorder()
+		transactionsHandler(db, w, r)
+		err := json.NewDecoder(w.Body).Decode(&ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// Recorded in both issues
+	out := transactions("1")
+	in := transactions("2")
+	if len(out) != len(c.Cryptocurrencies) || len(in) != len(out) {
+		t.Fatal("invalid transactions", out, in)
+	}
+	for i := range out {
+		if out[i].To != 2 || in[i].From != 1 || out[i].Tx != in[i].Tx {
+			t.Fatal("invalid rollover", out[i], in[i])
+		}
+	}
+}
+
+func TestRolloverTargetDuplicate(t *testing.T) {
+	fg := forge.NewFake()
+	for number := 1; number <= 3; number++ {
+		fg.SetIssue("owner", "project", forge.Issue{Number: number})
+	}
+	fg.SetMaintainer("owner", "project", "maintainer")
+	fg.SetDuplicate("owner", "project", 1, 2)
+	fg.SetDuplicate("owner", "project", 2, 3)
+	err := fg.AddComment("owner", "project", 2, "maintainer",
+		"/donate rollover #1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := settings{Rollover: 3}
+	for number, expected := range map[int]int{
+		1: 2, // canonical issue overrides the repo settings
+		2: 1, // maintainer command overrides the canonical issue
+		3: 3,
+	} {
+		target, err := rolloverTarget(fg, context.Background(),
+			"owner", "project", number, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != expected {
+			t.Fatal(number, "invalid target", target)
+		}
+	}
+}
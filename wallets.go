@@ -0,0 +1,179 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+)
+
+// Wallets backend to generate issue wallets and send funds from them
+type Wallets interface {
+	// Currencies that are supported by the backend
+	Currencies() []c.Cryptocurrency
+
+	// GenWallet generates a new wallet
+	GenWallet(cc c.Cryptocurrency) (seed, address string, err error)
+
+	// SendAll funds of the wallet to the address, errNoFunds if
+	// there is nothing to send
+	SendAll(cc c.Cryptocurrency, seed, address string) (tx string,
+		err error)
+
+	// Validate the address
+	Validate(cc c.Cryptocurrency, address string) (valid bool, err error)
+}
+
+// SplitWallets backend is also able to split funds of the wallet
+// between several addresses in one transaction, it's required for
+// payouts with a fee or to several contributors
+type SplitWallets interface {
+	Wallets
+
+	// SendShares of all funds of the wallet to the addresses in one
+	// transaction, funds are divided in proportion to weights
+	SendShares(cc c.Cryptocurrency, seed string,
+		shares []database.Share) (tx string, err error)
+}
+
+var errSplitNotSupported = errors.New("split send is not supported " +
+	"by the wallets backend")
+
+// errSplitRequired is returned for payouts to several contributors if
+// the wallets backend can't split funds, the maintainer designates one
+// of them instead
+var errSplitRequired = errors.New("payout to several contributors " +
+	"is not supported by the wallets backend, designate one with " +
+	"/donate pay @user")
+
+// errNoFunds is returned by backends for empty wallets, sending is
+// not retried then
+var errNoFunds = errors.New("no funds")
+
+// payoutShares in percents of the funds, the fee (if any) is the
+// last one
+func payoutShares(p database.Payout) (shares []database.Share) {
+	contributors := p.Shares
+	if len(contributors) == 0 {
+		contributors = []database.Share{{
+			Destination: p.Destination,
+			Weight:      1,
+		}}
+	}
+
+	var total float64
+	for _, share := range contributors {
+		total += share.Weight
+	}
+	for _, share := range contributors {
+		shares = append(shares, database.Share{
+			Destination: share.Destination,
+			Weight:      share.Weight / total * (100 - p.Fee),
+		})
+	}
+
+	if p.Fee != 0 {
+		shares = append(shares, database.Share{
+			Destination: p.FeeDestination,
+			Weight:      p.Fee,
+		})
+	}
+	return
+}
+
+// needsSplit returns true if the payout can't be sent by SendAll
+func needsSplit(p database.Payout) bool {
+	return p.Fee != 0 || len(p.Shares) != 0
+}
+
+// canSend the payout by the wallets backend
+func canSend(wallets Wallets, p database.Payout) bool {
+	_, split := wallets.(SplitWallets)
+	return split || !needsSplit(p)
+}
+
+// sendPayout of all funds of the wallet to the destination (or split
+// between shares), the fee (if any) is sent in the same transaction
+func sendPayout(wallets Wallets, p database.Payout, seed string) (
+	tx string, err error) {
+
+	if !needsSplit(p) {
+		tx, err = wallets.SendAll(p.Type, seed, p.Destination)
+		return
+	}
+
+	split, ok := wallets.(SplitWallets)
+	if !ok {
+		err = errSplitNotSupported
+		return
+	}
+
+	tx, err = split.SendShares(p.Type, seed, payoutShares(p))
+	return
+}
+
+// libWallets backend uses code.dumpstack.io/lib/cryptocurrency, it
+// is only able to send all funds to one address, so the fee is refused
+// (see checkFee) and so are payouts to several contributors (see
+// errSplitRequired)
+type libWallets struct{}
+
+func (libWallets) Currencies() []c.Cryptocurrency {
+	return c.Cryptocurrencies
+}
+
+func (libWallets) GenWallet(cc c.Cryptocurrency) (seed, address string,
+	err error) {
+
+	return cc.GenWallet()
+}
+
+func (libWallets) SendAll(cc c.Cryptocurrency, seed, address string) (
+	tx string, err error) {
+
+	tx, err = cc.SendAll(seed, address)
+	if err != nil && isNoFunds(err) {
+		err = errNoFunds
+	}
+	return
+}
+
+// noFundsMessages of the library (and of nodes behind it) about the
+// empty wallet. Other errors (e.g. "insufficient fee" or "not enough
+// inputs confirmed") are temporary and retried.
+var noFundsMessages = []string{
+	"no funds",
+	"insufficient funds",
+	"insufficient balance",
+	"not enough funds",
+	"not enough balance",
+}
+
+func isNoFunds(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range noFundsMessages {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (libWallets) Validate(cc c.Cryptocurrency, address string) (
+	valid bool, err error) {
+
+	return cc.Validate(address)
+}
+
+// defaultDonationAddresses are donating to this project
+var defaultDonationAddresses = map[c.Cryptocurrency]string{
+	c.Bitcoin:  "bc1q23fyuq7kmngrgqgp6yq9hk8a5q460f39m8nv87",
+	c.Ethereum: "0xD2237129937E40b32db36Cda0Ae2c82B5ceD2380",
+	c.Cardano:  "Ae2tdPwUPEZ68cfEjZjKKRabiqbazMtP69uGaM2pMZRg87fvn4FGvR95BEV",
+}
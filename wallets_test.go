@@ -0,0 +1,127 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+)
+
+// fakeWallets is a deterministic in-memory Wallets backend. Wallets
+// are numbered per currency (seed-btc-1, address-btc-1, ...) and
+// SendAll and SendShares return "tx-" + seed.
+type fakeWallets struct {
+	mutex sync.Mutex
+
+	// delay of SendAll
+	delay time.Duration
+	// failing currencies, SendAll returns the error for them
+	failing map[c.Cryptocurrency]error
+	// invalid addresses
+	invalid map[string]bool
+
+	generated    map[c.Cryptocurrency]int
+	destinations []string
+}
+
+func newFakeWallets() *fakeWallets {
+	return &fakeWallets{
+		failing:   make(map[c.Cryptocurrency]error),
+		invalid:   make(map[string]bool),
+		generated: make(map[c.Cryptocurrency]int),
+	}
+}
+
+func (f *fakeWallets) Currencies() []c.Cryptocurrency {
+	return c.Cryptocurrencies
+}
+
+func (f *fakeWallets) GenWallet(cc c.Cryptocurrency) (seed, address string,
+	err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.generated[cc]++
+	seed = fmt.Sprintf("seed-%s-%d", cc.Symbol(), f.generated[cc])
+	address = fmt.Sprintf("address-%s-%d", cc.Symbol(), f.generated[cc])
+	return
+}
+
+func (f *fakeWallets) SendAll(cc c.Cryptocurrency, seed, address string) (
+	tx string, err error) {
+
+	time.Sleep(f.delay)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	err = f.failing[cc]
+	if err != nil {
+		return
+	}
+
+	f.destinations = append(f.destinations, address)
+	tx = "tx-" + seed
+	return
+}
+
+func (f *fakeWallets) SendShares(cc c.Cryptocurrency, seed string,
+	shares []database.Share) (tx string, err error) {
+
+	time.Sleep(f.delay)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	err = f.failing[cc]
+	if err != nil {
+		return
+	}
+
+	for _, share := range shares {
+		f.destinations = append(f.destinations,
+			fmt.Sprintf("%s (%g%%)", share.Destination, share.Weight))
+	}
+	tx = "tx-" + seed
+	return
+}
+
+func (f *fakeWallets) Validate(cc c.Cryptocurrency, address string) (
+	valid bool, err error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	valid = !f.invalid[address]
+	return
+}
+
+// setFailing makes SendAll of the currency fail (or succeed if err
+// is nil)
+func (f *fakeWallets) setFailing(cc c.Cryptocurrency, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err == nil {
+		delete(f.failing, cc)
+		return
+	}
+	f.failing[cc] = err
+}
+
+// sent returns destinations of successful SendAll and SendShares
+// calls, destinations of shares are followed by the percents
+func (f *fakeWallets) sent() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string{}, f.destinations...)
+}
@@ -0,0 +1,279 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v29/github"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+// verifySignature of the GitHub webhook payload
+// (X-Hub-Signature-256 header)
+func verifySignature(signature string, payload, secret []byte) (err error) {
+	if !strings.HasPrefix(signature, "sha256=") {
+		err = errors.New("no sha256 signature")
+		return
+	}
+
+	sum, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		err = errors.New("invalid signature")
+	}
+	return
+}
+
+// closingIssues returns issues that are closed by the pull request
+// according to the GitHub keywords, e.g. "Fixes #1".
+func closingIssues(body string) (issues []int) {
+	re := regexp.MustCompile(`(?i)\b(?:close[sd]?|fix(?:e[sd])?|` +
+		`resolve[sd]?):?\s+#([0-9]+)`)
+	for _, match := range re.FindAllStringSubmatch(body, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		issues = append(issues, n)
+	}
+	return
+}
+
+func webhookHandler(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, w http.ResponseWriter, r *http.Request,
+	secret []byte, cfg *config) {
+
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = verifySignature(r.Header.Get("X-Hub-Signature-256"),
+		payload, secret)
+	if err != nil {
+		log.Println("webhook:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		log.Println("webhook:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	switch e := event.(type) {
+	case *github.IssuesEvent:
+		err = handleIssuesEvent(db, wallets, fg, ctx, e, cfg)
+	case *github.PullRequestEvent:
+		err = handlePullRequestEvent(db, wallets, fg, ctx, e, cfg)
+	case *github.IssueCommentEvent:
+		err = handleIssueCommentEvent(db, wallets, fg, ctx, e, cfg)
+	default:
+		// ping and events we're not interested in
+	}
+	if err != nil {
+		log.Println("webhook:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func handleIssuesEvent(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, e *github.IssuesEvent, cfg *config) (err error) {
+
+	owner := e.GetRepo().GetOwner().GetLogin()
+	project := e.GetRepo().GetName()
+
+	issue := database.NewIssue()
+	issue.Repo = "github.com/" + owner + "/" + project
+	issue.ID = e.GetIssue().GetNumber()
+
+	switch e.GetAction() {
+	case "opened", "reopened":
+		err = getOrCreateIssue(db, wallets, fg, ctx, owner, project,
+			&issue, cfg)
+		if err == errNotAnIssue || err == errIssueNotOpen {
+			// state was changed since the event
+			err = nil
+		}
+		if err == errRepoNotRegistered {
+			log.Printf("webhook: %s is not registered", issue.Repo)
+			err = nil
+		}
+	case "closed":
+		err = webhookPayout(db, wallets, fg, ctx, owner, project, issue,
+			cfg)
+	}
+	return
+}
+
+func handlePullRequestEvent(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, e *github.PullRequestEvent, cfg *config) (err error) {
+
+	if e.GetAction() != "closed" || !e.GetPullRequest().GetMerged() {
+		return
+	}
+
+	owner := e.GetRepo().GetOwner().GetLogin()
+	project := e.GetRepo().GetName()
+
+	pr := forge.PullRequest{
+		Number:   e.GetPullRequest().GetNumber(),
+		Author:   e.GetPullRequest().GetUser().GetLogin(),
+		Body:     e.GetPullRequest().GetBody(),
+		MergeSHA: e.GetPullRequest().GetMergeCommitSHA(),
+	}
+
+	for _, id := range closingIssues(pr.Body) {
+		issue := database.NewIssue()
+		issue.Repo = "github.com/" + owner + "/" + project
+		issue.ID = id
+
+		err = snapshotPullRequest(db, wallets, fg, ctx, owner, project,
+			issue, pr)
+		if err != nil {
+			return
+		}
+
+		err = webhookPayout(db, wallets, fg, ctx, owner, project,
+			issue, cfg)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// handleIssueCommentEvent runs payout on claim and pay commands, in
+// comments of the issue or of the pull request that closes issues
+func handleIssueCommentEvent(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, e *github.IssueCommentEvent, cfg *config) (
+	err error) {
+
+	if e.GetAction() != "created" && e.GetAction() != "edited" {
+		return
+	}
+
+	body := e.GetComment().GetBody()
+	if !claimRe.MatchString(body) && !payRe.MatchString(body) {
+		return
+	}
+
+	owner := e.GetRepo().GetOwner().GetLogin()
+	project := e.GetRepo().GetName()
+
+	ids := []int{e.GetIssue().GetNumber()}
+	if e.GetIssue().IsPullRequest() {
+		ids = closingIssues(e.GetIssue().GetBody())
+	}
+
+	for _, id := range ids {
+		issue := database.NewIssue()
+		issue.Repo = "github.com/" + owner + "/" + project
+		issue.ID = id
+
+		err = webhookPayout(db, wallets, fg, ctx, owner, project,
+			issue, cfg)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// snapshotPullRequest records addresses of the pull request at merge
+// if the issue has wallets
+func snapshotPullRequest(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, owner, project string, issue database.Issue,
+	pr forge.PullRequest) (err error) {
+
+	exists, err := database.IsExists(db, issue)
+	if err != nil || !exists {
+		return
+	}
+
+	err = database.GetWallets(db, &issue, database.HideSeed)
+	if err != nil {
+		return
+	}
+
+	_, err = snapshotContributors(db, fg, ctx, owner, project, issue,
+		issueCurrencies(wallets, issue), []forge.PullRequest{pr})
+	return
+}
+
+// webhookPayout runs payout for the issue if it has wallets,
+// issues that are still open are skipped because GitHub can
+// deliver the pull request event before closing of the issue.
+func webhookPayout(db *database.DB, wallets Wallets, fg forge.Forge,
+	ctx context.Context, owner, project string, issue database.Issue,
+	cfg *config) (err error) {
+
+	exists, err := database.IsExists(db, issue)
+	if err != nil || !exists {
+		return
+	}
+
+	err = database.GetWallets(db, &issue, database.ShowSeed)
+	if err != nil {
+		return
+	}
+
+	transactions, sent, err := payout(db, wallets, fg, ctx, owner,
+		project, issue, cfg)
+	if err == errPayoutPending {
+		log.Printf("webhook: %s#%d is waiting for approval",
+			issue.Repo, issue.ID)
+		err = nil
+		return
+	}
+	if err == errIssueOpen {
+		err = nil
+		return
+	}
+	if err == errClaimMissing || err == errClaimWindow ||
+		err == errSplitRequired {
+
+		log.Printf("webhook: %s#%d: %v", issue.Repo, issue.ID, err)
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if sent {
+		log.Printf("webhook: %s#%d paid: %v", issue.Repo, issue.ID,
+			transactions)
+	}
+	return
+}
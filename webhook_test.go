@@ -0,0 +1,235 @@
+// Copyright 2020 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	c "code.dumpstack.io/lib/cryptocurrency"
+
+	"code.dumpstack.io/tools/donate/database"
+	"code.dumpstack.io/tools/donate/forge"
+)
+
+var testWebhookSecret = []byte("It's a Secret to Everybody")
+
+func deliver(t *testing.T, db *database.DB, wallets Wallets, fg forge.Forge,
+	event, name string, secret []byte) (code int) {
+
+	payload, err := ioutil.ReadFile(filepath.Join("testdata", "webhook", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	r := httptest.NewRequest("POST", "/webhook", bytes.NewReader(payload))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	defaultDests := make(map[c.Cryptocurrency]string)
+	for _, cc := range c.Cryptocurrencies {
+		defaultDests[cc] = "default-" + cc.Symbol()
+	}
+
+	w := httptest.NewRecorder()
+	webhookHandler(db, wallets, fg, context.Background(), w, r,
+		testWebhookSecret, testConfig(defaultDests, false))
+	return w.Code
+}
+
+func TestWebhookSignature(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Open,
+	})
+
+	wallets := newFakeWallets()
+
+	code := deliver(t, db, wallets, fg, "issues", "issues_opened.json",
+		[]byte("wrong secret"))
+	if code != http.StatusUnauthorized {
+		t.Fatal("invalid signature is accepted", code)
+	}
+
+	issue := database.Issue{Repo: "github.com/owner/project", ID: 1}
+	exists, err := database.IsExists(db, issue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("wallets are created for unsigned event")
+	}
+
+	code = deliver(t, db, wallets, fg, "ping", "ping.json", testWebhookSecret)
+	if code != http.StatusOK {
+		t.Fatal("ping is failed", code)
+	}
+}
+
+func TestWebhookIssues(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Open,
+	})
+	fg.SetFile("owner", "project", ".github/workflows/donate.yml")
+
+	wallets := newFakeWallets()
+
+	code := deliver(t, db, wallets, fg, "issues", "issues_opened.json",
+		testWebhookSecret)
+	if code != http.StatusOK {
+		t.Fatal("issues opened is failed", code)
+	}
+
+	issue := database.NewIssue()
+	issue.Repo = "github.com/owner/project"
+	issue.ID = 1
+	err := database.GetWallets(db, &issue, database.HideSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue.Wallets[c.Bitcoin].Address != "address-btc-1" {
+		t.Fatal("wallets are not created")
+	}
+
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+
+	code = deliver(t, db, wallets, fg, "issues", "issues_closed.json",
+		testWebhookSecret)
+	if code != http.StatusOK {
+		t.Fatal("issues closed is failed", code)
+	}
+
+	if len(wallets.sent()) != len(c.Cryptocurrencies) {
+		t.Fatal("not all wallets are paid to default", wallets.sent())
+	}
+
+	// Redelivery should not pay twice
+	code = deliver(t, db, wallets, fg, "issues", "issues_closed.json",
+		testWebhookSecret)
+	if code != http.StatusOK {
+		t.Fatal("redelivery is failed", code)
+	}
+	if len(wallets.sent()) != len(c.Cryptocurrencies) {
+		t.Fatal("paid twice", wallets.sent())
+	}
+}
+
+func TestWebhookPullRequest(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	addTestIssue(t, db, "github.com/owner/project", 1)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 1,
+		State:  forge.Closed,
+	})
+	// The body is edited after the merge, addresses of the
+	// webhook payload are paid
+	err := fg.SetClosingPullRequest("owner", "project", 1, forge.PullRequest{
+		Number: 2,
+		Author: "contributor",
+		Body:   "Fixes #1\r\n\r\nBTC{bc1qedited}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := newFakeWallets()
+
+	code := deliver(t, db, wallets, fg, "pull_request", "pull_request_merged.json",
+		testWebhookSecret)
+	if code != http.StatusOK {
+		t.Fatal("pull request is failed", code)
+	}
+
+	expected := []string{"bc1qcontributor"}
+	for _, cc := range c.Cryptocurrencies[1:] {
+		expected = append(expected, "default-"+cc.Symbol())
+	}
+	if !reflect.DeepEqual(wallets.sent(), expected) {
+		t.Fatal("invalid payout", wallets.sent())
+	}
+}
+
+func TestWebhookClaimComment(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	addTestIssue(t, db, "github.com/owner/project", 3)
+
+	fg := forge.NewFake()
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 3,
+		State:  forge.Closed,
+	})
+	err := fg.SetClosingPullRequest("owner", "project", 3, forge.PullRequest{
+		Number: 4,
+		Author: "contributor",
+		Body:   "Fixes #3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pull requests are issues on GitHub
+	fg.SetIssue("owner", "project", forge.Issue{
+		Number: 4,
+		State:  forge.Closed,
+	})
+	err = fg.AddComment("owner", "project", 4, "contributor",
+		"/claim BTC{bc1qclaimed}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := newFakeWallets()
+
+	code := deliver(t, db, wallets, fg, "issue_comment",
+		"issue_comment_claim.json", testWebhookSecret)
+	if code != http.StatusOK {
+		t.Fatal("issue comment is failed", code)
+	}
+
+	expected := []string{"bc1qclaimed"}
+	for _, cc := range c.Cryptocurrencies[1:] {
+		expected = append(expected, "default-"+cc.Symbol())
+	}
+	if !reflect.DeepEqual(wallets.sent(), expected) {
+		t.Fatal("invalid payout", wallets.sent())
+	}
+}
+
+func TestClosingIssues(t *testing.T) {
+	body := "Fixes #1, closes #22\nresolved: #3\nsee #4, prefix#5"
+	if !reflect.DeepEqual(closingIssues(body), []int{1, 22, 3}) {
+		t.Fatal("invalid closing issues", closingIssues(body))
+	}
+}